@@ -1,8 +1,8 @@
-// +heroku goVersion go1.14
+// +heroku goVersion go1.15
 // +heroku install -tags 'postgres' github.com/golang-migrate/migrate/v4/cmd/migrate .
 module github.com/cga1123/bissy-api
 
-go 1.14
+go 1.15
 
 require (
 	github.com/DATA-DOG/go-txdb v0.1.4
@@ -21,7 +21,12 @@ require (
 	github.com/honeycombio/beeline-go v0.11.1
 	github.com/jmoiron/sqlx v1.3.4
 	github.com/lib/pq v1.10.2
+	github.com/mattn/go-sqlite3 v1.14.6
 	github.com/rs/cors v1.7.0
 	github.com/slack-go/slack v0.9.1
 	github.com/snowflakedb/gosnowflake v1.5.0
 )
+
+// beeline-go requires v2.0.3 of go-sqlite3, which was retracted in favour of
+// v1.14
+exclude github.com/mattn/go-sqlite3 v2.0.3+incompatible
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"time"
 
 	"github.com/bugsnag/bugsnag-go"
@@ -43,6 +44,45 @@ const (
 	slackBotTokenVar           = "SLACK_BOT_TOKEN"
 	slackerdutySlackChannelVar = "SLACKERDUTY_SLACK_CHANNEL"
 	bugsnagAPIKeyVar           = "BUGSNAG_API_KEY"
+	queryCacheMaxBytesVar      = "QUERYCACHE_MAX_CACHE_BYTES"
+	queryCacheMaxOpenVar       = "QUERYCACHE_DB_MAX_OPEN"
+	queryCacheMaxIdleVar       = "QUERYCACHE_DB_MAX_IDLE"
+	queryCacheMaxIdleTimeVar   = "QUERYCACHE_DB_MAX_IDLE_TIME"
+	queryCacheQueryTimeoutVar  = "QUERYCACHE_QUERY_TIMEOUT"
+	queryCacheRefreshInterval  = "QUERYCACHE_REFRESH_INTERVAL"
+	queryCacheRefreshLead      = "QUERYCACHE_REFRESH_LEAD"
+	queryCacheRefreshJitter    = "QUERYCACHE_REFRESH_JITTER"
+	queryCacheRefreshWorkers   = "QUERYCACHE_REFRESH_CONCURRENCY"
+	queryCacheRunRetentionVar  = "QUERYCACHE_RUN_RETENTION"
+	queryCacheRunWorkersVar    = "QUERYCACHE_RUN_CONCURRENCY"
+	queryCacheRunBacklogVar    = "QUERYCACHE_RUN_BACKLOG"
+	queryCacheRunTimeoutVar    = "QUERYCACHE_RUN_TIMEOUT"
+	queryCacheRunResultVar     = "QUERYCACHE_RUN_RESULT_LIFETIME"
+	queryCacheExplainVar       = "QUERYCACHE_EXPLAIN_QUERIES"
+	queryCacheCatalogVar       = "QUERYCACHE_CATALOG_LIFETIME"
+	queryCacheKeysVar          = "QUERYCACHE_ENCRYPTION_KEYS"
+	queryCacheSQLiteVar        = "QUERYCACHE_SQLITE_DIR"
+)
+
+const (
+	defaultQueryCacheMaxBytes    = 10 * 1024 * 1024
+	defaultQueryCacheMaxOpen     = 5
+	defaultQueryCacheMaxIdle     = 2
+	defaultQueryCacheMaxIdleTime = 5 * time.Minute
+	defaultQueryCacheTimeout     = 10 * time.Second
+	defaultQueryCacheRefresh     = time.Minute
+	defaultQueryCacheLead        = time.Minute
+	defaultQueryCacheJitter      = 30 * time.Second
+	defaultQueryCacheWorkers     = 2
+	defaultQueryCacheRetention   = 30 * 24 * time.Hour
+	queryCachePruneInterval      = time.Hour
+	defaultQueryCacheRunWorkers  = 2
+	defaultQueryCacheRunBacklog  = 100
+	defaultQueryCacheRunTimeout  = time.Hour
+	defaultQueryCacheRunResult   = 24 * time.Hour
+	defaultQueryCacheCatalog     = 10 * time.Minute
+	queryCacheReencryptBatch     = 100
+	queryCacheReencryptInterval  = time.Second
 )
 
 func setupBugsnag(apiKey string) {
@@ -106,15 +146,122 @@ func initDb(env map[string]string) *hnysqlx.DB {
 	return hnysqlx.WrapDB(db)
 }
 
-func initQueryCache(db *hnysqlx.DB, clock utils.Clock, gen utils.IDGenerator, redisClient *redis.Client) *querycache.Config {
+func intEnv(name string, fallback int) int {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Fatalf("failed to parse %v %v", name, err)
+	}
+
+	return i
+}
+
+func boolEnv(name string, fallback bool) bool {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Fatalf("failed to parse %v %v", name, err)
+	}
+
+	return b
+}
+
+func durationEnv(name string, fallback time.Duration) time.Duration {
+	value, ok := os.LookupEnv(name)
+	if !ok {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Fatalf("failed to parse %v %v", name, err)
+	}
+
+	return d
+}
+
+func initKeyring() *querycache.Keyring {
+	value, ok := os.LookupEnv(queryCacheKeysVar)
+	if !ok || value == "" {
+		return nil
+	}
+
+	keyring, err := querycache.ParseKeyring(value)
+	if err != nil {
+		log.Fatalf("failed to parse %v %v", queryCacheKeysVar, err)
+	}
+
+	return keyring
+}
+
+// initSQLite enables sqlite datasources, confined to the directory set, for
+// local development and tests only
+func initSQLite() {
+	dir, ok := os.LookupEnv(queryCacheSQLiteVar)
+	if !ok || dir == "" {
+		return
+	}
+
+	if err := querycache.EnableSQLite(dir); err != nil {
+		log.Fatalf("failed to enable sqlite datasources in %v %v", dir, err)
+	}
+}
+
+func initQueryCache(db *hnysqlx.DB, clock utils.Clock, gen utils.IDGenerator, redisClient *redis.Client, datasources *querycache.SQLDatasourceStore) *querycache.Config {
+	connections := querycache.NewConnections(querycache.ConnectionOptions{
+		MaxOpen:     intEnv(queryCacheMaxOpenVar, defaultQueryCacheMaxOpen),
+		MaxIdle:     intEnv(queryCacheMaxIdleVar, defaultQueryCacheMaxIdle),
+		MaxIdleTime: durationEnv(queryCacheMaxIdleTimeVar, defaultQueryCacheMaxIdleTime),
+	})
+
 	return &querycache.Config{
 		QueryStore:      querycache.NewSQLQueryStore(db, clock, gen),
-		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, gen),
+		DatasourceStore: querycache.NewConnectionClosingStore(datasources, connections),
+		RunStore:        querycache.NewSQLRunStore(db, gen),
+		SnapshotStore:   querycache.NewSQLSnapshotStore(db, gen),
+		RevisionStore:   querycache.NewSQLRevisionStore(db, gen),
+		CatalogStore:    querycache.NewSQLCatalogStore(db, gen),
 		Cache:           &querycache.RedisCache{Client: redisClient},
 		Clock:           clock,
+		Connections:     connections,
+		MaxCacheBytes:   intEnv(queryCacheMaxBytesVar, defaultQueryCacheMaxBytes),
+		QueryTimeout:    durationEnv(queryCacheQueryTimeoutVar, defaultQueryCacheTimeout),
+		CatalogLifetime: durationEnv(queryCacheCatalogVar, defaultQueryCacheCatalog),
+		ExplainQueries:  boolEnv(queryCacheExplainVar, false),
 	}
 }
 
+func initQueryCacheScheduler(config *querycache.Config) *querycache.Scheduler {
+	scheduler, err := querycache.NewScheduler(config, querycache.SchedulerOptions{
+		Interval:    durationEnv(queryCacheRefreshInterval, defaultQueryCacheRefresh),
+		Lead:        durationEnv(queryCacheRefreshLead, defaultQueryCacheLead),
+		Jitter:      durationEnv(queryCacheRefreshJitter, defaultQueryCacheJitter),
+		Concurrency: intEnv(queryCacheRefreshWorkers, defaultQueryCacheWorkers),
+	})
+	if err != nil {
+		log.Fatalf("failed to configure %v %v", queryCacheRefreshInterval, err)
+	}
+
+	return scheduler
+}
+
+func initQueryCacheRunner(config *querycache.Config) *querycache.Runner {
+	return querycache.NewRunner(config, querycache.RunnerOptions{
+		Concurrency:    intEnv(queryCacheRunWorkersVar, defaultQueryCacheRunWorkers),
+		Backlog:        intEnv(queryCacheRunBacklogVar, defaultQueryCacheRunBacklog),
+		Timeout:        durationEnv(queryCacheRunTimeoutVar, defaultQueryCacheRunTimeout),
+		ResultLifetime: durationEnv(queryCacheRunResultVar, defaultQueryCacheRunResult),
+	})
+}
+
 func requireEnv() map[string]string {
 	env, err := utils.RequireEnv(
 		redisURLVar,
@@ -160,7 +307,7 @@ func runServer(handler http.Handler, port string) *http.Server {
 	return server
 }
 
-func shutdown(server *http.Server) {
+func shutdown(server *http.Server, cleanup ...func()) {
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
 	<-c
@@ -169,6 +316,10 @@ func shutdown(server *http.Server) {
 	defer cancel()
 	server.Shutdown(ctx)
 
+	for _, f := range cleanup {
+		f()
+	}
+
 	log.Println("shutting down")
 }
 
@@ -208,10 +359,20 @@ func main() {
 	apikeyConfig.SetupHandlers(apikeyMux)
 
 	// querycache
-	queryCacheConfig := initQueryCache(db, clock, generator, redisClient)
+	initSQLite()
+	datasourceStore := querycache.NewEncryptedSQLDatasourceStore(db, clock, generator, initKeyring())
+	queryCacheConfig := initQueryCache(db, clock, generator, redisClient, datasourceStore)
+	queryCacheConfig.Runner = initQueryCacheRunner(queryCacheConfig).Start()
 	querycacheMux := router.PathPrefix("/querycache").Subrouter()
 	querycacheMux.Use(authConfig.Middleware)
 	queryCacheConfig.SetupHandlers(querycacheMux)
+	queryCacheScheduler := initQueryCacheScheduler(queryCacheConfig).Start()
+	pruneCtx, stopPruning := context.WithCancel(context.Background())
+	go querycache.PruneRuns(pruneCtx, queryCacheConfig.RunStore, clock,
+		durationEnv(queryCacheRunRetentionVar, defaultQueryCacheRetention),
+		queryCachePruneInterval)
+	go querycache.ReencryptDatasources(pruneCtx, datasourceStore,
+		queryCacheReencryptBatch, queryCacheReencryptInterval)
 
 	// slackerduty
 	slackerdutyConfig := &slackerduty.Config{
@@ -223,7 +384,17 @@ func main() {
 
 	handler := handlers.LoggingHandler(os.Stdout, bugsnag.Handler(hnynethttp.WrapHandler(router)))
 
-	shutdown(runServer(handler, env[portVar]))
+	shutdown(
+		runServer(handler, env[portVar]),
+		queryCacheScheduler.Stop,
+		queryCacheConfig.Runner.Stop,
+		stopPruning,
+		func() {
+			if err := queryCacheConfig.Connections.Shutdown(); err != nil {
+				log.Printf("failed to close querycache connections %v", err)
+			}
+		},
+	)
 
 	os.Exit(0)
 }
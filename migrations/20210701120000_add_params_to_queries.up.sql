@@ -0,0 +1,2 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS params jsonb NOT NULL DEFAULT '[]';
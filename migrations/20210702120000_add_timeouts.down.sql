@@ -0,0 +1,5 @@
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS timeout;
+
+ALTER TABLE querycache_datasources
+DROP COLUMN IF EXISTS timeout;
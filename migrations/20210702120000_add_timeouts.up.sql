@@ -0,0 +1,5 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS timeout varchar(255) NOT NULL DEFAULT '0';
+
+ALTER TABLE querycache_datasources
+ADD COLUMN IF NOT EXISTS timeout varchar(255) NOT NULL DEFAULT '0';
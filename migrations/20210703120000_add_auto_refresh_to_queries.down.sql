@@ -0,0 +1,2 @@
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS auto_refresh;
@@ -0,0 +1,3 @@
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS stale_while_revalidate,
+DROP COLUMN IF EXISTS stale_if_error;
@@ -0,0 +1,3 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS stale_while_revalidate varchar(255) NOT NULL DEFAULT '0',
+ADD COLUMN IF NOT EXISTS stale_if_error varchar(255) NOT NULL DEFAULT '0';
@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS querycache_runs (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    query_id uuid NOT NULL,
+    datasource_id uuid NOT NULL,
+    trigger varchar(255) NOT NULL,
+    started_at timestamp NOT NULL,
+    ended_at timestamp NOT NULL,
+    row_count bigint NOT NULL,
+    bytes bigint NOT NULL,
+    cache_hit boolean NOT NULL,
+    error text,
+    PRIMARY KEY (id),
+    FOREIGN KEY (query_id) REFERENCES querycache_queries(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS querycache_runs_query_id_started_at_idx
+ON querycache_runs (query_id, started_at);
+
+CREATE INDEX IF NOT EXISTS querycache_runs_started_at_idx
+ON querycache_runs (started_at);
@@ -0,0 +1,2 @@
+ALTER TABLE querycache_runs
+DROP COLUMN IF EXISTS status;
@@ -0,0 +1,2 @@
+ALTER TABLE querycache_runs
+ADD COLUMN IF NOT EXISTS status varchar(255) NOT NULL DEFAULT 'succeeded';
@@ -0,0 +1,7 @@
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS max_rows,
+DROP COLUMN IF EXISTS max_bytes;
+
+ALTER TABLE querycache_datasources
+DROP COLUMN IF EXISTS max_rows,
+DROP COLUMN IF EXISTS max_bytes;
@@ -0,0 +1,7 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS max_rows integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS max_bytes integer NOT NULL DEFAULT 0;
+
+ALTER TABLE querycache_datasources
+ADD COLUMN IF NOT EXISTS max_rows integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS max_bytes integer NOT NULL DEFAULT 0;
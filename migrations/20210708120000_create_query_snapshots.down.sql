@@ -0,0 +1,6 @@
+DROP TABLE IF EXISTS querycache_snapshots;
+
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS snapshot_count,
+DROP COLUMN IF EXISTS snapshot_retention,
+DROP COLUMN IF EXISTS snapshot_key;
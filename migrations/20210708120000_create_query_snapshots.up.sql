@@ -0,0 +1,20 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS snapshot_count integer NOT NULL DEFAULT 0,
+ADD COLUMN IF NOT EXISTS snapshot_retention varchar(255) NOT NULL DEFAULT '0',
+ADD COLUMN IF NOT EXISTS snapshot_key varchar(255) NOT NULL DEFAULT '';
+
+CREATE TABLE IF NOT EXISTS querycache_snapshots (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    query_id uuid NOT NULL,
+    args_hash varchar(255) NOT NULL,
+    hash varchar(255) NOT NULL,
+    row_count bigint NOT NULL,
+    result text NOT NULL,
+    created_at timestamp NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (query_id) REFERENCES querycache_queries(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS querycache_snapshots_query_id_created_at_idx
+ON querycache_snapshots (query_id, created_at);
@@ -0,0 +1,2 @@
+ALTER TABLE querycache_datasources
+DROP COLUMN IF EXISTS read_only;
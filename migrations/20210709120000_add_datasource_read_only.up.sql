@@ -0,0 +1,2 @@
+ALTER TABLE querycache_datasources
+ADD COLUMN IF NOT EXISTS read_only boolean NOT NULL DEFAULT true;
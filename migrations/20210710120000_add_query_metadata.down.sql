@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS querycache_queries_search_idx;
+DROP INDEX IF EXISTS querycache_queries_tags_idx;
+DROP INDEX IF EXISTS querycache_queries_user_id_datasource_id_idx;
+
+ALTER TABLE querycache_queries
+DROP COLUMN IF EXISTS name,
+DROP COLUMN IF EXISTS description,
+DROP COLUMN IF EXISTS tags;
@@ -0,0 +1,13 @@
+ALTER TABLE querycache_queries
+ADD COLUMN IF NOT EXISTS name varchar(255) NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS description text NOT NULL DEFAULT '',
+ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+
+CREATE INDEX IF NOT EXISTS querycache_queries_user_id_datasource_id_idx
+ON querycache_queries (user_id, datasource_id);
+
+CREATE INDEX IF NOT EXISTS querycache_queries_tags_idx
+ON querycache_queries USING GIN (tags);
+
+CREATE INDEX IF NOT EXISTS querycache_queries_search_idx
+ON querycache_queries USING GIN (to_tsvector('english', name || ' ' || description || ' ' || query));
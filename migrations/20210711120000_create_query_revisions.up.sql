@@ -0,0 +1,21 @@
+CREATE TABLE IF NOT EXISTS querycache_revisions (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    query_id uuid NOT NULL,
+    query text NOT NULL,
+    datasource_id uuid NOT NULL,
+    restored_from uuid,
+    created_at timestamp NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (query_id) REFERENCES querycache_queries(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS querycache_revisions_query_id_created_at_idx
+ON querycache_revisions (query_id, created_at);
+
+-- existing queries start with a revision of their current SQL and datasource,
+-- with an id derived from theirs
+INSERT INTO querycache_revisions (id, user_id, query_id, query, datasource_id, created_at)
+SELECT md5(id::text || ':revision')::uuid, user_id, id, query, datasource_id, updated_at
+FROM querycache_queries
+ON CONFLICT DO NOTHING;
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS querycache_catalog_snapshots;
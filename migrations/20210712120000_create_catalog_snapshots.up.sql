@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS querycache_catalog_snapshots (
+    id uuid NOT NULL,
+    user_id uuid NOT NULL,
+    datasource_id uuid NOT NULL,
+    hash varchar(255) NOT NULL,
+    catalog text NOT NULL,
+    created_at timestamp NOT NULL,
+    PRIMARY KEY (id),
+    FOREIGN KEY (datasource_id) REFERENCES querycache_datasources(id) ON DELETE CASCADE ON UPDATE CASCADE
+);
+
+CREATE INDEX IF NOT EXISTS querycache_catalog_snapshots_datasource_id_created_at_idx
+ON querycache_catalog_snapshots (datasource_id, created_at);
@@ -0,0 +1,12 @@
+-- encrypted options can't be decrypted here, refuse to drop the key they were
+-- encrypted with rather than leave them unreadable
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM querycache_datasources WHERE options_key_id <> '') THEN
+        RAISE EXCEPTION 'querycache_datasources has encrypted options, which would be unreadable once rolled back';
+    END IF;
+END
+$$;
+
+ALTER TABLE querycache_datasources
+DROP COLUMN IF EXISTS options_key_id;
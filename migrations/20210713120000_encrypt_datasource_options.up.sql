@@ -0,0 +1,5 @@
+-- encrypted options are longer than the plaintext, and identify the key they
+-- were encrypted with, existing rows are left in plaintext until re-encrypted
+ALTER TABLE querycache_datasources
+ALTER COLUMN options TYPE text,
+ADD COLUMN IF NOT EXISTS options_key_id varchar(255) NOT NULL DEFAULT '';
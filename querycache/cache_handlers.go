@@ -0,0 +1,117 @@
+package querycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+var errCacheDisabled = &handlerutils.HandlerError{
+	Err: fmt.Errorf("caching is not enabled"), Status: http.StatusNotImplemented}
+
+var errEvictUnsupported = &handlerutils.HandlerError{
+	Err: fmt.Errorf("the cache does not support evicting queries"), Status: http.StatusNotImplemented}
+
+// evict removes every cached result of the query, if the cache supports it.
+// Failures are only logged, the results expire on their own.
+func (c *Config) evict(queryID string) {
+	evicter, ok := c.Cache.(Evicter)
+	if !ok {
+		return
+	}
+
+	if err := evicter.Evict(queryID); err != nil {
+		log.Printf("querycache: failed to evict query %v: %v", queryID, err)
+	}
+}
+
+// noCache determines whether the request asks for a result that was not
+// served from a cache, through its Cache-Control header
+func noCache(r *http.Request) bool {
+	for _, header := range r.Header.Values("Cache-Control") {
+		for _, directive := range strings.Split(header, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-cache") {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func (c *Config) queryRefresh(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.Cache == nil {
+		return errCacheDisabled
+	}
+
+	async := r.URL.Query().Get("async") == "true"
+	if async && c.Runner == nil {
+		return errRunsDisabled
+	}
+
+	query, args, err := c.boundQuery(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	if async {
+		run, err := c.Runner.EnqueueTrigger(query, args, TriggerManual)
+		if err == ErrRunQueueFull {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusServiceUnavailable}
+		} else if err != nil {
+			return err
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+
+		return json.NewEncoder(w).Encode(run)
+	}
+
+	format, options, err := resultFormatOptions(r)
+	if err != nil {
+		return err
+	}
+
+	executor, timeout, err := c.datasourceExecutor(query, c.QueryTimeout)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(WithTrigger(r.Context(), TriggerManual), timeout)
+	defer cancel()
+
+	result, err := c.cachedExecutor(executor).Refresh(ctx, query, args)
+	if err != nil {
+		return executionError(r.Context(), ctx, query, timeout, err)
+	}
+
+	handlerutils.ContentType(w, format.ContentType)
+
+	return result.Write(newQueryResultWriter(w, r, format, options, query))
+}
+
+func (c *Config) queryCacheDelete(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	evicter, ok := c.Cache.(Evicter)
+	if !ok {
+		return errEvictUnsupported
+	}
+
+	query, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	if err := evicter.Evict(query.ID); err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+
+	return nil
+}
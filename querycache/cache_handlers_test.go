@@ -0,0 +1,135 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/cga1123/bissy-api/utils/expecthttp"
+)
+
+func TestQueryRefresh(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		RunStore:        querycache.NewSQLRunStore(db, generator),
+		Cache:           querycache.NewInMemoryCache(),
+		Clock:           clock,
+	}
+	config.Runner = querycache.NewRunner(config, querycache.RunnerOptions{
+		Concurrency: 1, Backlog: 1, ResultLifetime: time.Hour}).Start()
+	defer config.Runner.Stop()
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", Lifetime: querycache.Duration(time.Hour), DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	do := func(method, path string, modify func(*http.Request)) *httptest.ResponseRecorder {
+		request, err := http.NewRequest(method, path, nil)
+		expect.Ok(t, err)
+		modify(request)
+
+		return testHandler(claims, config, request)
+	}
+
+	result := "/queries/" + query.ID + "/result"
+
+	response := do("GET", result, func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	response = do("GET", result, func(*http.Request) {})
+	expect.Equal(t, "HIT", response.Header().Get("X-Cache"))
+
+	// Cache-Control: no-cache bypasses the cache
+	response = do("GET", result, func(r *http.Request) { r.Header.Set("Cache-Control", "max-age=0, no-cache") })
+	expecthttp.Ok(t, response)
+	expecthttp.StringBody(t, "query\nGot: SELECT 1\n", response)
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	// refreshing executes the query, as a manual run
+	response = do("POST", "/queries/"+query.ID+"/refresh", func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expecthttp.StringBody(t, "query\nGot: SELECT 1\n", response)
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	runs, err := config.RunStore.List(claims.UserID, query.ID, 1, 1)
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.TriggerManual, runs[0].Trigger)
+	expect.False(t, runs[0].CacheHit)
+
+	response = do("POST", "/queries/"+query.ID+"/refresh?async=true", func(*http.Request) {})
+	expecthttp.Status(t, http.StatusAccepted, response)
+
+	var run querycache.Run
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&run))
+	expect.Equal(t, querycache.TriggerManual, run.Trigger)
+
+	deadline := time.Now().Add(time.Second)
+	for run.Status != querycache.RunSucceeded && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		updated, err := config.RunStore.Get(claims.UserID, run.ID)
+		expect.Ok(t, err)
+		run = *updated
+	}
+	expect.Equal(t, querycache.RunSucceeded, run.Status)
+
+	// evicting the cache
+	response = do("DELETE", "/queries/"+query.ID+"/cache", func(*http.Request) {})
+	expecthttp.Status(t, http.StatusNoContent, response)
+
+	_, ok := config.Cache.Get(cacheKey(t, query, nil))
+	expect.False(t, ok)
+
+	response = do("GET", result, func(*http.Request) {})
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	// deleting the query evicts it too
+	response = do("DELETE", "/queries/"+query.ID, func(*http.Request) {})
+	expecthttp.Ok(t, response)
+
+	_, ok = config.Cache.Get(cacheKey(t, query, nil))
+	expect.False(t, ok)
+
+	// other users' queries
+	request, err := http.NewRequest("DELETE", "/queries/"+query.ID+"/cache", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
+
+func TestQueryRefreshDisabled(t *testing.T) {
+	t.Parallel()
+
+	config := &querycache.Config{}
+
+	for method, path := range map[string]string{
+		"POST":   "/queries/1/refresh",
+		"DELETE": "/queries/1/cache",
+	} {
+		request, err := http.NewRequest(method, path, nil)
+		expect.Ok(t, err)
+
+		response := testHandler(testClaims(), config, request)
+		expecthttp.Status(t, http.StatusNotImplemented, response)
+	}
+}
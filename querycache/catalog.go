@@ -0,0 +1,323 @@
+package querycache
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrCatalogUnsupported is returned when introspecting a datasource whose
+// driver has no known catalog query
+var ErrCatalogUnsupported = errors.New("listing the schema is not supported by this datasource")
+
+// catalogQueries list the columns of every table and view visible to the
+// datasource's user, outside of each driver's system schemas, in order. sqlite
+// has no information_schema, its tables are listed from sqlite_master.
+var catalogQueries = map[string]string{
+	"postgres":  catalogQuery("'pg_catalog', 'information_schema'"),
+	"mysql":     catalogQuery("'information_schema', 'mysql', 'performance_schema', 'sys'"),
+	"snowflake": catalogQuery("'INFORMATION_SCHEMA'"),
+	"sqlite": `
+		SELECT 'main', m.name, CASE m.type WHEN 'view' THEN 'VIEW' ELSE 'BASE TABLE' END,
+			c.name, c.type, CASE c."notnull" WHEN 0 THEN 'YES' ELSE 'NO' END
+		FROM sqlite_master m, pragma_table_info(m.name) c
+		WHERE m.type IN ('table', 'view') AND m.name NOT LIKE 'sqlite_%'
+		ORDER BY m.name, c.cid`,
+}
+
+func catalogQuery(excluded string) string {
+	return `
+		SELECT c.table_schema, c.table_name, t.table_type, c.column_name, c.data_type, c.is_nullable
+		FROM information_schema.columns c
+		JOIN information_schema.tables t
+		ON t.table_schema = c.table_schema AND t.table_name = c.table_name
+		WHERE c.table_schema NOT IN (` + excluded + `)
+		ORDER BY c.table_schema, c.table_name, c.ordinal_position`
+}
+
+// Catalog describes the schemas of a datasource, along with their tables and
+// views and the columns of each
+type Catalog struct {
+	Schemas []*CatalogSchema `json:"schemas"`
+}
+
+// CatalogSchema is a schema of a Catalog
+type CatalogSchema struct {
+	Name   string          `json:"name"`
+	Tables []*CatalogTable `json:"tables"`
+}
+
+// CatalogTable is a table or view of a CatalogSchema, its Type is as reported
+// by the datasource (e.g. BASE TABLE or VIEW)
+type CatalogTable struct {
+	Name    string          `json:"name"`
+	Type    string          `json:"type"`
+	Columns []CatalogColumn `json:"columns"`
+}
+
+// CatalogColumn is a column of a CatalogTable
+type CatalogColumn struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable bool   `json:"nullable"`
+}
+
+// Cataloger is implemented by Executors which can describe the schemas of
+// their datasource
+type Cataloger interface {
+	Catalog(context.Context) (*Catalog, error)
+}
+
+// add appends the column to the Catalog, which is built in order of schema and
+// table
+func (catalog *Catalog) add(schema, table, tableType string, column CatalogColumn) {
+	if len(catalog.Schemas) == 0 || catalog.Schemas[len(catalog.Schemas)-1].Name != schema {
+		catalog.Schemas = append(catalog.Schemas, &CatalogSchema{Name: schema, Tables: []*CatalogTable{}})
+	}
+
+	s := catalog.Schemas[len(catalog.Schemas)-1]
+	if len(s.Tables) == 0 || s.Tables[len(s.Tables)-1].Name != table {
+		s.Tables = append(s.Tables, &CatalogTable{Name: table, Type: tableType, Columns: []CatalogColumn{}})
+	}
+
+	t := s.Tables[len(s.Tables)-1]
+	t.Columns = append(t.Columns, column)
+}
+
+// Search returns the parts of the Catalog matching the search term, case
+// insensitively. Tables whose name matches are returned whole, otherwise only
+// their matching columns are.
+func (catalog *Catalog) Search(term string) *Catalog {
+	term = strings.ToLower(term)
+	matches := func(name string) bool { return strings.Contains(strings.ToLower(name), term) }
+
+	found := &Catalog{Schemas: []*CatalogSchema{}}
+
+	for _, schema := range catalog.Schemas {
+		tables := []*CatalogTable{}
+
+		for _, table := range schema.Tables {
+			if matches(table.Name) {
+				tables = append(tables, table)
+				continue
+			}
+
+			columns := []CatalogColumn{}
+			for _, column := range table.Columns {
+				if matches(column.Name) {
+					columns = append(columns, column)
+				}
+			}
+
+			if len(columns) > 0 {
+				tables = append(tables, &CatalogTable{Name: table.Name, Type: table.Type, Columns: columns})
+			}
+		}
+
+		if len(tables) > 0 {
+			found.Schemas = append(found.Schemas, &CatalogSchema{Name: schema.Name, Tables: tables})
+		}
+	}
+
+	return found
+}
+
+// hash returns the hex encoded SHA-256 of the JSON representation of the
+// Catalog
+func (catalog *Catalog) hash() (string, error) {
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Value satisfies the driver.Valuer interface, Catalogs are persisted as JSON
+func (catalog *Catalog) Value() (driver.Value, error) {
+	b, err := json.Marshal(catalog)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan satisfies the sql.Scanner interface
+func (catalog *Catalog) Scan(src interface{}) error {
+	switch v := src.(type) {
+	case []byte:
+		return json.Unmarshal(v, catalog)
+	case string:
+		return json.Unmarshal([]byte(v), catalog)
+	default:
+		return fmt.Errorf("cannot scan %T into Catalog", src)
+	}
+}
+
+// Catalog lists the schemas, tables and columns of the configured database
+// through its information_schema
+func (executor *SQLExecutor) Catalog(ctx context.Context) (*Catalog, error) {
+	queryStr, ok := catalogQueries[executor.driver]
+	if !ok {
+		return nil, ErrCatalogUnsupported
+	}
+
+	db, done, err := executor.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	rows, err := db.QueryContext(ctx, queryStr)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	catalog := &Catalog{Schemas: []*CatalogSchema{}}
+
+	for rows.Next() {
+		var schema, table, tableType, nullable string
+		var column CatalogColumn
+
+		if err := rows.Scan(&schema, &table, &tableType, &column.Name, &column.Type, &nullable); err != nil {
+			return nil, err
+		}
+
+		column.Type = strings.ToUpper(column.Type)
+		column.Nullable = nullable == "YES"
+
+		catalog.add(schema, table, tableType, column)
+	}
+
+	return catalog, rows.Err()
+}
+
+// Catalog describes a single table, holding the echoed queries
+func (t *TestExecutor) Catalog(ctx context.Context) (*Catalog, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	catalog := &Catalog{Schemas: []*CatalogSchema{}}
+	catalog.add("public", "queries", "BASE TABLE", CatalogColumn{Name: "query", Type: "TEXT"})
+
+	return catalog, nil
+}
+
+// ColumnChange is a column present in both Catalogs of a CatalogDiff, whose
+// type or nullability differs
+type ColumnChange struct {
+	Name   string        `json:"name"`
+	Before CatalogColumn `json:"before"`
+	After  CatalogColumn `json:"after"`
+}
+
+// TableChange lists the columns added, removed and changed in a table present
+// in both Catalogs of a CatalogDiff
+type TableChange struct {
+	Table   string          `json:"table"`
+	Added   []CatalogColumn `json:"added"`
+	Removed []CatalogColumn `json:"removed"`
+	Changed []*ColumnChange `json:"changed"`
+}
+
+// CatalogDiff lists the tables added, removed and changed between two
+// Catalogs, tables are named as schema.table
+type CatalogDiff struct {
+	Added   []string       `json:"added"`
+	Removed []string       `json:"removed"`
+	Changed []*TableChange `json:"changed"`
+}
+
+// tables indexes the tables of the Catalog by their qualified name, along with
+// their names in order
+func (catalog *Catalog) tables() (map[string]*CatalogTable, []string) {
+	tables := map[string]*CatalogTable{}
+	names := []string{}
+
+	for _, schema := range catalog.Schemas {
+		for _, table := range schema.Tables {
+			name := schema.Name + "." + table.Name
+			tables[name] = table
+			names = append(names, name)
+		}
+	}
+
+	return tables, names
+}
+
+// DiffCatalogs compares Catalog a to Catalog b, reporting how the schema
+// drifted from a to b
+func DiffCatalogs(a, b *Catalog) *CatalogDiff {
+	before, beforeNames := a.tables()
+	after, afterNames := b.tables()
+
+	diff := &CatalogDiff{Added: []string{}, Removed: []string{}, Changed: []*TableChange{}}
+
+	for _, name := range beforeNames {
+		if _, ok := after[name]; !ok {
+			diff.Removed = append(diff.Removed, name)
+		}
+	}
+
+	for _, name := range afterNames {
+		table, ok := before[name]
+		if !ok {
+			diff.Added = append(diff.Added, name)
+			continue
+		}
+
+		if change := diffTables(name, table, after[name]); change != nil {
+			diff.Changed = append(diff.Changed, change)
+		}
+	}
+
+	return diff
+}
+
+// diffTables compares the columns of two versions of a table, returning nil if
+// they are the same
+func diffTables(name string, a, b *CatalogTable) *TableChange {
+	change := &TableChange{
+		Table: name, Added: []CatalogColumn{}, Removed: []CatalogColumn{}, Changed: []*ColumnChange{}}
+
+	before := map[string]CatalogColumn{}
+	for _, column := range a.Columns {
+		before[column.Name] = column
+	}
+
+	after := map[string]CatalogColumn{}
+	for _, column := range b.Columns {
+		after[column.Name] = column
+	}
+
+	for _, column := range a.Columns {
+		if _, ok := after[column.Name]; !ok {
+			change.Removed = append(change.Removed, column)
+		}
+	}
+
+	for _, column := range b.Columns {
+		previous, ok := before[column.Name]
+		if !ok {
+			change.Added = append(change.Added, column)
+		} else if previous != column {
+			change.Changed = append(change.Changed, &ColumnChange{Name: column.Name, Before: previous, After: column})
+		}
+	}
+
+	if len(change.Added) == 0 && len(change.Removed) == 0 && len(change.Changed) == 0 {
+		return nil
+	}
+
+	return change
+}
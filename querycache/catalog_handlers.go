@@ -0,0 +1,213 @@
+package querycache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+var errCatalogSnapshotsDisabled = &handlerutils.HandlerError{
+	Err: fmt.Errorf("schema snapshots are not enabled"), Status: http.StatusNotImplemented}
+
+func catalogCacheKey(datasourceID string) string {
+	return "catalog:" + datasourceID
+}
+
+// cachedCatalog is a Catalog as it is cached, along with the time it was
+// fetched from the datasource
+type cachedCatalog struct {
+	*Catalog
+	FetchedAt time.Time `json:"fetchedAt"`
+}
+
+func (c *Config) datasourceSchema(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	datasource, err := c.DatasourceStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	catalog, hit, err := c.catalog(r, datasource)
+	if err != nil {
+		return err
+	}
+
+	if hit {
+		w.Header().Set("X-Cache", "HIT")
+	} else {
+		w.Header().Set("X-Cache", "MISS")
+	}
+
+	if search := r.URL.Query().Get("search"); search != "" {
+		catalog = &cachedCatalog{Catalog: catalog.Search(search), FetchedAt: catalog.FetchedAt}
+	}
+
+	return json.NewEncoder(w).Encode(catalog)
+}
+
+// catalog returns the Catalog of the datasource, from the cache unless the
+// request asks for it not to be. Catalogs fetched from the datasource are
+// cached for CatalogLifetime, and snapshotted if they changed.
+func (c *Config) catalog(r *http.Request, datasource *Datasource) (*cachedCatalog, bool, error) {
+	key := catalogCacheKey(datasource.ID)
+	caching := c.Cache != nil && c.CatalogLifetime > 0
+
+	if caching && !noCache(r) {
+		if value, ok := c.Cache.Get(key); ok {
+			var cached cachedCatalog
+			if err := json.Unmarshal([]byte(value), &cached); err == nil {
+				return &cached, true, nil
+			}
+		}
+	}
+
+	executor, err := datasource.NewExecutor(c.Connections)
+	if err != nil {
+		return nil, false, err
+	}
+
+	cataloger, ok := executor.(Cataloger)
+	if !ok {
+		return nil, false, &handlerutils.HandlerError{
+			Err: ErrCatalogUnsupported, Status: http.StatusNotImplemented}
+	}
+
+	timeout := queryTimeout(&Query{}, datasource, c.QueryTimeout)
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
+
+	catalog, err := cataloger.Catalog(ctx)
+	if err == ErrCatalogUnsupported {
+		return nil, false, &handlerutils.HandlerError{
+			Err: err, Status: http.StatusNotImplemented}
+	} else if ctx.Err() == context.DeadlineExceeded {
+		return nil, false, &handlerutils.HandlerError{
+			Err:    fmt.Errorf("listing the schema of datasource %v timed out after %v", datasource.ID, timeout),
+			Status: http.StatusGatewayTimeout}
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	fetched := &cachedCatalog{Catalog: catalog, FetchedAt: c.now()}
+
+	if caching {
+		if b, err := json.Marshal(fetched); err != nil {
+			log.Printf("querycache: failed to encode schema of datasource %v: %v", datasource.ID, err)
+		} else if err := c.Cache.Set(key, string(b), c.CatalogLifetime); err != nil {
+			log.Printf("querycache: failed to cache schema of datasource %v: %v", datasource.ID, err)
+		}
+	}
+
+	c.snapshotCatalog(datasource, fetched)
+
+	return fetched, false, nil
+}
+
+// snapshotCatalog records a CatalogSnapshot of the fetched Catalog, unless it
+// is the same as the most recent one. Failures are only logged.
+func (c *Config) snapshotCatalog(datasource *Datasource, fetched *cachedCatalog) {
+	if c.CatalogStore == nil {
+		return
+	}
+
+	hash, err := fetched.Catalog.hash()
+	if err != nil {
+		log.Printf("querycache: failed to hash schema of datasource %v: %v", datasource.ID, err)
+		return
+	}
+
+	latest, err := c.CatalogStore.List(datasource.UserID, datasource.ID, 1, 1)
+	if err != nil {
+		log.Printf("querycache: failed to list schema snapshots of datasource %v: %v", datasource.ID, err)
+		return
+	}
+
+	if len(latest) > 0 && latest[0].Hash == hash {
+		return
+	}
+
+	_, err = c.CatalogStore.Create(&CreateCatalogSnapshot{
+		UserID:       datasource.UserID,
+		DatasourceID: datasource.ID,
+		Hash:         hash,
+		Catalog:      fetched.Catalog,
+		CreatedAt:    fetched.FetchedAt,
+	})
+	if err != nil {
+		log.Printf("querycache: failed to snapshot schema of datasource %v: %v", datasource.ID, err)
+	}
+}
+
+func (c *Config) datasourceSchemaSnapshots(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if _, err := c.DatasourceStore.Get(claims.UserID, id); err != nil {
+		return err
+	}
+
+	snapshots := []*CatalogSnapshot{}
+
+	if c.CatalogStore != nil {
+		params := handlerutils.Params(r)
+		page := params.MaybeInt("page", 1)
+		per := params.MaybeInt("per", 25)
+
+		var err error
+		snapshots, err = c.CatalogStore.List(claims.UserID, id, page, per)
+		if err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusInternalServerError}
+		}
+	}
+
+	return json.NewEncoder(w).Encode(snapshots)
+}
+
+func (c *Config) datasourceSchemaSnapshot(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.CatalogStore == nil {
+		return errCatalogSnapshotsDisabled
+	}
+
+	params := handlerutils.Params(r)
+	if err := params.Require("snapshot"); err != nil {
+		return err
+	}
+
+	snapshotID, _ := params.Get("snapshot")
+
+	snapshot, err := c.CatalogStore.Get(claims.UserID, id, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// datasourceSchemaDiff reports the drift of the schema from snapshot a to
+// snapshot b
+func (c *Config) datasourceSchemaDiff(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.CatalogStore == nil {
+		return errCatalogSnapshotsDisabled
+	}
+
+	params := handlerutils.Params(r)
+	if err := params.Require("a", "b"); err != nil {
+		return err
+	}
+
+	snapshots := make([]*CatalogSnapshot, 2)
+	for i, param := range []string{"a", "b"} {
+		snapshotID, _ := params.Get(param)
+
+		var err error
+		snapshots[i], err = c.CatalogStore.Get(claims.UserID, id, snapshotID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return json.NewEncoder(w).Encode(DiffCatalogs(snapshots[0].Catalog, snapshots[1].Catalog))
+}
@@ -0,0 +1,99 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/cga1123/bissy-api/utils/expecthttp"
+)
+
+func TestDatasourceSchema(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		CatalogStore:    querycache.NewSQLCatalogStore(db, generator),
+		Cache:           querycache.NewInMemoryCache(),
+		CatalogLifetime: time.Hour,
+		Clock:           clock,
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	get := func(path string, modify func(*http.Request)) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "/datasources/"+datasource.ID+path, nil)
+		expect.Ok(t, err)
+		modify(request)
+
+		return testHandler(claims, config, request)
+	}
+
+	expected := &querycache.Catalog{Schemas: []*querycache.CatalogSchema{
+		{Name: "public", Tables: []*querycache.CatalogTable{
+			{Name: "queries", Type: "BASE TABLE", Columns: []querycache.CatalogColumn{{Name: "query", Type: "TEXT"}}},
+		}},
+	}}
+
+	response := get("/schema", func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	var catalog querycache.Catalog
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&catalog))
+	expect.Equal(t, expected, &catalog)
+
+	response = get("/schema", func(*http.Request) {})
+	expect.Equal(t, "HIT", response.Header().Get("X-Cache"))
+
+	response = get("/schema?search=missing", func(*http.Request) {})
+	expecthttp.Ok(t, response)
+
+	catalog = querycache.Catalog{}
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&catalog))
+	expect.Equal(t, 0, len(catalog.Schemas))
+
+	response = get("/schema", func(r *http.Request) { r.Header.Set("Cache-Control", "no-cache") })
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+
+	// unchanged schemas are only snapshotted once
+	response = get("/schema/snapshots", func(*http.Request) {})
+	expecthttp.Ok(t, response)
+
+	var snapshots []*querycache.CatalogSnapshot
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&snapshots))
+	expect.Equal(t, 1, len(snapshots))
+
+	snapshot := snapshots[0].ID
+
+	response = get("/schema/snapshots/"+snapshot, func(*http.Request) {})
+	expecthttp.Ok(t, response)
+
+	var full querycache.CatalogSnapshot
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&full))
+	expect.Equal(t, expected, full.Catalog)
+
+	response = get("/schema/snapshots/"+snapshot+"/diff/"+snapshot, func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, querycache.DiffCatalogs(expected, expected), response.Body)
+
+	// other users' datasources
+	request, err := http.NewRequest("GET", "/datasources/"+datasource.ID+"/schema", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
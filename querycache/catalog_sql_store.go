@@ -0,0 +1,76 @@
+package querycache
+
+import (
+	"fmt"
+
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
+)
+
+// SQLCatalogStore defines an SQL implementation of a CatalogStore
+type SQLCatalogStore struct {
+	db          *hnysqlx.DB
+	idGenerator utils.IDGenerator
+}
+
+// NewSQLCatalogStore builds a new SQLCatalogStore
+func NewSQLCatalogStore(db *hnysqlx.DB, generator utils.IDGenerator) *SQLCatalogStore {
+	return &SQLCatalogStore{db: db, idGenerator: generator}
+}
+
+// Create records a new CatalogSnapshot
+func (s *SQLCatalogStore) Create(cs *CreateCatalogSnapshot) (*CatalogSnapshot, error) {
+	queryStr := `
+		INSERT INTO querycache_catalog_snapshots (id, user_id, datasource_id, hash, catalog, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING *`
+
+	var snapshot CatalogSnapshot
+	err := s.db.Get(&snapshot, queryStr, s.idGenerator.Generate(), cs.UserID, cs.DatasourceID,
+		cs.Hash, cs.Catalog, cs.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// Get returns the CatalogSnapshot of the Datasource with associated id from
+// the store, along with its Catalog
+func (s *SQLCatalogStore) Get(userID, datasourceID, id string) (*CatalogSnapshot, error) {
+	var snapshot CatalogSnapshot
+
+	queryStr := "SELECT * FROM querycache_catalog_snapshots WHERE id = $1 AND datasource_id = $2 AND user_id = $3"
+
+	if err := s.db.Get(&snapshot, queryStr, id, datasourceID, userID); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// List returns the requested CatalogSnapshots of a Datasource, most recent
+// first and without their Catalogs
+func (s *SQLCatalogStore) List(userID, datasourceID string, page, per int) ([]*CatalogSnapshot, error) {
+	if page < 1 || per < 1 {
+		return nil,
+			fmt.Errorf("page and per must be greater than 0 (page %v) (per %v)",
+				page, per)
+	}
+
+	snapshots := []*CatalogSnapshot{}
+
+	queryStr := `
+		SELECT id, user_id, datasource_id, hash, created_at
+		FROM querycache_catalog_snapshots
+		WHERE user_id = $1
+		AND datasource_id = $2
+		ORDER BY created_at DESC
+		OFFSET $3
+		LIMIT $4`
+	if err := s.db.Select(&snapshots, queryStr, userID, datasourceID, (page-1)*per, per); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,36 @@
+package querycache
+
+import (
+	"time"
+)
+
+// CatalogSnapshot is a retained copy of the Catalog of a Datasource, taken
+// whenever it is introspected and has changed since the previous one. Hash is
+// a hash of the Catalog's content.
+// Catalog is only set when fetching a single CatalogSnapshot.
+type CatalogSnapshot struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"userId" db:"user_id"`
+	DatasourceID string    `json:"datasourceId" db:"datasource_id"`
+	Hash         string    `json:"hash"`
+	Catalog      *Catalog  `json:"catalog,omitempty"`
+	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
+}
+
+// CreateCatalogSnapshot describes the parameters to record a new
+// CatalogSnapshot
+type CreateCatalogSnapshot struct {
+	UserID       string
+	DatasourceID string
+	Hash         string
+	Catalog      *Catalog
+	CreatedAt    time.Time
+}
+
+// CatalogStore describes a generic Store for CatalogSnapshots, they are listed
+// most recent first
+type CatalogStore interface {
+	Create(*CreateCatalogSnapshot) (*CatalogSnapshot, error)
+	Get(userID, datasourceID, id string) (*CatalogSnapshot, error)
+	List(userID, datasourceID string, page, per int) ([]*CatalogSnapshot, error)
+}
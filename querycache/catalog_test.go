@@ -0,0 +1,115 @@
+package querycache_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func testCatalog() *querycache.Catalog {
+	return &querycache.Catalog{Schemas: []*querycache.CatalogSchema{
+		{Name: "public", Tables: []*querycache.CatalogTable{
+			{Name: "users", Type: "BASE TABLE", Columns: []querycache.CatalogColumn{
+				{Name: "id", Type: "UUID"},
+				{Name: "email", Type: "TEXT"},
+				{Name: "created_at", Type: "TIMESTAMP", Nullable: true},
+			}},
+			{Name: "payments", Type: "BASE TABLE", Columns: []querycache.CatalogColumn{
+				{Name: "id", Type: "UUID"},
+				{Name: "user_id", Type: "UUID"},
+			}},
+		}},
+		{Name: "reporting", Tables: []*querycache.CatalogTable{
+			{Name: "active_users", Type: "VIEW", Columns: []querycache.CatalogColumn{
+				{Name: "email", Type: "TEXT"},
+			}},
+		}},
+	}}
+}
+
+func TestCatalogSearch(t *testing.T) {
+	t.Parallel()
+
+	catalog := testCatalog()
+
+	// matching tables are returned whole
+	expect.Equal(t, &querycache.Catalog{Schemas: []*querycache.CatalogSchema{
+		{Name: "public", Tables: catalog.Schemas[0].Tables[:1]},
+		{Name: "reporting", Tables: catalog.Schemas[1].Tables},
+	}}, catalog.Search("USERS"))
+
+	// otherwise only their matching columns
+	expect.Equal(t, &querycache.Catalog{Schemas: []*querycache.CatalogSchema{
+		{Name: "public", Tables: []*querycache.CatalogTable{
+			{Name: "payments", Type: "BASE TABLE", Columns: []querycache.CatalogColumn{{Name: "user_id", Type: "UUID"}}},
+		}},
+	}}, catalog.Search("user_id"))
+
+	expect.Equal(t, &querycache.Catalog{Schemas: []*querycache.CatalogSchema{}}, catalog.Search("missing"))
+}
+
+func TestDiffCatalogs(t *testing.T) {
+	t.Parallel()
+
+	before := testCatalog()
+	after := testCatalog()
+
+	expect.Equal(t, &querycache.CatalogDiff{
+		Added: []string{}, Removed: []string{}, Changed: []*querycache.TableChange{}},
+		querycache.DiffCatalogs(before, after))
+
+	users := after.Schemas[0].Tables[0]
+	users.Columns = []querycache.CatalogColumn{
+		{Name: "id", Type: "UUID"},
+		{Name: "email", Type: "VARCHAR"},
+		{Name: "name", Type: "TEXT", Nullable: true},
+	}
+	after.Schemas[0].Tables = append(after.Schemas[0].Tables, &querycache.CatalogTable{
+		Name: "refunds", Type: "BASE TABLE", Columns: []querycache.CatalogColumn{{Name: "id", Type: "UUID"}}})
+	after.Schemas = after.Schemas[:1]
+
+	expect.Equal(t, &querycache.CatalogDiff{
+		Added:   []string{"public.refunds"},
+		Removed: []string{"reporting.active_users"},
+		Changed: []*querycache.TableChange{{
+			Table:   "public.users",
+			Added:   []querycache.CatalogColumn{{Name: "name", Type: "TEXT", Nullable: true}},
+			Removed: []querycache.CatalogColumn{{Name: "created_at", Type: "TIMESTAMP", Nullable: true}},
+			Changed: []*querycache.ColumnChange{{
+				Name:   "email",
+				Before: querycache.CatalogColumn{Name: "email", Type: "TEXT"},
+				After:  querycache.CatalogColumn{Name: "email", Type: "VARCHAR"},
+			}},
+		}},
+	}, querycache.DiffCatalogs(before, after))
+}
+
+func TestCatalogPostgres(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
+	expect.Ok(t, err)
+
+	catalog, err := executor.Catalog(context.Background())
+	expect.Ok(t, err)
+
+	queries := catalog.Search("querycache_queries")
+	expect.Equal(t, 1, len(queries.Schemas))
+	expect.Equal(t, "public", queries.Schemas[0].Name)
+
+	table := queries.Schemas[0].Tables[0]
+	expect.Equal(t, "BASE TABLE", table.Type)
+	expect.Equal(t, querycache.CatalogColumn{Name: "id", Type: "UUID"}, table.Columns[0])
+
+	for _, schema := range catalog.Schemas {
+		expect.True(t, schema.Name != "pg_catalog" && schema.Name != "information_schema")
+	}
+}
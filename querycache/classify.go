@@ -0,0 +1,228 @@
+package querycache
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// The statements which may run against a read-only Datasource
+var readOnlyStatements = map[string]bool{
+	"SELECT":   true,
+	"WITH":     true,
+	"VALUES":   true,
+	"TABLE":    true,
+	"SHOW":     true,
+	"DESCRIBE": true,
+	"DESC":     true,
+	"EXPLAIN":  true,
+}
+
+// The keywords of statements which write, and why they are not read-only
+var writeKeywords = map[string]string{
+	"INSERT":   "modifies data",
+	"UPDATE":   "modifies data",
+	"DELETE":   "modifies data",
+	"MERGE":    "modifies data",
+	"UPSERT":   "modifies data",
+	"REPLACE":  "modifies data",
+	"COPY":     "modifies data",
+	"LOAD":     "modifies data",
+	"CALL":     "may modify data",
+	"TRUNCATE": "modifies the schema",
+	"CREATE":   "modifies the schema",
+	"ALTER":    "modifies the schema",
+	"DROP":     "modifies the schema",
+	"RENAME":   "modifies the schema",
+	"COMMENT":  "modifies the schema",
+	"GRANT":    "modifies privileges",
+	"REVOKE":   "modifies privileges",
+}
+
+// The keywords which write data when they appear within a read-only
+// statement, as in data-modifying WITH queries
+var nestedWriteKeywords = map[string]bool{
+	"INSERT": true,
+	"UPDATE": true,
+	"DELETE": true,
+	"MERGE":  true,
+}
+
+var dollarQuoteRegex = regexp.MustCompile(`^\$([A-Za-z_][A-Za-z0-9_]*)?\$`)
+
+// ReadOnlyError explains why a query may not run against a read-only
+// Datasource. Statement is the position of the offending statement, from 1.
+type ReadOnlyError struct {
+	Statement int
+	Reason    string
+}
+
+func (err *ReadOnlyError) Error() string {
+	return fmt.Sprintf(
+		"statement %v is not read-only: %v; read-only datasources only run SELECT, WITH, VALUES, TABLE, SHOW, DESCRIBE and EXPLAIN statements",
+		err.Statement, err.Reason)
+}
+
+// sqlWord is a keyword or unquoted identifier of a statement, call is set if
+// it is immediately followed by an opening parenthesis as functions are
+type sqlWord struct {
+	text string
+	call bool
+}
+
+// splitStatements returns the words of each statement of the query, skipping
+// quoted strings and identifiers, comments, qualified names and parameters
+func splitStatements(query string) [][]sqlWord {
+	query = parameterReferenceRegex.ReplaceAllString(query, " NULL ")
+
+	statements := [][]sqlWord{}
+	words := []sqlWord{}
+
+	skipUntil := func(i int, end string) int {
+		if j := strings.Index(query[i:], end); j >= 0 {
+			return i + j + len(end)
+		}
+
+		return len(query)
+	}
+
+	for i := 0; i < len(query); {
+		c := query[i]
+
+		switch {
+		case c == ';':
+			statements = append(statements, words)
+			words = []sqlWord{}
+			i++
+		case c == '\'' || c == '"' || c == '`':
+			// doubled quotes are escapes, and skipped as two adjacent strings
+			i = skipUntil(i+1, string(c))
+		case strings.HasPrefix(query[i:], "--"):
+			i = skipUntil(i, "\n")
+		case strings.HasPrefix(query[i:], "/*"):
+			i = skipUntil(i+2, "*/")
+		case c == '$' && dollarQuoteRegex.MatchString(query[i:]):
+			tag := dollarQuoteRegex.FindString(query[i:])
+			i = skipUntil(i+len(tag), tag)
+		case isWordStart(c):
+			j := i
+			for j < len(query) && isWordPart(query[j]) {
+				j++
+			}
+
+			qualified := i > 0 && query[i-1] == '.'
+			if !qualified {
+				k := j
+				for k < len(query) && (query[k] == ' ' || query[k] == '\t') {
+					k++
+				}
+
+				words = append(words, sqlWord{
+					text: strings.ToUpper(query[i:j]),
+					call: k < len(query) && query[k] == '(',
+				})
+			}
+
+			i = j
+		case isWordPart(c):
+			// numbers and positional placeholders
+			for i < len(query) && isWordPart(query[i]) {
+				i++
+			}
+		default:
+			i++
+		}
+	}
+
+	return append(statements, words)
+}
+
+func isWordStart(c byte) bool {
+	return c == '_' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z')
+}
+
+func isWordPart(c byte) bool {
+	return isWordStart(c) || c == '$' || (c >= '0' && c <= '9')
+}
+
+// classifyStatement returns why the statement is not read-only, if it is not
+func classifyStatement(words []sqlWord) (string, bool) {
+	first := words[0].text
+
+	// EXPLAIN ANALYZE executes the statement it explains, which follows its
+	// options
+	if first == "EXPLAIN" {
+		for i, word := range words[1:] {
+			if _, ok := writeKeywords[word.text]; ok || readOnlyStatements[word.text] {
+				return classifyStatement(words[i+1:])
+			}
+		}
+
+		return "", true
+	}
+
+	if !readOnlyStatements[first] {
+		if reason, ok := writeKeywords[first]; ok {
+			return first + " " + reason, false
+		}
+
+		return first + " is not a read-only statement", false
+	}
+
+	for i, word := range words {
+		if word.call {
+			continue
+		}
+
+		if word.text == "INTO" {
+			return "SELECT ... INTO writes its result to a table or file", false
+		}
+
+		if !nestedWriteKeywords[word.text] {
+			continue
+		}
+
+		// FOR UPDATE and FOR NO KEY UPDATE locking clauses
+		if word.text == "UPDATE" && i > 0 && (words[i-1].text == "FOR" || words[i-1].text == "KEY") {
+			return "FOR UPDATE locks rows for writing", false
+		}
+
+		return first + " contains " + word.text + ", which modifies data", false
+	}
+
+	return "", true
+}
+
+// countStatements counts the statements of the query, ignoring empty ones
+func countStatements(query string) int {
+	count := 0
+
+	for _, words := range splitStatements(query) {
+		if len(words) > 0 {
+			count++
+		}
+	}
+
+	return count
+}
+
+// CheckReadOnly classifies each statement of the query, returning a
+// *ReadOnlyError for the first that may modify data, schema or privileges.
+// It is a best effort based on the statements' keywords, read-only
+// transactions are what guarantee queries do not write where supported.
+func CheckReadOnly(query string) error {
+	position := 0
+
+	for _, words := range splitStatements(query) {
+		if len(words) == 0 {
+			continue
+		}
+
+		position++
+		if reason, ok := classifyStatement(words); !ok {
+			return &ReadOnlyError{Statement: position, Reason: reason}
+		}
+	}
+
+	return nil
+}
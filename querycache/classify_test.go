@@ -0,0 +1,50 @@
+package querycache_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func TestCheckReadOnly(t *testing.T) {
+	t.Parallel()
+
+	for _, query := range []string{
+		"SELECT 1",
+		"select * from users where id = {{id}};",
+		"WITH recent AS (SELECT * FROM orders) SELECT count(*) FROM recent",
+		"SELECT replace(name, 'a', 'b'), u.update, \"delete\" FROM users u",
+		"SELECT 'DROP TABLE users; DELETE FROM users' -- UPDATE users\n",
+		"SELECT $body$ INSERT INTO users $body$, $1 /* TRUNCATE users */",
+		"SELECT comment, created FROM posts ORDER BY created DESC",
+		"VALUES (1), (2)",
+		"SHOW TABLES",
+		"EXPLAIN (ANALYZE, FORMAT JSON) SELECT 1",
+		"SELECT 1; SELECT 2;",
+	} {
+		expect.Ok(t, querycache.CheckReadOnly(query))
+	}
+
+	for query, reason := range map[string]string{
+		"DELETE FROM users":                           "DELETE modifies data",
+		"  insert into users (id) values (1)":         "INSERT modifies data",
+		"DROP TABLE users":                            "DROP modifies the schema",
+		"GRANT SELECT ON users TO public":             "GRANT modifies privileges",
+		"SET search_path TO other":                    "SET is not a read-only statement",
+		"WITH gone AS (DELETE FROM users) SELECT 1":   "WITH contains DELETE, which modifies data",
+		"SELECT * INTO backup FROM users":             "SELECT ... INTO writes its result to a table or file",
+		"SELECT * FROM users FOR UPDATE":              "FOR UPDATE locks rows for writing",
+		"EXPLAIN ANALYZE UPDATE users SET name = 'x'": "UPDATE modifies data",
+	} {
+		err := querycache.CheckReadOnly(query)
+
+		var readOnlyErr *querycache.ReadOnlyError
+		expect.True(t, errors.As(err, &readOnlyErr))
+		expect.Equal(t, &querycache.ReadOnlyError{Statement: 1, Reason: reason}, readOnlyErr)
+	}
+
+	err := querycache.CheckReadOnly("SELECT 1;\n; TRUNCATE users")
+	expect.Equal(t, &querycache.ReadOnlyError{Statement: 2, Reason: "TRUNCATE modifies the schema"}, err)
+}
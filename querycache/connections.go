@@ -0,0 +1,147 @@
+package querycache
+
+import (
+	"database/sql"
+	"log"
+	"sync"
+	"time"
+)
+
+// ConnectionOptions configures each of the *sql.DB pools held by Connections,
+// zero values leave the database/sql defaults in place
+type ConnectionOptions struct {
+	MaxOpen     int
+	MaxIdle     int
+	MaxIdleTime time.Duration
+	MaxLifetime time.Duration
+}
+
+type connection struct {
+	db       *sql.DB
+	driver   string
+	options  string
+	readOnly bool
+}
+
+// Connections is a registry of *sql.DB pools, holding one per datasource ID so
+// that connections are reused across executions
+type Connections struct {
+	options ConnectionOptions
+	pools   map[string]*connection
+	lock    sync.Mutex
+}
+
+// NewConnections builds a new, empty, Connections registry
+func NewConnections(options ConnectionOptions) *Connections {
+	return &Connections{options: options, pools: map[string]*connection{}}
+}
+
+// Get returns the pool for the given datasource, opening it if required.
+// A pool is reopened if the datasource's type, options or whether it is read-only
+// have changed since it was opened.
+func (c *Connections) Get(datasource *Datasource) (*sql.DB, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if conn, ok := c.pools[datasource.ID]; ok {
+		if conn.driver == datasource.Type && conn.options == datasource.Options && conn.readOnly == datasource.ReadOnly {
+			return conn.db, nil
+		}
+
+		conn.db.Close()
+		delete(c.pools, datasource.ID)
+	}
+
+	db, err := datasource.open()
+	if err != nil {
+		return nil, err
+	}
+
+	db.SetMaxOpenConns(c.options.MaxOpen)
+	db.SetMaxIdleConns(c.options.MaxIdle)
+	db.SetConnMaxIdleTime(c.options.MaxIdleTime)
+	db.SetConnMaxLifetime(c.options.MaxLifetime)
+
+	c.pools[datasource.ID] = &connection{
+		db:       db,
+		driver:   datasource.Type,
+		options:  datasource.Options,
+		readOnly: datasource.ReadOnly,
+	}
+
+	return db, nil
+}
+
+// Close closes and forgets the pool for the given datasource ID, if any
+func (c *Connections) Close(id string) error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	conn, ok := c.pools[id]
+	if !ok {
+		return nil
+	}
+
+	delete(c.pools, id)
+
+	return conn.db.Close()
+}
+
+// Shutdown closes all pools held by the registry
+func (c *Connections) Shutdown() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var err error
+	for id, conn := range c.pools {
+		if closeErr := conn.db.Close(); closeErr != nil {
+			err = closeErr
+		}
+
+		delete(c.pools, id)
+	}
+
+	return err
+}
+
+// ConnectionClosingStore wraps a DatasourceStore, closing any pooled
+// connections to a datasource when it is updated or deleted
+type ConnectionClosingStore struct {
+	DatasourceStore
+	Connections *Connections
+}
+
+// NewConnectionClosingStore builds a new ConnectionClosingStore
+func NewConnectionClosingStore(store DatasourceStore, connections *Connections) *ConnectionClosingStore {
+	return &ConnectionClosingStore{DatasourceStore: store, Connections: connections}
+}
+
+func (s *ConnectionClosingStore) close(id string) {
+	if err := s.Connections.Close(id); err != nil {
+		log.Printf("querycache: failed to close connections for datasource %v: %v", id, err)
+	}
+}
+
+// Update updates the Datasource and closes its pooled connections
+func (s *ConnectionClosingStore) Update(userID, id string, ua *UpdateDatasource) (*Datasource, error) {
+	datasource, err := s.DatasourceStore.Update(userID, id, ua)
+	if err != nil {
+		return nil, err
+	}
+
+	s.close(id)
+
+	return datasource, nil
+}
+
+// Delete deletes the Datasource and closes its pooled connections
+func (s *ConnectionClosingStore) Delete(userID, id string) (*Datasource, error) {
+	datasource, err := s.DatasourceStore.Delete(userID, id)
+	if err != nil {
+		return nil, err
+	}
+
+	s.close(id)
+
+	return datasource, nil
+}
@@ -0,0 +1,50 @@
+package querycache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func TestConnections(t *testing.T) {
+	t.Parallel()
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{
+		MaxOpen: 2, MaxIdle: 1, MaxIdleTime: time.Minute})
+	datasource := &querycache.Datasource{ID: "1", Type: "postgres", Options: "dbname=a"}
+
+	db, err := connections.Get(datasource)
+	expect.Ok(t, err)
+	expect.Equal(t, 2, db.Stats().MaxOpenConnections)
+
+	// reused while unchanged
+	same, err := connections.Get(datasource)
+	expect.Ok(t, err)
+	expect.True(t, db == same)
+
+	// reopened when options change
+	datasource.Options = "dbname=b"
+	changed, err := connections.Get(datasource)
+	expect.Ok(t, err)
+	expect.False(t, db == changed)
+
+	// reopened after being closed
+	expect.Ok(t, connections.Close("1"))
+	reopened, err := connections.Get(datasource)
+	expect.Ok(t, err)
+	expect.False(t, changed == reopened)
+
+	expect.Ok(t, connections.Close("unknown"))
+	expect.Ok(t, connections.Shutdown())
+}
+
+func TestConnectionsUnknownDriver(t *testing.T) {
+	t.Parallel()
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+
+	_, err := connections.Get(&querycache.Datasource{ID: "1", Type: "postgress"})
+	expect.Error(t, err)
+}
@@ -34,6 +34,19 @@ func (c *Config) datasourcesCreate(claims *auth.Claims, w http.ResponseWriter, r
 			Err: err, Status: http.StatusUnprocessableEntity}
 	}
 
+	if err := createDatasource.configure(); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	if testConnection(r) {
+		candidate := &Datasource{
+			Type: createDatasource.Type, Options: createDatasource.Options, Timeout: createDatasource.Timeout}
+		if report := candidate.TestConnection(r.Context()); !report.OK() {
+			return writeFailedConnection(w, report)
+		}
+	}
+
 	datasource, err := c.DatasourceStore.Create(claims.UserID, &createDatasource)
 	if err != nil {
 		return &handlerutils.HandlerError{
@@ -68,6 +81,22 @@ func (c *Config) datasourceUpdate(claims *auth.Claims, id string, w http.Respons
 			Err: err, Status: http.StatusUnprocessableEntity}
 	}
 
+	current, err := c.DatasourceStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	if err := updateDatasource.configure(current); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	if testConnection(r) {
+		if report := updateDatasource.apply(current).TestConnection(r.Context()); !report.OK() {
+			return writeFailedConnection(w, report)
+		}
+	}
+
 	datasource, err := c.DatasourceStore.Update(claims.UserID, id, &updateDatasource)
 	if err != nil {
 		return err
@@ -75,3 +104,34 @@ func (c *Config) datasourceUpdate(claims *auth.Claims, id string, w http.Respons
 
 	return json.NewEncoder(w).Encode(datasource)
 }
+
+// datasourceTypes lists the registered Drivers, along with the options each of
+// them is configured with
+func (c *Config) datasourceTypes(claims *auth.Claims, w http.ResponseWriter, r *http.Request) error {
+	handlerutils.ContentType(w, handlerutils.ContentTypeJSON)
+
+	return json.NewEncoder(w).Encode(Drivers())
+}
+
+func (c *Config) datasourceTest(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	datasource, err := c.DatasourceStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(datasource.TestConnection(r.Context()))
+}
+
+// testConnection determines whether the request asks for the datasource's
+// connection to be tested before it is saved
+func testConnection(r *http.Request) bool {
+	return r.URL.Query().Get("test") == "true"
+}
+
+// writeFailedConnection refuses to save a datasource whose connection test
+// failed, responding with the report
+func writeFailedConnection(w http.ResponseWriter, report *ConnectionReport) error {
+	w.WriteHeader(http.StatusUnprocessableEntity)
+
+	return json.NewEncoder(w).Encode(report)
+}
@@ -1,8 +1,11 @@
 package querycache_test
 
 import (
+	"database/sql"
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/cga1123/bissy-api/querycache"
@@ -36,6 +39,7 @@ func TestDatasourceCreate(t *testing.T) {
 		Name:      "test datasource",
 		Type:      "postgres",
 		Options:   "",
+		ReadOnly:  true,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -179,3 +183,141 @@ func TestDatasourceList(t *testing.T) {
 	expecthttp.ContentType(t, handlerutils.ContentTypeJSON, response)
 	expecthttp.JSONBody(t, datasources[5:10], response.Body)
 }
+
+func TestDatasourceTest(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, id, config := testConfig(db)
+	claims := testClaims()
+
+	// failing tests refuse to save the datasource
+	body, err := utils.JSONBody(map[string]string{
+		"name": "test datasource", "type": "postgres", "options": "host=127.0.0.1 port=1 sslmode=disable"})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/datasources?test=true", body)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+
+	var report querycache.ConnectionReport
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&report))
+	expect.False(t, report.Reachable)
+	expect.Equal(t, querycache.ConnectionErrorNetwork, report.Error.Category)
+
+	_, err = config.DatasourceStore.Get(claims.UserID, id)
+	expect.True(t, err == sql.ErrNoRows)
+
+	body, err = utils.JSONBody(map[string]string{"name": "test datasource", "type": "test"})
+	expect.Ok(t, err)
+
+	request, err = http.NewRequest("POST", "/datasources?test=true", body)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	// as do failing updates
+	body, err = utils.JSONBody(map[string]string{"type": "mysql", "options": "user@localhost"})
+	expect.Ok(t, err)
+
+	request, err = http.NewRequest("PATCH", "/datasources/"+id+"?test=true", body)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+
+	datasource, err := config.DatasourceStore.Get(claims.UserID, id)
+	expect.Ok(t, err)
+	expect.Equal(t, "test", datasource.Type)
+
+	request, err = http.NewRequest("POST", "/datasources/"+id+"/test", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, &querycache.ConnectionReport{
+		Reachable: true, Authenticated: true, ServerVersion: "test"}, response.Body)
+}
+
+func TestDatasourceCreateConfig(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, id, config := testConfig(db)
+	claims := testClaims()
+
+	create := func(datasource map[string]interface{}) *httptest.ResponseRecorder {
+		body, err := utils.JSONBody(datasource)
+		expect.Ok(t, err)
+
+		request, err := http.NewRequest("POST", "/datasources", body)
+		expect.Ok(t, err)
+
+		return testHandler(claims, config, request)
+	}
+
+	// configs are validated, as are types
+	for _, datasource := range []map[string]interface{}{
+		{"name": "test", "type": "oracle", "options": ""},
+		{"name": "test", "type": "postgres", "config": map[string]interface{}{"host": "db"}},
+		{"name": "test", "type": "postgres", "options": "sslmode=disable",
+			"config": map[string]interface{}{"host": "db", "database": "bissy", "user": "bissy"}},
+	} {
+		expecthttp.Status(t, http.StatusUnprocessableEntity, create(datasource))
+	}
+
+	response := create(map[string]interface{}{"name": "test", "type": "postgres",
+		"config": map[string]interface{}{"host": "db", "database": "bissy", "user": "bissy", "password": "secret"}})
+	expecthttp.Ok(t, response)
+
+	datasource, err := config.DatasourceStore.Get(claims.UserID, id)
+	expect.Ok(t, err)
+	expect.Equal(t, "postgres://bissy:secret@db:5432/bissy?sslmode=require", datasource.Options)
+
+	// updates are configured by the driver of the datasource's type
+	body, err := utils.JSONBody(map[string]interface{}{
+		"config": map[string]interface{}{"host": "db", "database": "other", "user": "bissy", "sslmode": "disable"}})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("PATCH", "/datasources/"+id, body)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	datasource, err = config.DatasourceStore.Get(claims.UserID, id)
+	expect.Ok(t, err)
+	expect.Equal(t, "postgres://bissy@db:5432/other?sslmode=disable", datasource.Options)
+}
+
+func TestDatasourceTypes(t *testing.T) {
+	t.Parallel()
+
+	request, err := http.NewRequest("GET", "/datasources/types", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(testClaims(), &querycache.Config{}, request)
+	expecthttp.Ok(t, response)
+	expecthttp.ContentType(t, handlerutils.ContentTypeJSON, response)
+
+	var drivers []querycache.Driver
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&drivers))
+	expect.Equal(t, len(querycache.Drivers()), len(drivers))
+
+	for _, driver := range drivers {
+		if driver.Name != "postgres" {
+			continue
+		}
+
+		expect.Equal(t, "PostgreSQL", driver.Label)
+		expect.Equal(t, querycache.DriverOption{
+			Name: "password", Label: "Password", Type: querycache.OptionString, Secret: true}, driver.Options[4])
+	}
+}
@@ -1,17 +1,24 @@
 package querycache
 
 import (
+	"context"
 	"fmt"
+	"log"
+	"time"
 
 	"github.com/cga1123/bissy-api/utils"
 	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
+	"github.com/lib/pq"
 )
 
-// SQLDatasourceStore describes an SQL implementation of DatasourceStore
+// SQLDatasourceStore describes an SQL implementation of DatasourceStore.
+// Options are encrypted at rest when the store has a Keyring, bound to the ID
+// of their Datasource.
 type SQLDatasourceStore struct {
 	db          *hnysqlx.DB
 	clock       utils.Clock
 	idGenerator utils.IDGenerator
+	keyring     *Keyring
 }
 
 // NewSQLDatasourceStore retunes a new SQLDatasourceStore
@@ -19,22 +26,45 @@ func NewSQLDatasourceStore(db *hnysqlx.DB, clock utils.Clock, generator utils.ID
 	return &SQLDatasourceStore{db: db, clock: clock, idGenerator: generator}
 }
 
+// NewEncryptedSQLDatasourceStore returns a new SQLDatasourceStore encrypting
+// Options with the given Keyring
+func NewEncryptedSQLDatasourceStore(db *hnysqlx.DB, clock utils.Clock, generator utils.IDGenerator, keyring *Keyring) *SQLDatasourceStore {
+	return &SQLDatasourceStore{db: db, clock: clock, idGenerator: generator, keyring: keyring}
+}
+
+// decrypt replaces the stored Options of the Datasource with their plaintext
+func (s *SQLDatasourceStore) decrypt(datasource *Datasource) error {
+	options, err := s.keyring.Decrypt(datasource.OptionsKeyID, datasource.Options, datasource.ID)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt options of datasource %v: %v", datasource.ID, err)
+	}
+
+	datasource.Options = options
+
+	return nil
+}
+
 // Create creates and persists a new Datasource to the Store
 func (s *SQLDatasourceStore) Create(userID string, ca *CreateDatasource) (*Datasource, error) {
 	now := s.clock.Now()
 	id := s.idGenerator.Generate()
 
+	options, keyID, err := s.keyring.Encrypt(ca.Options, id)
+	if err != nil {
+		return nil, err
+	}
+
 	query := `
-		INSERT INTO querycache_datasources (id, user_id, name, type, options, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		INSERT INTO querycache_datasources (id, user_id, name, type, options, timeout, max_rows, max_bytes, read_only, created_at, updated_at, options_key_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
 		RETURNING *`
 
 	var datasource Datasource
-	if err := s.db.Get(&datasource, query, id, userID, ca.Name, ca.Type, ca.Options, now, now); err != nil {
+	if err := s.db.Get(&datasource, query, id, userID, ca.Name, ca.Type, options, ca.Timeout, ca.MaxRows, ca.MaxBytes, ca.readOnly(), now, now, keyID); err != nil {
 		return nil, err
 	}
 
-	return &datasource, nil
+	return &datasource, s.decrypt(&datasource)
 }
 
 // Get returns the Datasource with associated id from the store
@@ -47,7 +77,7 @@ func (s *SQLDatasourceStore) Get(userID, id string) (*Datasource, error) {
 		return nil, err
 	}
 
-	return &datasource, nil
+	return &datasource, s.decrypt(&datasource)
 }
 
 // Delete removes the Datasource with given id from the Store
@@ -60,7 +90,7 @@ func (s *SQLDatasourceStore) Delete(userID, id string) (*Datasource, error) {
 		return nil, err
 	}
 
-	return &datasource, nil
+	return &datasource, s.decrypt(&datasource)
 }
 
 // List returns the requests Datasources from the Store, ordered by createdAt
@@ -85,26 +115,156 @@ func (s *SQLDatasourceStore) List(userID string, page, per int) ([]*Datasource,
 		return nil, err
 	}
 
+	for _, datasource := range datasources {
+		if err := s.decrypt(datasource); err != nil {
+			return nil, err
+		}
+	}
+
 	return datasources, nil
 }
 
 // Update updates the Datasource with associated id from the store
 func (s *SQLDatasourceStore) Update(userID, id string, ua *UpdateDatasource) (*Datasource, error) {
 	var datasource Datasource
+	var options, keyID *string
+
+	if ua.Options != nil {
+		encrypted, encryptedKeyID, err := s.keyring.Encrypt(*ua.Options, id)
+		if err != nil {
+			return nil, err
+		}
+
+		options, keyID = &encrypted, &encryptedKeyID
+	}
 
 	query := `
 		UPDATE querycache_datasources
 		SET name = COALESCE($3, name),
 				type = COALESCE($4, type),
-				options = COALESCE($5, options)
+				options = COALESCE($5, options),
+				timeout = COALESCE($6, timeout),
+				max_rows = COALESCE($7, max_rows),
+				max_bytes = COALESCE($8, max_bytes),
+				read_only = COALESCE($9, read_only),
+				options_key_id = COALESCE($10, options_key_id)
 		WHERE 1=1
 		AND id = $1
 		AND user_id = $2
 		RETURNING *`
 
-	if err := s.db.Get(&datasource, query, id, userID, ua.Name, ua.Type, ua.Options); err != nil {
+	if err := s.db.Get(&datasource, query, id, userID, ua.Name, ua.Type, options, ua.Timeout, ua.MaxRows, ua.MaxBytes, ua.ReadOnly, keyID); err != nil {
 		return nil, err
 	}
 
-	return &datasource, nil
+	return &datasource, s.decrypt(&datasource)
+}
+
+// Reencryption describes a batch of Datasources re-encrypted by Reencrypt: how
+// many were Found not yet encrypted with the primary key, how many of them were
+// Reencrypted, and the IDs of those Skipped as they could not be decrypted
+type Reencryption struct {
+	Found       int
+	Reencrypted int
+	Skipped     []string
+}
+
+// Reencrypt encrypts the Options of up to batch Datasources not yet encrypted
+// with the primary key of the store's Keyring, other than those in skip.
+// Each row is only rewritten if it was not updated in the meantime, so
+// Datasources may be used and edited while they are re-encrypted. Rows which
+// can't be decrypted are logged and left as they are.
+func (s *SQLDatasourceStore) Reencrypt(batch int, skip []string) (*Reencryption, error) {
+	reencryption := &Reencryption{}
+	if s.keyring == nil {
+		return reencryption, nil
+	}
+
+	datasources := []*Datasource{}
+
+	// a nil skip is bound as NULL, for which ANY matches no row
+	query := `
+		SELECT *
+		FROM querycache_datasources
+		WHERE options_key_id <> $1
+		AND NOT (id = ANY(COALESCE($3::uuid[], '{}')))
+		LIMIT $2`
+
+	if err := s.db.Select(&datasources, query, s.keyring.Primary(), batch, pq.Array(skip)); err != nil {
+		return reencryption, err
+	}
+
+	reencryption.Found = len(datasources)
+
+	for _, datasource := range datasources {
+		stored, storedKeyID := datasource.Options, datasource.OptionsKeyID
+
+		if err := s.decrypt(datasource); err != nil {
+			log.Printf("querycache: skipping re-encryption: %v", err)
+
+			reencryption.Skipped = append(reencryption.Skipped, datasource.ID)
+			continue
+		}
+
+		options, keyID, err := s.keyring.Encrypt(datasource.Options, datasource.ID)
+		if err != nil {
+			return reencryption, err
+		}
+
+		update := `
+			UPDATE querycache_datasources
+			SET options = $2, options_key_id = $3
+			WHERE id = $1
+			AND options = $4
+			AND options_key_id = $5`
+
+		result, err := s.db.Exec(update, datasource.ID, options, keyID, stored, storedKeyID)
+		if err != nil {
+			return reencryption, err
+		}
+
+		if updated, err := result.RowsAffected(); err == nil && updated > 0 {
+			reencryption.Reencrypted++
+		}
+	}
+
+	return reencryption, nil
+}
+
+// ReencryptDatasources re-encrypts the Options of every Datasource in the
+// store with its primary key, in batches, pausing for interval between each
+// until ctx is done. Rows updated concurrently are picked up by a later batch,
+// it stops once every row is encrypted with the primary key other than those
+// which could not be decrypted.
+func ReencryptDatasources(ctx context.Context, store *SQLDatasourceStore, batch int, interval time.Duration) {
+	total, skipped := 0, []string{}
+
+	for {
+		reencryption, err := store.Reencrypt(batch, skipped)
+		if err != nil {
+			log.Printf("querycache: failed to re-encrypt datasources: %v", err)
+			return
+		}
+
+		total += reencryption.Reencrypted
+		skipped = append(skipped, reencryption.Skipped...)
+
+		if reencryption.Found == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+
+	if total > 0 {
+		log.Printf("querycache: re-encrypted %v datasources with key %v", total, store.keyring.Primary())
+	}
+
+	if len(skipped) > 0 {
+		log.Printf("querycache: left %v datasources which could not be decrypted: %v", len(skipped), skipped)
+	}
 }
@@ -1,33 +1,68 @@
 package querycache
 
 import (
+	"encoding/json"
+	"errors"
 	"time"
 )
 
+var errOptionsAndConfig = errors.New("options and config may not both be set")
+
 // Datasource describes a database that Queries may be related to and executed
-// against
+// against. Queries against a ReadOnly Datasource may not modify it.
+// Options may be stored encrypted, with the key identified by OptionsKeyID,
+// and are redacted when rendered as JSON.
 type Datasource struct {
-	ID        string    `json:"id" db:"id"`
-	UserID    string    `json:"userId" db:"user_id"`
-	Name      string    `json:"name"`
-	Type      string    `json:"type"`
-	Options   string    `json:"options"`
-	CreatedAt time.Time `json:"createdAt" db:"created_at"`
-	UpdatedAt time.Time `json:"updatedAt" db:"updated_at"`
+	ID           string    `json:"id" db:"id"`
+	UserID       string    `json:"userId" db:"user_id"`
+	Name         string    `json:"name"`
+	Type         string    `json:"type"`
+	Options      string    `json:"options"`
+	OptionsKeyID string    `json:"-" db:"options_key_id"`
+	Timeout      Duration  `json:"timeout"`
+	MaxRows      int       `json:"maxRows" db:"max_rows"`
+	MaxBytes     int       `json:"maxBytes" db:"max_bytes"`
+	ReadOnly     bool      `json:"readOnly" db:"read_only"`
+	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
+	UpdatedAt    time.Time `json:"updatedAt" db:"updated_at"`
 }
 
-// UpdateDatasource describes the paramater which may be updated on a Datasource
+// MarshalJSON marshals the Datasource into JSON, with its secrets redacted
+// from its Options
+func (a Datasource) MarshalJSON() ([]byte, error) {
+	type datasource Datasource
+
+	redacted := datasource(a)
+	redacted.Options = RedactOptions(a.Options)
+
+	return json.Marshal(&redacted)
+}
+
+// UpdateDatasource describes the paramater which may be updated on a Datasource,
+// Config replaces the Options with those built by the Datasource's Driver
 type UpdateDatasource struct {
-	Name    *string `json:"name"`
-	Type    *string `json:"type"`
-	Options *string `json:"options"`
+	Name     *string      `json:"name"`
+	Type     *string      `json:"type"`
+	Options  *string      `json:"options"`
+	Config   DriverConfig `json:"config"`
+	Timeout  *Duration    `json:"timeout"`
+	MaxRows  *int         `json:"maxRows"`
+	MaxBytes *int         `json:"maxBytes"`
+	ReadOnly *bool        `json:"readOnly"`
 }
 
-// CreateDatasource describes the required paramater to create a new Datasource
+// CreateDatasource describes the required paramater to create a new Datasource,
+// Datasources are ReadOnly unless it is set to false. Its Options may instead be
+// built by the Driver of its Type from a Config.
 type CreateDatasource struct {
-	Name    string `json:"name"`
-	Type    string `json:"type"`
-	Options string `json:"options"`
+	Name     string       `json:"name"`
+	Type     string       `json:"type"`
+	Options  string       `json:"options"`
+	Config   DriverConfig `json:"config"`
+	Timeout  Duration     `json:"timeout"`
+	MaxRows  int          `json:"maxRows"`
+	MaxBytes int          `json:"maxBytes"`
+	ReadOnly *bool        `json:"readOnly"`
 }
 
 // DatasourceStore describes a generic Store for Datasources
@@ -39,14 +74,130 @@ type DatasourceStore interface {
 	Update(string, string, *UpdateDatasource) (*Datasource, error)
 }
 
-// NewExecutor returns a new SQLExecutor configured against this Datasource
-// Will return a TestExecutor if the datasources "Type" is "test"
-func (a *Datasource) NewExecutor() (Executor, error) {
-	switch a.Type {
-	case "test":
-		return &TestExecutor{}, nil
-	default:
-		// TODO: Cache this per datasource-id? keep DB objects available and not need to recreate connections?
-		return NewSQLExecutor(a.Type, a.Options)
+// apply returns a copy of the Datasource with every field set by the update
+// applied, as it would be stored
+func (ua *UpdateDatasource) apply(datasource *Datasource) *Datasource {
+	updated := *datasource
+
+	if ua.Name != nil {
+		updated.Name = *ua.Name
+	}
+
+	if ua.Type != nil {
+		updated.Type = *ua.Type
+	}
+
+	if ua.Options != nil {
+		updated.Options = *ua.Options
+	}
+
+	if ua.Timeout != nil {
+		updated.Timeout = *ua.Timeout
+	}
+
+	if ua.MaxRows != nil {
+		updated.MaxRows = *ua.MaxRows
+	}
+
+	if ua.MaxBytes != nil {
+		updated.MaxBytes = *ua.MaxBytes
+	}
+
+	if ua.ReadOnly != nil {
+		updated.ReadOnly = *ua.ReadOnly
+	}
+
+	return &updated
+}
+
+// configure checks that the Type names a registered Driver, and builds the
+// Options from the Config if set
+func (ca *CreateDatasource) configure() error {
+	driver, err := lookupDriver(ca.Type)
+	if err != nil {
+		return err
+	}
+
+	if ca.Config == nil {
+		return nil
 	}
+
+	if ca.Options != "" {
+		return errOptionsAndConfig
+	}
+
+	ca.Options, err = driver.Configure(ca.Config)
+	return err
+}
+
+// configure checks that the updated Type names a registered Driver, and builds
+// the Options from the Config if set, with the Driver of the updated Type or
+// of the current Datasource
+func (ua *UpdateDatasource) configure(current *Datasource) error {
+	if ua.Type == nil && ua.Config == nil {
+		return nil
+	}
+
+	driverName := current.Type
+	if ua.Type != nil {
+		driverName = *ua.Type
+	}
+
+	driver, err := lookupDriver(driverName)
+	if err != nil {
+		return err
+	}
+
+	if ua.Config == nil {
+		return nil
+	}
+
+	if ua.Options != nil {
+		return errOptionsAndConfig
+	}
+
+	options, err := driver.Configure(ua.Config)
+	if err != nil {
+		return err
+	}
+
+	ua.Options = &options
+
+	return nil
+}
+
+// readOnly determines whether the Datasource should be created ReadOnly
+func (ca *CreateDatasource) readOnly() bool {
+	return ca.ReadOnly == nil || *ca.ReadOnly
+}
+
+// Limits returns the Limits on the size of results of Queries executed against
+// the Datasource
+func (a *Datasource) Limits() Limits {
+	return Limits{Rows: a.MaxRows, Bytes: a.MaxBytes}
+}
+
+// NewExecutor returns a new Executor configured against this Datasource by the
+// Driver of its Type, by default a SQLExecutor using a pooled connection from
+// the given Connections registry
+func (a *Datasource) NewExecutor(connections *Connections) (Executor, error) {
+	driver, err := lookupDriver(a.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver.NewExecutor != nil {
+		return driver.NewExecutor(a, connections)
+	}
+
+	db, err := connections.Get(a)
+	if err != nil {
+		return nil, err
+	}
+
+	executor := newSQLExecutor(a.Type, db)
+	executor.limits = a.Limits()
+	executor.readOnly = a.ReadOnly
+
+	return executor, nil
 }
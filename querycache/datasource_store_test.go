@@ -1,6 +1,7 @@
 package querycache_test
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"log"
@@ -25,6 +26,7 @@ func testDatasourceCreate(t *testing.T, store querycache.DatasourceStore, id str
 		Name:      "test datasource",
 		Type:      "postgres",
 		Options:   "sslmode=disable",
+		ReadOnly:  true,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -52,6 +54,7 @@ func testDatasourceDelete(t *testing.T, store querycache.DatasourceStore, id str
 		Name:      "test datasource",
 		Type:      "postgres",
 		Options:   "sslmode=disable",
+		ReadOnly:  true,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -92,6 +95,7 @@ func testDatasourceGet(t *testing.T, store querycache.DatasourceStore, id string
 		Name:      "test datasource",
 		Type:      "postgres",
 		Options:   "sslmode=disable",
+		ReadOnly:  true,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -126,6 +130,7 @@ func testDatasourceUpdate(t *testing.T, store querycache.DatasourceStore, id str
 		Name:      "test snowdapter",
 		Type:      "snowflake",
 		Options:   "",
+		ReadOnly:  false,
 		CreatedAt: now,
 		UpdatedAt: now,
 	}
@@ -140,10 +145,12 @@ func testDatasourceUpdate(t *testing.T, store querycache.DatasourceStore, id str
 	newName := "test snowdapter"
 	newType := "snowflake"
 	newOptions := ""
+	newReadOnly := false
 	datasource, err := store.Update(userID, id, &querycache.UpdateDatasource{
-		Name:    &newName,
-		Type:    &newType,
-		Options: &newOptions,
+		Name:     &newName,
+		Type:     &newType,
+		Options:  &newOptions,
+		ReadOnly: &newReadOnly,
 	})
 
 	expect.Ok(t, err)
@@ -294,3 +301,96 @@ func TestSQLDatasourceUpdate(t *testing.T) {
 
 	withTestSQLDatasourceStore(t, testDatasourceUpdate)
 }
+
+func TestSQLDatasourceEncrypted(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	old, err := querycache.NewKeyring("1", map[string][]byte{"1": testKey(1)})
+	expect.Ok(t, err)
+
+	rotated, err := querycache.NewKeyring("2", map[string][]byte{"1": testKey(1), "2": testKey(2)})
+	expect.Ok(t, err)
+
+	clock, generator := &utils.RealClock{}, &utils.UUIDGenerator{}
+	plain := querycache.NewSQLDatasourceStore(db, clock, generator)
+	store := querycache.NewEncryptedSQLDatasourceStore(db, clock, generator, old)
+
+	stored := func(id string) (string, string) {
+		var options, keyID string
+		row := db.QueryRow("SELECT options, options_key_id FROM querycache_datasources WHERE id = $1", id)
+		expect.Ok(t, row.Scan(&options, &keyID))
+
+		return options, keyID
+	}
+
+	userID := uuid.New().String()
+	options := "host=db user=bissy password=secret"
+
+	datasource, err := store.Create(userID, &querycache.CreateDatasource{Type: "postgres", Options: options})
+	expect.Ok(t, err)
+	expect.Equal(t, options, datasource.Options)
+
+	ciphertext, keyID := stored(datasource.ID)
+	expect.Equal(t, "1", keyID)
+	expect.True(t, ciphertext != options)
+
+	datasource, err = store.Get(userID, datasource.ID)
+	expect.Ok(t, err)
+	expect.Equal(t, options, datasource.Options)
+
+	updated := options + " sslmode=require"
+	datasource, err = store.Update(userID, datasource.ID, &querycache.UpdateDatasource{Options: &updated})
+	expect.Ok(t, err)
+	expect.Equal(t, updated, datasource.Options)
+
+	// rows written before encryption was enabled
+	legacy, err := plain.Create(userID, &querycache.CreateDatasource{Type: "postgres", Options: options})
+	expect.Ok(t, err)
+
+	_, keyID = stored(legacy.ID)
+	expect.Equal(t, "", keyID)
+
+	legacy, err = store.Get(userID, legacy.ID)
+	expect.Ok(t, err)
+	expect.Equal(t, options, legacy.Options)
+
+	// rotating re-encrypts every row with the new key
+	store = querycache.NewEncryptedSQLDatasourceStore(db, clock, generator, rotated)
+
+	reencryption, err := store.Reencrypt(1, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.Reencryption{Found: 1, Reencrypted: 1}, reencryption)
+
+	// rows encrypted with a key since lost are skipped
+	lostKeyring, err := querycache.NewKeyring("3", map[string][]byte{"3": testKey(3)})
+	expect.Ok(t, err)
+
+	lost, err := querycache.NewEncryptedSQLDatasourceStore(db, clock, generator, lostKeyring).Create(
+		userID, &querycache.CreateDatasource{Type: "postgres", Options: options})
+	expect.Ok(t, err)
+
+	querycache.ReencryptDatasources(context.Background(), store, 1, time.Millisecond)
+
+	for id, expected := range map[string]string{datasource.ID: updated, legacy.ID: options} {
+		_, keyID := stored(id)
+		expect.Equal(t, "2", keyID)
+
+		datasource, err := store.Get(userID, id)
+		expect.Ok(t, err)
+		expect.Equal(t, expected, datasource.Options)
+	}
+
+	_, keyID = stored(lost.ID)
+	expect.Equal(t, "3", keyID)
+
+	reencryption, err = store.Reencrypt(10, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.Reencryption{Found: 1, Skipped: []string{lost.ID}}, reencryption)
+
+	reencryption, err = store.Reencrypt(10, []string{lost.ID})
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.Reencryption{}, reencryption)
+}
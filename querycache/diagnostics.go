@@ -0,0 +1,243 @@
+package querycache
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/lib/pq"
+	"github.com/snowflakedb/gosnowflake"
+)
+
+// defaultConnectionTestTimeout bounds testing the connection to Datasources
+// which don't set a Timeout
+const defaultConnectionTestTimeout = 10 * time.Second
+
+// The categories driver errors are mapped into when testing the connection to
+// a Datasource
+const (
+	ConnectionErrorOptions  = "options"
+	ConnectionErrorDNS      = "dns"
+	ConnectionErrorNetwork  = "network"
+	ConnectionErrorTimeout  = "timeout"
+	ConnectionErrorTLS      = "tls"
+	ConnectionErrorAuth     = "auth"
+	ConnectionErrorDatabase = "database"
+	ConnectionErrorUnknown  = "unknown"
+)
+
+var connectionErrorMessages = map[string]string{
+	ConnectionErrorOptions:  "the connection options are invalid",
+	ConnectionErrorDNS:      "the host could not be resolved",
+	ConnectionErrorNetwork:  "the server could not be reached or refused the connection",
+	ConnectionErrorTimeout:  "the server did not respond in time",
+	ConnectionErrorTLS:      "the TLS handshake with the server failed",
+	ConnectionErrorAuth:     "the server rejected the credentials",
+	ConnectionErrorDatabase: "the database does not exist or may not be accessed",
+	ConnectionErrorUnknown:  "the connection failed",
+}
+
+// ConnectionReport describes the outcome of testing the connection to a
+// Datasource. The server is Reachable if a connection could be opened to it,
+// whether or not the credentials were accepted.
+type ConnectionReport struct {
+	Reachable     bool             `json:"reachable"`
+	Authenticated bool             `json:"authenticated"`
+	ServerVersion string           `json:"serverVersion,omitempty"`
+	Latency       Duration         `json:"latency"`
+	Error         *ConnectionError `json:"error,omitempty"`
+}
+
+// OK determines whether the connection test succeeded
+func (report *ConnectionReport) OK() bool {
+	return report.Error == nil
+}
+
+// ConnectionError describes why the connection to a Datasource failed, with
+// its Category, a human friendly Message and the driver's error as Detail
+type ConnectionError struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+	Detail   string `json:"detail"`
+}
+
+func newConnectionError(err error) *ConnectionError {
+	category := connectionErrorCategory(err)
+
+	return &ConnectionError{
+		Category: category,
+		Message:  connectionErrorMessages[category],
+		Detail:   err.Error(),
+	}
+}
+
+// TestConnection tests the connection to the Datasource with its Driver's
+// TestConnection, or by connecting to it with database/sql if it is nil. The
+// test is bounded by the Datasource's Timeout.
+func (a *Datasource) TestConnection(ctx context.Context) *ConnectionReport {
+	timeout := time.Duration(a.Timeout)
+	if timeout <= 0 {
+		timeout = defaultConnectionTestTimeout
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	driver, err := lookupDriver(a.Type)
+	if err != nil {
+		return &ConnectionReport{Error: optionsError(err)}
+	}
+
+	if driver.TestConnection != nil {
+		return driver.TestConnection(ctx, a)
+	}
+
+	return testSQLConnection(ctx, a, driver.Version)
+}
+
+// testSQLConnection opens a new connection to the Datasource, separate from any
+// pooled by Connections, pings it and runs the version statement, if any, for
+// the server's version
+func testSQLConnection(ctx context.Context, a *Datasource, version string) *ConnectionReport {
+	report := &ConnectionReport{}
+
+	start := time.Now()
+	defer func() { report.Latency = Duration(time.Since(start)) }()
+
+	db, err := a.open()
+	if err != nil {
+		report.Error = optionsError(err)
+
+		return report
+	}
+	defer db.Close()
+
+	db.SetMaxOpenConns(1)
+
+	if err := db.PingContext(ctx); err != nil {
+		report.Error = newConnectionError(err)
+		report.Reachable = reachable(report.Error.Category)
+
+		return report
+	}
+
+	report.Reachable, report.Authenticated = true, true
+
+	if version == "" {
+		return report
+	}
+
+	if err := db.QueryRowContext(ctx, version).Scan(&report.ServerVersion); err != nil {
+		report.Error = newConnectionError(err)
+	}
+
+	return report
+}
+
+// optionsError describes a Datasource whose options could not be opened
+func optionsError(err error) *ConnectionError {
+	return &ConnectionError{
+		Category: ConnectionErrorOptions,
+		Message:  connectionErrorMessages[ConnectionErrorOptions],
+		Detail:   err.Error(),
+	}
+}
+
+// reachable determines whether the server was reached before the connection
+// failed with the given category of error
+func reachable(category string) bool {
+	switch category {
+	case ConnectionErrorTLS, ConnectionErrorAuth, ConnectionErrorDatabase:
+		return true
+	default:
+		return false
+	}
+}
+
+// connectionErrorCategory maps errors returned by the drivers while connecting
+// into one of the ConnectionError categories
+func connectionErrorCategory(err error) string {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return ConnectionErrorTimeout
+	}
+
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return ConnectionErrorDNS
+	}
+
+	if tlsError(err) {
+		return ConnectionErrorTLS
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch {
+		case pqErr.Code.Class() == "28":
+			return ConnectionErrorAuth
+		case pqErr.Code == "3D000":
+			return ConnectionErrorDatabase
+		}
+	}
+
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		switch mysqlErr.Number {
+		case 1045:
+			return ConnectionErrorAuth
+		case 1044, 1049:
+			return ConnectionErrorDatabase
+		}
+	}
+
+	var snowflakeErr *gosnowflake.SnowflakeError
+	if errors.As(err, &snowflakeErr) {
+		switch {
+		case snowflakeErr.Number >= 390100 && snowflakeErr.Number < 390200,
+			snowflakeErr.Number == gosnowflake.ErrFailedToAuth,
+			snowflakeErr.Number == gosnowflake.ErrFailedToAuthSAML,
+			snowflakeErr.Number == gosnowflake.ErrFailedToAuthOKTA:
+			return ConnectionErrorAuth
+		case snowflakeErr.Number == gosnowflake.ErrCodeFailedToConnect,
+			snowflakeErr.Number == gosnowflake.ErrCodeServiceUnavailable:
+			return ConnectionErrorNetwork
+		}
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return ConnectionErrorTimeout
+	}
+
+	var opErr *net.OpError
+	if errors.As(err, &opErr) || errors.Is(err, syscall.ECONNREFUSED) {
+		return ConnectionErrorNetwork
+	}
+
+	// the drivers don't wrap the errors of parsing their options
+	if strings.Contains(err.Error(), "invalid DSN") || strings.Contains(err.Error(), "missing \"=\"") {
+		return ConnectionErrorOptions
+	}
+
+	return ConnectionErrorUnknown
+}
+
+func tlsError(err error) bool {
+	if errors.Is(err, pq.ErrSSLNotSupported) || errors.Is(err, mysql.ErrNoTLS) {
+		return true
+	}
+
+	var recordErr tls.RecordHeaderError
+	var authorityErr x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidErr x509.CertificateInvalidError
+
+	return errors.As(err, &recordErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr)
+}
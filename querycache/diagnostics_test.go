@@ -0,0 +1,58 @@
+package querycache_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func TestTestConnection(t *testing.T) {
+	t.Parallel()
+
+	timeout := querycache.Duration(5 * time.Second)
+
+	for _, tc := range []struct {
+		datasource *querycache.Datasource
+		category   string
+		reachable  bool
+	}{
+		{&querycache.Datasource{Type: "oracle", Options: "", Timeout: timeout}, querycache.ConnectionErrorOptions, false},
+		{&querycache.Datasource{Type: "mysql", Options: "user@localhost", Timeout: timeout}, querycache.ConnectionErrorOptions, false},
+		{&querycache.Datasource{Type: "postgres", Options: "host", Timeout: timeout}, querycache.ConnectionErrorOptions, false},
+		{&querycache.Datasource{Type: "postgres", Options: "host=127.0.0.1 port=1 sslmode=disable", Timeout: timeout}, querycache.ConnectionErrorNetwork, false},
+	} {
+		report := tc.datasource.TestConnection(context.Background())
+		expect.False(t, report.OK())
+		expect.Equal(t, tc.category, report.Error.Category)
+		expect.Equal(t, tc.reachable, report.Reachable)
+		expect.False(t, report.Authenticated)
+		expect.True(t, report.Error.Message != "")
+	}
+
+	report := (&querycache.Datasource{Type: "test"}).TestConnection(context.Background())
+	expect.True(t, report.OK())
+	expect.True(t, report.Reachable)
+	expect.True(t, report.Authenticated)
+	expect.Equal(t, "test", report.ServerVersion)
+}
+
+func TestTestConnectionPostgres(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	report := (&querycache.Datasource{Type: "postgres", Options: url}).TestConnection(context.Background())
+	expect.True(t, report.OK())
+	expect.True(t, report.Reachable)
+	expect.True(t, report.Authenticated)
+	expect.True(t, strings.HasPrefix(report.ServerVersion, "PostgreSQL"))
+	expect.True(t, report.Latency > 0)
+}
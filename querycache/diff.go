@@ -0,0 +1,120 @@
+package querycache
+
+import (
+	"fmt"
+)
+
+// ChangedRow is a row present in both Results of a ResultDiff, whose values
+// differ
+type ChangedRow struct {
+	Key    interface{}            `json:"key"`
+	Before map[string]interface{} `json:"before"`
+	After  map[string]interface{} `json:"after"`
+}
+
+// ResultDiff lists the rows added, removed and changed between two Results,
+// rows are matched on the values of their Key column
+type ResultDiff struct {
+	Key     string                   `json:"key"`
+	Added   []map[string]interface{} `json:"added"`
+	Removed []map[string]interface{} `json:"removed"`
+	Changed []*ChangedRow            `json:"changed"`
+}
+
+func rowObject(columns []Column, row []interface{}) map[string]interface{} {
+	object := make(map[string]interface{}, len(columns))
+	for i, column := range columns {
+		object[column.Name] = row[i]
+	}
+
+	return object
+}
+
+// keyedRows indexes the rows of the Result by the text of their key value
+func keyedRows(result *Result, key string) (map[string]map[string]interface{}, []string, error) {
+	index, err := columnIndex(result.Columns, key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows := make(map[string]map[string]interface{}, len(result.Rows))
+	keys := make([]string, 0, len(result.Rows))
+
+	for _, row := range result.Rows {
+		k := valueString(row[index], "")
+		if _, ok := rows[k]; ok {
+			return nil, nil, fmt.Errorf("key column %q is not unique, %q is repeated", key, k)
+		}
+
+		rows[k] = rowObject(result.Columns, row)
+		keys = append(keys, k)
+	}
+
+	return rows, keys, nil
+}
+
+func sameValue(a, b interface{}) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+
+	return valueString(a, "") == valueString(b, "")
+}
+
+func sameRow(a, b map[string]interface{}) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for column, value := range a {
+		other, ok := b[column]
+		if !ok || !sameValue(value, other) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// DiffResults compares the rows of before and after, matched on the values of
+// the key column which must be unique in both
+func DiffResults(before, after *Result, key string) (*ResultDiff, error) {
+	beforeRows, beforeKeys, err := keyedRows(before, key)
+	if err != nil {
+		return nil, err
+	}
+
+	afterRows, afterKeys, err := keyedRows(after, key)
+	if err != nil {
+		return nil, err
+	}
+
+	diff := &ResultDiff{
+		Key:     key,
+		Added:   []map[string]interface{}{},
+		Removed: []map[string]interface{}{},
+		Changed: []*ChangedRow{},
+	}
+
+	for _, k := range beforeKeys {
+		if _, ok := afterRows[k]; !ok {
+			diff.Removed = append(diff.Removed, beforeRows[k])
+		}
+	}
+
+	for _, k := range afterKeys {
+		row := afterRows[k]
+
+		previous, ok := beforeRows[k]
+		if !ok {
+			diff.Added = append(diff.Added, row)
+			continue
+		}
+
+		if !sameRow(previous, row) {
+			diff.Changed = append(diff.Changed, &ChangedRow{Key: row[key], Before: previous, After: row})
+		}
+	}
+
+	return diff, nil
+}
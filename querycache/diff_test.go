@@ -0,0 +1,45 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func TestDiffResults(t *testing.T) {
+	t.Parallel()
+
+	columns := []querycache.Column{{Name: "id", Type: "INT8"}, {Name: "name", Type: "TEXT"}}
+	before := &querycache.Result{
+		Columns: columns,
+		Rows:    [][]interface{}{{int64(1), "a"}, {int64(2), "b"}, {int64(3), nil}},
+	}
+
+	// as read back from a snapshot
+	after := &querycache.Result{
+		Columns: columns,
+		Rows:    [][]interface{}{{json.Number("3"), ""}, {json.Number("1"), "a"}, {json.Number("4"), "d"}},
+	}
+
+	diff, err := querycache.DiffResults(before, after, "id")
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.ResultDiff{
+		Key:     "id",
+		Added:   []map[string]interface{}{{"id": json.Number("4"), "name": "d"}},
+		Removed: []map[string]interface{}{{"id": int64(2), "name": "b"}},
+		Changed: []*querycache.ChangedRow{{
+			Key:    json.Number("3"),
+			Before: map[string]interface{}{"id": int64(3), "name": nil},
+			After:  map[string]interface{}{"id": json.Number("3"), "name": ""},
+		}},
+	}, diff)
+
+	_, err = querycache.DiffResults(before, after, "missing")
+	expect.Error(t, err)
+
+	before.Rows = append(before.Rows, []interface{}{int64(1), "again"})
+	_, err = querycache.DiffResults(before, after, "id")
+	expect.Error(t, err)
+}
@@ -0,0 +1,352 @@
+package querycache
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"math"
+	"net"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/snowflakedb/gosnowflake"
+)
+
+// The types of the options of a Driver
+const (
+	OptionString  = "string"
+	OptionInteger = "integer"
+	OptionBoolean = "boolean"
+)
+
+// Driver describes a type of Datasource: the options it is configured with and
+// how they make up its connection string. Datasources are executed against with
+// NewExecutor, or with a SQLExecutor over a pooled connection if it is nil.
+// Connections are opened with Open, or with the database/sql driver of the same
+// Name if it is nil. They are tested with TestConnection, or by pinging a new
+// connection and querying the server's version with the Version statement if
+// it is nil.
+type Driver struct {
+	Name           string                                               `json:"name"`
+	Label          string                                               `json:"label"`
+	Options        []DriverOption                                       `json:"options"`
+	DSN            func(DriverConfig) (string, error)                   `json:"-"`
+	Open           func(*Datasource) (*sql.DB, error)                   `json:"-"`
+	NewExecutor    func(*Datasource, *Connections) (Executor, error)    `json:"-"`
+	Version        string                                               `json:"-"`
+	TestConnection func(context.Context, *Datasource) *ConnectionReport `json:"-"`
+}
+
+// DriverOption describes an option of a Driver. Options with Values may only
+// be set to one of them, Secret options should not be displayed once set.
+type DriverOption struct {
+	Name     string      `json:"name"`
+	Label    string      `json:"label"`
+	Type     string      `json:"type"`
+	Required bool        `json:"required"`
+	Secret   bool        `json:"secret"`
+	Default  interface{} `json:"default,omitempty"`
+	Values   []string    `json:"values,omitempty"`
+}
+
+// DriverConfig holds the options of a Datasource, by name, as decoded from JSON
+type DriverConfig map[string]interface{}
+
+var (
+	driversLock sync.RWMutex
+	drivers     = map[string]*Driver{}
+)
+
+// RegisterDriver makes a Driver available to Datasources of its Name, it
+// panics if a Driver of the same Name is already registered
+func RegisterDriver(driver *Driver) {
+	driversLock.Lock()
+	defer driversLock.Unlock()
+
+	if _, ok := drivers[driver.Name]; ok {
+		panic("querycache: driver " + driver.Name + " is already registered")
+	}
+
+	drivers[driver.Name] = driver
+}
+
+// LookupDriver returns the registered Driver of the given name
+func LookupDriver(name string) (*Driver, bool) {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+
+	driver, ok := drivers[name]
+	return driver, ok
+}
+
+// Drivers lists the registered Drivers, by Name
+func Drivers() []*Driver {
+	driversLock.RLock()
+	defer driversLock.RUnlock()
+
+	list := make([]*Driver, 0, len(drivers))
+	for _, driver := range drivers {
+		list = append(list, driver)
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+
+	return list
+}
+
+// lookupDriver returns the registered Driver of the given name, or an error
+// naming the unknown type
+func lookupDriver(name string) (*Driver, error) {
+	driver, ok := LookupDriver(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown datasource type %q", name)
+	}
+
+	return driver, nil
+}
+
+// open opens a pool of connections to the Datasource with the Driver of its
+// Type
+func (a *Datasource) open() (*sql.DB, error) {
+	driver, err := lookupDriver(a.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	if driver.Open != nil {
+		return driver.Open(a)
+	}
+
+	return sql.Open(a.Type, a.Options)
+}
+
+// Configure validates the config against the Driver's options, filling in
+// their defaults, and returns the connection string it describes
+func (driver *Driver) Configure(config DriverConfig) (string, error) {
+	validated, err := driver.Validate(config)
+	if err != nil {
+		return "", err
+	}
+
+	if driver.DSN == nil {
+		return "", nil
+	}
+
+	return driver.DSN(validated)
+}
+
+// Validate checks that every option of the config is known to the Driver and
+// of the right type, and that required options are set. It returns a copy of
+// the config with integers as ints and defaults filled in.
+func (driver *Driver) Validate(config DriverConfig) (DriverConfig, error) {
+	options := map[string]DriverOption{}
+	for _, option := range driver.Options {
+		options[option.Name] = option
+	}
+
+	for name := range config {
+		if _, ok := options[name]; !ok {
+			return nil, fmt.Errorf("unknown option %q for %v datasources", name, driver.Name)
+		}
+	}
+
+	validated := DriverConfig{}
+
+	for _, option := range driver.Options {
+		value, ok := config[option.Name]
+		if !ok || value == nil {
+			if option.Default != nil {
+				validated[option.Name] = option.Default
+			} else if option.Required {
+				return nil, fmt.Errorf("option %q is required", option.Name)
+			}
+
+			continue
+		}
+
+		value, err := option.validate(value)
+		if err != nil {
+			return nil, err
+		}
+
+		validated[option.Name] = value
+	}
+
+	return validated, nil
+}
+
+func (option *DriverOption) validate(value interface{}) (interface{}, error) {
+	invalid := fmt.Errorf("option %q must be of type %v", option.Name, option.Type)
+
+	switch option.Type {
+	case OptionInteger:
+		switch v := value.(type) {
+		case int:
+			return v, nil
+		case float64:
+			if v != math.Trunc(v) || math.Abs(v) > math.MaxInt32 {
+				return nil, invalid
+			}
+
+			return int(v), nil
+		default:
+			return nil, invalid
+		}
+	case OptionBoolean:
+		if _, ok := value.(bool); !ok {
+			return nil, invalid
+		}
+	default:
+		s, ok := value.(string)
+		if !ok {
+			return nil, invalid
+		}
+
+		if option.Required && s == "" {
+			return nil, fmt.Errorf("option %q is required", option.Name)
+		}
+
+		if len(option.Values) > 0 && !contains(option.Values, s) {
+			return nil, fmt.Errorf("option %q must be one of %v", option.Name, option.Values)
+		}
+	}
+
+	return value, nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// String returns the string option of the given name, or an empty string if it
+// isn't set
+func (config DriverConfig) String(name string) string {
+	s, _ := config[name].(string)
+	return s
+}
+
+// Int returns the integer option of the given name, or 0 if it isn't set
+func (config DriverConfig) Int(name string) int {
+	i, _ := config[name].(int)
+	return i
+}
+
+// Bool returns the boolean option of the given name, or false if it isn't set
+func (config DriverConfig) Bool(name string) bool {
+	b, _ := config[name].(bool)
+	return b
+}
+
+func init() {
+	RegisterDriver(&Driver{
+		Name:    "test",
+		Label:   "Test",
+		Options: []DriverOption{},
+		NewExecutor: func(*Datasource, *Connections) (Executor, error) {
+			return &TestExecutor{}, nil
+		},
+		TestConnection: func(context.Context, *Datasource) *ConnectionReport {
+			return &ConnectionReport{Reachable: true, Authenticated: true, ServerVersion: "test"}
+		},
+	})
+
+	RegisterDriver(&Driver{
+		Name:  "postgres",
+		Label: "PostgreSQL",
+		Options: []DriverOption{
+			{Name: "host", Label: "Host", Type: OptionString, Required: true},
+			{Name: "port", Label: "Port", Type: OptionInteger, Default: 5432},
+			{Name: "database", Label: "Database", Type: OptionString, Required: true},
+			{Name: "user", Label: "User", Type: OptionString, Required: true},
+			{Name: "password", Label: "Password", Type: OptionString, Secret: true},
+			{Name: "sslmode", Label: "SSL mode", Type: OptionString, Default: "require",
+				Values: []string{"disable", "allow", "prefer", "require", "verify-ca", "verify-full"}},
+		},
+		DSN:     postgresDSN,
+		Version: "SELECT version()",
+	})
+
+	RegisterDriver(&Driver{
+		Name:  "mysql",
+		Label: "MySQL",
+		Options: []DriverOption{
+			{Name: "host", Label: "Host", Type: OptionString, Required: true},
+			{Name: "port", Label: "Port", Type: OptionInteger, Default: 3306},
+			{Name: "database", Label: "Database", Type: OptionString, Required: true},
+			{Name: "user", Label: "User", Type: OptionString, Required: true},
+			{Name: "password", Label: "Password", Type: OptionString, Secret: true},
+			{Name: "tls", Label: "TLS", Type: OptionString, Default: "preferred",
+				Values: []string{"false", "preferred", "skip-verify", "true"}},
+		},
+		DSN:     mysqlDSN,
+		Version: "SELECT version()",
+	})
+
+	RegisterDriver(&Driver{
+		Name:  "snowflake",
+		Label: "Snowflake",
+		Options: []DriverOption{
+			{Name: "account", Label: "Account", Type: OptionString, Required: true},
+			{Name: "user", Label: "User", Type: OptionString, Required: true},
+			{Name: "password", Label: "Password", Type: OptionString, Required: true, Secret: true},
+			{Name: "database", Label: "Database", Type: OptionString},
+			{Name: "schema", Label: "Schema", Type: OptionString},
+			{Name: "warehouse", Label: "Warehouse", Type: OptionString},
+			{Name: "role", Label: "Role", Type: OptionString},
+		},
+		DSN:     snowflakeDSN,
+		Version: "SELECT current_version()",
+	})
+}
+
+// postgresDSN builds a postgres:// URL, escaping each of its parts
+func postgresDSN(config DriverConfig) (string, error) {
+	dsn := &url.URL{
+		Scheme: "postgres",
+		Host:   net.JoinHostPort(config.String("host"), strconv.Itoa(config.Int("port"))),
+		Path:   "/" + config.String("database"),
+	}
+
+	if password := config.String("password"); password != "" {
+		dsn.User = url.UserPassword(config.String("user"), password)
+	} else {
+		dsn.User = url.User(config.String("user"))
+	}
+
+	dsn.RawQuery = url.Values{"sslmode": {config.String("sslmode")}}.Encode()
+
+	return dsn.String(), nil
+}
+
+func mysqlDSN(config DriverConfig) (string, error) {
+	dsn := mysql.NewConfig()
+	dsn.Net = "tcp"
+	dsn.Addr = net.JoinHostPort(config.String("host"), strconv.Itoa(config.Int("port")))
+	dsn.DBName = config.String("database")
+	dsn.User = config.String("user")
+	dsn.Passwd = config.String("password")
+	dsn.TLSConfig = config.String("tls")
+
+	return dsn.FormatDSN(), nil
+}
+
+func snowflakeDSN(config DriverConfig) (string, error) {
+	return gosnowflake.DSN(&gosnowflake.Config{
+		Account:   config.String("account"),
+		User:      config.String("user"),
+		Password:  config.String("password"),
+		Database:  config.String("database"),
+		Schema:    config.String("schema"),
+		Warehouse: config.String("warehouse"),
+		Role:      config.String("role"),
+	})
+}
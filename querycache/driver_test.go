@@ -0,0 +1,83 @@
+package querycache_test
+
+import (
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func TestDriverConfigure(t *testing.T) {
+	t.Parallel()
+
+	for name, test := range map[string]struct {
+		config   querycache.DriverConfig
+		expected string
+	}{
+		"postgres": {
+			querycache.DriverConfig{
+				"host": "db", "database": "bissy", "user": "bissy", "password": "p@ss word"},
+			"postgres://bissy:p%40ss%20word@db:5432/bissy?sslmode=require",
+		},
+		"mysql": {
+			querycache.DriverConfig{
+				"host": "db", "port": float64(3307), "database": "bissy", "user": "bissy", "password": "secret", "tls": "true"},
+			"bissy:secret@tcp(db:3307)/bissy?tls=true",
+		},
+		"snowflake": {
+			querycache.DriverConfig{
+				"account": "bissy", "user": "bissy", "password": "secret", "warehouse": "compute", "role": "analyst"},
+			"bissy:secret@bissy.snowflakecomputing.com:443?ocspFailOpen=true&role=analyst&validateDefaultParameters=true&warehouse=compute",
+		},
+		"test": {querycache.DriverConfig{}, ""},
+	} {
+		driver, ok := querycache.LookupDriver(name)
+		expect.True(t, ok)
+
+		dsn, err := driver.Configure(test.config)
+		expect.Ok(t, err)
+		expect.Equal(t, test.expected, dsn)
+	}
+}
+
+func TestDriverValidate(t *testing.T) {
+	t.Parallel()
+
+	driver, ok := querycache.LookupDriver("postgres")
+	expect.True(t, ok)
+
+	validated, err := driver.Validate(querycache.DriverConfig{
+		"host": "db", "port": float64(6432), "database": "bissy", "user": "bissy"})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.DriverConfig{
+		"host": "db", "port": 6432, "database": "bissy", "user": "bissy", "sslmode": "require"}, validated)
+
+	for _, config := range []querycache.DriverConfig{
+		{"database": "bissy", "user": "bissy"},
+		{"host": "", "database": "bissy", "user": "bissy"},
+		{"host": "db", "port": "5432", "database": "bissy", "user": "bissy"},
+		{"host": "db", "port": 54.32, "database": "bissy", "user": "bissy"},
+		{"host": "db", "database": "bissy", "user": "bissy", "sslmode": "sometimes"},
+		{"host": "db", "database": "bissy", "user": "bissy", "warehouse": "compute"},
+	} {
+		_, err := driver.Validate(config)
+		expect.True(t, err != nil)
+	}
+}
+
+func TestDrivers(t *testing.T) {
+	t.Parallel()
+
+	names := []string{}
+	for _, driver := range querycache.Drivers() {
+		// sqlite is only registered once enabled, see TestSQLiteConfigure
+		if driver.Name != "sqlite" {
+			names = append(names, driver.Name)
+		}
+	}
+
+	expect.Equal(t, []string{"mysql", "postgres", "snowflake", "test"}, names)
+
+	_, ok := querycache.LookupDriver("oracle")
+	expect.False(t, ok)
+}
@@ -1,16 +1,20 @@
 package querycache
 
 import (
-	"bytes"
 	"context"
 	"database/sql"
-	"encoding/csv"
+	"encoding/base64"
 	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/cga1123/bissy-api/utils"
 	"github.com/go-redis/redis/v8"
+	"github.com/google/uuid"
 
 	// add support for mysql databases
 	_ "github.com/go-sql-driver/mysql"
@@ -22,36 +26,120 @@ import (
 
 // QueryCache defines the interface for a cache of query results
 type QueryCache interface {
-	Get(*Query) (string, bool)
-	Set(*Query, string) error
+	Get(string) (string, bool)
+	Set(string, string, time.Duration) error
+}
+
+// Locker may be implemented by a QueryCache to provide locks shared by every
+// instance using the cache. Lock returns whether the lock on key was acquired,
+// along with a token to release it with. Locks expire after the given ttl so
+// that a crashed holder does not hold them forever.
+type Locker interface {
+	Lock(key string, ttl time.Duration) (string, bool, error)
+	Unlock(key, token string) error
+}
+
+// Evicter may be implemented by a QueryCache to remove every cached result of
+// a Query, whatever arguments it was executed with
+type Evicter interface {
+	Evict(queryID string) error
+}
+
+type inMemoryEntry struct {
+	value   string
+	expires time.Time
 }
 
 // InMemoryCache is an in-memory implementation of QueryCache
 type InMemoryCache struct {
-	Cache map[string]string
+	Clock utils.Clock
+	cache map[string]inMemoryEntry
+	locks map[string]inMemoryEntry
 	lock  sync.RWMutex
+	token int
 }
 
 // NewInMemoryCache sets up a new InMemoryCache
 func NewInMemoryCache() *InMemoryCache {
-	return &InMemoryCache{Cache: map[string]string{}}
+	return &InMemoryCache{
+		Clock: &utils.RealClock{},
+		cache: map[string]inMemoryEntry{},
+		locks: map[string]inMemoryEntry{},
+	}
 }
 
-// Get returns the cached results for a given query
-func (cache *InMemoryCache) Get(query *Query) (string, bool) {
+// Get returns the cached results for a given key
+func (cache *InMemoryCache) Get(key string) (string, bool) {
 	cache.lock.RLock()
 	defer cache.lock.RUnlock()
 
-	value, ok := cache.Cache[query.ID]
-	return value, ok
+	entry, ok := cache.cache[key]
+	if !ok {
+		return "", false
+	}
+
+	if !entry.expires.IsZero() && !cache.Clock.Now().Before(entry.expires) {
+		return "", false
+	}
+
+	return entry.value, true
+}
+
+// Set caches the results for a given key, a zero expiration means the entry
+// does not expire
+func (cache *InMemoryCache) Set(key, result string, expiration time.Duration) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	entry := inMemoryEntry{value: result}
+	if expiration > 0 {
+		entry.expires = cache.Clock.Now().Add(expiration)
+	}
+
+	cache.cache[key] = entry
+
+	return nil
+}
+
+// Evict removes the cached results of the Query
+func (cache *InMemoryCache) Evict(queryID string) error {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	for key := range cache.cache {
+		if key == queryID || strings.HasPrefix(key, queryID+":") {
+			delete(cache.cache, key)
+		}
+	}
+
+	return nil
+}
+
+// Lock acquires the lock on key unless it is already held
+func (cache *InMemoryCache) Lock(key string, ttl time.Duration) (string, bool, error) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+
+	now := cache.Clock.Now()
+	if held, ok := cache.locks[key]; ok && now.Before(held.expires) {
+		return "", false, nil
+	}
+
+	cache.token++
+	token := strconv.Itoa(cache.token)
+	cache.locks[key] = inMemoryEntry{value: token, expires: now.Add(ttl)}
+
+	return token, true, nil
 }
 
-// Set caches the results for a given query
-func (cache *InMemoryCache) Set(query *Query, result string) error {
+// Unlock releases the lock on key if it is still held with token
+func (cache *InMemoryCache) Unlock(key, token string) error {
 	cache.lock.Lock()
 	defer cache.lock.Unlock()
 
-	cache.Cache[query.ID] = result
+	if held, ok := cache.locks[key]; ok && held.value == token {
+		delete(cache.locks, key)
+	}
 
 	return nil
 }
@@ -61,55 +149,297 @@ type RedisCache struct {
 	Client *redis.Client
 }
 
-// Get returns the cached results for a given query
-func (cache *RedisCache) Get(query *Query) (string, bool) {
+// Get returns the cached results for a given key
+func (cache *RedisCache) Get(key string) (string, bool) {
 	value, err := cache.Client.Get(
 		context.TODO(),
-		"querycache:"+query.ID,
+		"querycache:"+key,
 	).Result()
 
 	return value, err == nil
 }
 
-// Set caches the results for a given query
-func (cache *RedisCache) Set(query *Query, result string) error {
+// Set caches the results for a given key
+func (cache *RedisCache) Set(key, result string, expiration time.Duration) error {
 	set := cache.Client.Set(
 		context.TODO(),
-		"querycache:"+query.ID,
+		"querycache:"+key,
 		result,
-		time.Duration(query.Lifetime))
+		expiration)
 
 	return set.Err()
 }
 
+// Evict removes the cached results of the Query, scanning for the keys of
+// every set of arguments it was executed with
+func (cache *RedisCache) Evict(queryID string) error {
+	ctx := context.TODO()
+	keys := []string{"querycache:" + queryID}
+
+	iter := cache.Client.Scan(ctx, 0, "querycache:"+queryID+":*", 100).Iterator()
+	for iter.Next(ctx) {
+		keys = append(keys, iter.Val())
+	}
+
+	if err := iter.Err(); err != nil {
+		return err
+	}
+
+	return cache.Client.Del(ctx, keys...).Err()
+}
+
+// Lock acquires the lock on key unless it is already held, by this or any
+// other instance
+func (cache *RedisCache) Lock(key string, ttl time.Duration) (string, bool, error) {
+	token := uuid.New().String()
+
+	ok, err := cache.Client.SetNX(
+		context.TODO(),
+		"querycache:lock:"+key,
+		token,
+		ttl).Result()
+
+	return token, ok, err
+}
+
+// unlockScript deletes a lock only if it is still held with the given token,
+// so that an expired lock since taken by another instance is left alone
+var unlockScript = redis.NewScript(`
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+
+// Unlock releases the lock on key if it is still held with token
+func (cache *RedisCache) Unlock(key, token string) error {
+	return unlockScript.Run(
+		context.TODO(),
+		cache.Client,
+		[]string{"querycache:lock:" + key},
+		token).Err()
+}
+
+// CacheKey returns the key under which results of the given query executed
+// with the given arguments are cached, or an error if the arguments can't be
+// hashed
+func CacheKey(query *Query, args Arguments) (string, error) {
+	hash, err := args.Hash()
+	if err != nil {
+		return "", err
+	}
+
+	return resultKey(query, hash), nil
+}
+
+// resultKey returns the cache key of the results of the query executed with
+// arguments of the given hash
+func resultKey(query *Query, argsHash string) string {
+	if argsHash == "" {
+		return query.ID
+	}
+
+	return query.ID + ":" + argsHash
+}
+
 // Executor defines the interface to execute a query
 type Executor interface {
-	Execute(*Query) (string, error)
+	Execute(context.Context, *Query, Arguments) (*Result, error)
+}
+
+// Streamer is implemented by Executors which can write a result to a RowWriter
+// row by row as it is read, rather than buffering the whole result
+type Streamer interface {
+	Stream(context.Context, *Query, Arguments, RowWriter) error
+}
+
+// Stream writes the result of the query to the given RowWriter, streaming it
+// if the Executor supports it
+func Stream(ctx context.Context, executor Executor, query *Query, args Arguments, w RowWriter) error {
+	if streamer, ok := executor.(Streamer); ok {
+		return streamer.Stream(ctx, query, args, w)
+	}
+
+	result, err := executor.Execute(ctx, query, args)
+	if err != nil {
+		return err
+	}
+
+	return result.Write(w)
 }
 
 // TestExecutor implements an Executor that echoes the passed query
 type TestExecutor struct{}
 
 // Execute echoes the given query
-func (t *TestExecutor) Execute(query *Query) (string, error) {
-	return fmt.Sprintf("Got: %v", query.Query), nil
+func (t *TestExecutor) Execute(ctx context.Context, query *Query, args Arguments) (*Result, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return &Result{
+		Columns: []Column{{Name: "query", Type: "TEXT"}},
+		Rows:    [][]interface{}{{fmt.Sprintf("Got: %v", query.Query)}},
+	}, nil
 }
 
+// The defaults for how long execution locks are held for, and how often their
+// waiters check for a result
+const (
+	defaultLockTimeout = time.Minute
+	defaultLockPoll    = 100 * time.Millisecond
+)
+
 // CachedExecutor implements Executor that caches query results for the given
-// Lifetime of a Query
+// Lifetime of a Query.
+// Results larger than MaxBytes are not cached, a zero value means no limit.
+// Concurrent executions of the same query and arguments are coalesced using
+// Flights, if set, and across instances when the Cache is a Locker. Locks are
+// held until the execution's deadline, or LockTimeout if it has none, and
+// waiters check for a result every LockPoll.
+// Every execution is recorded as a Run in Runs, if set, and results cached are
+// retained in Snapshots, if set, according to the Query's retention policy.
 type CachedExecutor struct {
-	Cache    QueryCache
-	Executor Executor
-	Store    QueryStore
-	Clock    utils.Clock
+	Cache       QueryCache
+	Executor    Executor
+	Store       QueryStore
+	Runs        RunStore
+	Snapshots   SnapshotStore
+	Clock       utils.Clock
+	MaxBytes    int
+	Flights     *Flights
+	LockTimeout time.Duration
+	LockPoll    time.Duration
+}
+
+// CacheInfo describes a result served from the cache. Age is the time since
+// it was executed at ExecutedAt, Stale is set once it is older than the
+// query's Lifetime and Failed is set when it is served because executing the
+// query failed. Hash is a hash of the result's content.
+type CacheInfo struct {
+	Age        time.Duration
+	Stale      bool
+	Failed     bool
+	ExecutedAt time.Time
+	Hash       string
+}
+
+// CacheInfoWriter may be implemented by a RowWriter to be told when a result is
+// served from the cache, WriteCacheInfo is called before WriteColumns.
+type CacheInfoWriter interface {
+	WriteCacheInfo(CacheInfo)
 }
 
-func updateCache(cache *CachedExecutor, query *Query, result string) {
-	if err := cache.Cache.Set(query, result); err != nil {
+// cacheExpiration returns how long results of the query are kept in the cache,
+// stale results are kept for as long as they may still be served
+func cacheExpiration(query *Query) time.Duration {
+	stale := query.StaleWhileRevalidate
+	if query.StaleIfError > stale {
+		stale = query.StaleIfError
+	}
+
+	return time.Duration(query.Lifetime + stale)
+}
+
+func updateCache(cache *CachedExecutor, query *Query, args Arguments, result *Result) {
+	now := cache.Clock.Now()
+
+	entry := &cacheEntry{Result: result, ExecutedAt: now}
+
+	value, err := marshalEntry(entry)
+	if err != nil {
+		log.Printf("querycache: failed to encode result of query %v: %v", query.ID, err)
+		return
+	}
+
+	if cache.MaxBytes > 0 && len(value) > cache.MaxBytes {
+		return
+	}
+
+	argsHash, err := args.Hash()
+	if err != nil {
+		log.Printf("querycache: failed to cache result of query %v: %v", query.ID, err)
+		return
+	}
+
+	if err := cache.Cache.Set(resultKey(query, argsHash), value, cacheExpiration(query)); err != nil {
+		log.Printf("querycache: failed to cache result of query %v: %v", query.ID, err)
+		return
+	}
+
+	snapshot(cache.Snapshots, query, argsHash, entry)
+
+	// parameterised results each have their own lifetime, tracked by the cache
+	if len(args) > 0 {
 		return
 	}
 
-	cache.Store.Update(query.UserID, query.ID, &UpdateQuery{LastRefresh: cache.Clock.Now()})
+	if _, err := cache.Store.Update(query.UserID, query.ID, &UpdateQuery{LastRefresh: now}); err != nil {
+		log.Printf("querycache: failed to update last refresh of query %v: %v", query.ID, err)
+	}
+}
+
+// runRecorder collects the details of a single execution by a CachedExecutor,
+// recording it as a Run once finished
+type runRecorder struct {
+	cache   *CachedExecutor
+	ctx     context.Context
+	query   *Query
+	started time.Time
+	hit     bool
+	rows    int
+	bytes   int
+	err     error
+
+	// writeErr fails the response to the caller, but not the execution
+	writeErr error
+}
+
+func (cache *CachedExecutor) startRun(ctx context.Context, query *Query) *runRecorder {
+	return &runRecorder{
+		cache:   cache,
+		ctx:     ctx,
+		query:   query,
+		started: cache.Clock.Now(),
+	}
+}
+
+// served notes the result served, and whether it was served without executing
+// the query
+func (r *runRecorder) served(result *Result, hit bool) {
+	r.hit = hit
+	r.rows, r.bytes = result.size()
+}
+
+// finish records the Run, failed with err if set or any error noted while
+// serving a result. Errors writing a result which was otherwise executed in
+// full do not fail the Run.
+func (r *runRecorder) finish(err error) {
+	if r.cache.Runs == nil {
+		return
+	}
+
+	if err == nil || err == r.writeErr {
+		err = r.err
+	}
+
+	status, message := runOutcome(r.ctx, err)
+
+	_, err = r.cache.Runs.Create(&CreateRun{
+		UserID:       r.query.UserID,
+		QueryID:      r.query.ID,
+		DatasourceID: r.query.DatasourceID,
+		Trigger:      Trigger(r.ctx),
+		Status:       status,
+		StartedAt:    r.started,
+		EndedAt:      r.cache.Clock.Now(),
+		RowCount:     r.rows,
+		Bytes:        r.bytes,
+		CacheHit:     r.hit,
+		Error:        message,
+	})
+	if err != nil {
+		log.Printf("querycache: failed to record run of query %v: %v", r.query.ID, err)
+	}
 }
 
 // NewCachedExecutor sets up a new CachedExecutor
@@ -122,28 +452,410 @@ func NewCachedExecutor(cache QueryCache, store QueryStore, clock utils.Clock, ex
 	}
 }
 
+// cached returns the cached result for the query, stale or not, along with its
+// CacheInfo.
+// The age of results without arguments is based on the query's LastRefresh,
+// so that updating it invalidates the cache.
+func (cache *CachedExecutor) cached(query *Query, args Arguments) (*Result, CacheInfo, bool) {
+	if query.Lifetime <= 0 {
+		return nil, CacheInfo{}, false
+	}
+
+	// arguments which can't be hashed fail once executed
+	key, err := CacheKey(query, args)
+	if err != nil {
+		return nil, CacheInfo{}, false
+	}
+
+	entry, ok := cache.entry(key)
+	if !ok {
+		return nil, CacheInfo{}, false
+	}
+
+	executedAt := entry.ExecutedAt
+	if len(args) == 0 {
+		executedAt = query.LastRefresh
+	}
+
+	age := cache.Clock.Now().Sub(executedAt)
+	info := CacheInfo{
+		Age:        age,
+		Stale:      Duration(age) >= query.Lifetime,
+		ExecutedAt: executedAt,
+		Hash:       entry.Hash,
+	}
+
+	return entry.Result, info, true
+}
+
+// within determines whether a cached result is no older than the query's
+// Lifetime plus the given window
+func within(query *Query, info CacheInfo, window Duration) bool {
+	return window > 0 && Duration(info.Age) < query.Lifetime+window
+}
+
+// serveCached determines whether the cached result described by info should
+// be served, triggering a background refresh if it is stale but within the
+// query's StaleWhileRevalidate window
+func (cache *CachedExecutor) serveCached(ctx context.Context, query *Query, args Arguments, info CacheInfo) bool {
+	if !info.Stale {
+		return true
+	}
+
+	if !within(query, info, query.StaleWhileRevalidate) {
+		return false
+	}
+
+	cache.revalidate(ctx, query, args)
+
+	return true
+}
+
+// revalidate refreshes the query in the background. The refresh outlives the
+// request in ctx, but keeps to its deadline.
+func (cache *CachedExecutor) revalidate(ctx context.Context, query *Query, args Arguments) {
+	var background context.Context
+	var cancel context.CancelFunc
+
+	if deadline, ok := ctx.Deadline(); ok {
+		background, cancel = context.WithDeadline(context.Background(), deadline)
+	} else {
+		background, cancel = context.WithCancel(context.Background())
+	}
+
+	go func() {
+		defer cancel()
+
+		if _, err := cache.Refresh(background, query, args); err != nil {
+			log.Printf("querycache: failed to revalidate query %v: %v", query.ID, err)
+		}
+	}()
+}
+
+func writeCached(result *Result, info CacheInfo, w RowWriter) error {
+	if infoWriter, ok := w.(CacheInfoWriter); ok {
+		infoWriter.WriteCacheInfo(info)
+	}
+
+	return result.Write(w)
+}
+
 // Execute checks the cache for the given query cache, fallsback to the the
 // configured executor if no results are found and stores the new results.
-func (cache *CachedExecutor) Execute(query *Query) (string, error) {
-	if query.Fresh(cache.Clock.Now()) {
-		if result, ok := cache.Cache.Get(query); ok {
-			return result, nil
+// Results are cached per set of Arguments.
+// Stale results are returned within the query's StaleWhileRevalidate window
+// while being refreshed in the background, and within its StaleIfError window
+// when the configured executor fails.
+func (cache *CachedExecutor) Execute(ctx context.Context, query *Query, args Arguments) (result *Result, err error) {
+	record := cache.startRun(ctx, query)
+	defer func() { record.finish(err) }()
+
+	cached, info, ok := cache.cached(query, args)
+	if ok && cache.serveCached(ctx, query, args, info) {
+		record.served(cached, true)
+
+		return cached, nil
+	}
+
+	result, executed, err := cache.refresh(ctx, query, args)
+	if err != nil && ok && within(query, info, query.StaleIfError) {
+		log.Printf("querycache: serving stale result for query %v: %v", query.ID, err)
+
+		record.err = err
+		record.served(cached, true)
+
+		return cached, nil
+	}
+
+	if err == nil {
+		record.served(result, !executed)
+	}
+
+	return result, err
+}
+
+// Refresh executes the query with the configured executor regardless of the
+// state of the cache, and stores the new results.
+func (cache *CachedExecutor) Refresh(ctx context.Context, query *Query, args Arguments) (result *Result, err error) {
+	record := cache.startRun(ctx, query)
+	defer func() { record.finish(err) }()
+
+	result, executed, err := cache.refresh(ctx, query, args)
+	if err == nil {
+		record.served(result, !executed)
+	}
+
+	return result, err
+}
+
+// Refreshing returns an Executor executing queries through Refresh, and
+// streaming them as Stream does on a miss, bypassing the cache while still
+// storing the new results
+func (cache *CachedExecutor) Refreshing() Executor {
+	return &refreshingExecutor{cache: cache}
+}
+
+type refreshingExecutor struct {
+	cache *CachedExecutor
+}
+
+func (r *refreshingExecutor) Execute(ctx context.Context, query *Query, args Arguments) (*Result, error) {
+	return r.cache.Refresh(ctx, query, args)
+}
+
+// Stream streams the result of the configured executor to w as
+// CachedExecutor.Stream does on a miss, without looking up the cache
+func (r *refreshingExecutor) Stream(ctx context.Context, query *Query, args Arguments, w RowWriter) (err error) {
+	record := r.cache.startRun(ctx, query)
+	defer func() { record.finish(err) }()
+
+	return r.cache.stream(ctx, query, args, w, record)
+}
+
+func (cache *CachedExecutor) refresh(ctx context.Context, query *Query, args Arguments) (*Result, bool, error) {
+	return cache.coalesce(ctx, query, args, func() (*Result, error) {
+		result, err := cache.Executor.Execute(ctx, query, args)
+		if err != nil {
+			return nil, err
+		}
+
+		updateCache(cache, query, args, result)
+
+		return result, nil
+	})
+}
+
+// Stream writes the cached result for the given query if available. Otherwise
+// the result is streamed from the configured executor to w, while also being
+// recorded for the cache unless it grows beyond MaxBytes.
+// Stale results are served as with Execute, when a stale result may be served
+// on error the new result is buffered rather than streamed so that the stale
+// result can still be written if the executor fails.
+func (cache *CachedExecutor) Stream(ctx context.Context, query *Query, args Arguments, w RowWriter) (err error) {
+	record := cache.startRun(ctx, query)
+	defer func() { record.finish(err) }()
+
+	cached, info, ok := cache.cached(query, args)
+	if ok && cache.serveCached(ctx, query, args, info) {
+		record.served(cached, true)
+
+		return writeCached(cached, info, w)
+	}
+
+	if ok && within(query, info, query.StaleIfError) {
+		refreshed, executed, refreshErr := cache.refresh(ctx, query, args)
+		if refreshErr != nil {
+			log.Printf("querycache: serving stale result for query %v: %v", query.ID, refreshErr)
+
+			record.err = refreshErr
+			record.served(cached, true)
+			info.Failed = true
+
+			return writeCached(cached, info, w)
 		}
+
+		record.served(refreshed, !executed)
+
+		return refreshed.Write(w)
 	}
 
-	result, err := cache.Executor.Execute(query)
+	return cache.stream(ctx, query, args, w, record)
+}
+
+// stream streams the result of the configured executor to w, recording it for
+// the cache, unless the same execution is already in flight in which case its
+// result is written once done.
+// Errors writing to w only fail this caller, the execution carries on so that
+// its result is still cached and shared with any waiters.
+func (cache *CachedExecutor) stream(ctx context.Context, query *Query, args Arguments, w RowWriter, record *runRecorder) error {
+	var writeErr error
+
+	result, executed, err := cache.coalesce(ctx, query, args, func() (*Result, error) {
+		recorder := newResultRecorder(cache.MaxBytes)
+		tee := &teeWriter{primary: w, recorder: recorder}
+		streamErr := Stream(ctx, cache.Executor, query, args, tee)
+
+		record.rows, record.bytes = recorder.size()
+		writeErr = tee.err
+
+		result, ok := recorder.Result()
+		if !ok && writeErr != nil {
+			// aborted by w, with no result to share waiters execute themselves
+			return nil, nil
+		}
+
+		record.writeErr = writeErr
+
+		if streamErr != nil {
+			return nil, streamErr
+		}
+
+		if !ok {
+			return nil, nil
+		}
+
+		updateCache(cache, query, args, result)
+
+		return result, nil
+	})
+
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if executed {
+		return writeErr
 	}
 
-	updateCache(cache, query, result)
+	record.served(result, true)
 
-	return result, nil
+	return result.Write(w)
+}
+
+// coalesce calls run to execute the query unless the same execution is
+// already in flight, in this or another instance, in which case its result is
+// returned instead. executed reports whether run was called.
+// run may return a nil result, when it is too large to share, in which case
+// waiters call run themselves.
+func (cache *CachedExecutor) coalesce(ctx context.Context, query *Query, args Arguments, run func() (*Result, error)) (*Result, bool, error) {
+	key, err := CacheKey(query, args)
+	if err != nil {
+		return nil, false, err
+	}
+
+	executed := false
+	locked := func() (*Result, error) {
+		result, ran, err := cache.locked(ctx, query, key, run)
+		executed = ran
+
+		return result, err
+	}
+
+	var result *Result
+
+	if cache.Flights == nil {
+		result, err = locked()
+	} else {
+		result, err = cache.Flights.Do(ctx, key, locked)
+	}
+
+	if err == nil && result == nil && !executed {
+		result, err = run()
+		executed = true
+	}
+
+	return result, executed, err
+}
+
+// locked calls run while holding the cache's lock for the query under key, if
+// the cache is a Locker. While another instance holds the lock, it waits for that
+// instance's result to be cached and returns it instead, or takes over the
+// lock once it is released or expires.
+func (cache *CachedExecutor) locked(ctx context.Context, query *Query, key string, run func() (*Result, error)) (*Result, bool, error) {
+	locker, ok := cache.Cache.(Locker)
+	if !ok {
+		result, err := run()
+		return result, true, err
+	}
+
+	// compare against the entry already cached rather than our clock, which
+	// may be skewed from that of other instances
+	var since time.Time
+	if entry, ok := cache.entry(key); ok {
+		since = entry.ExecutedAt
+	}
+
+	poll := cache.LockPoll
+	if poll <= 0 {
+		poll = defaultLockPoll
+	}
+
+	for {
+		token, acquired, err := locker.Lock(key, cache.lockTimeout(ctx))
+		if err != nil {
+			log.Printf("querycache: failed to lock query %v, executing without: %v", query.ID, err)
+
+			result, err := run()
+			return result, true, err
+		}
+
+		// the holder we were waiting on may have just released the lock
+		if result, ok := cache.executedSince(key, since); ok {
+			if acquired {
+				cache.unlock(locker, key, token)
+			}
+
+			return result, false, nil
+		}
+
+		if acquired {
+			defer cache.unlock(locker, key, token)
+
+			result, err := run()
+			return result, true, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, false, ctx.Err()
+		case <-time.After(poll):
+		}
+	}
+}
+
+func (cache *CachedExecutor) lockTimeout(ctx context.Context) time.Duration {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) > 0 {
+		return time.Until(deadline)
+	}
+
+	if cache.LockTimeout > 0 {
+		return cache.LockTimeout
+	}
+
+	return defaultLockTimeout
+}
+
+func (cache *CachedExecutor) unlock(locker Locker, key, token string) {
+	if err := locker.Unlock(key, token); err != nil {
+		log.Printf("querycache: failed to unlock %v: %v", key, err)
+	}
+}
+
+func (cache *CachedExecutor) entry(key string) (*cacheEntry, bool) {
+	value, ok := cache.Cache.Get(key)
+	if !ok {
+		return nil, false
+	}
+
+	entry, err := unmarshalEntry(value)
+	if err != nil {
+		return nil, false
+	}
+
+	return entry, true
+}
+
+// executedSince returns the cached result under key if it was executed after
+// since
+func (cache *CachedExecutor) executedSince(key string, since time.Time) (*Result, bool) {
+	entry, ok := cache.entry(key)
+	if !ok || !entry.ExecutedAt.After(since) {
+		return nil, false
+	}
+
+	return entry.Result, true
 }
 
-// SQLExecutor implements Executor against an *sql.DB
+// SQLExecutor implements Executor against an *sql.DB, results are truncated to
+// the tightest of its limits and those of the Query.
+// When readOnly, queries which are not read-only are rejected, and the rest run
+// within a read-only transaction if the driver supports them.
 type SQLExecutor struct {
-	db *sql.DB
+	db          *sql.DB
+	driver      string
+	placeholder PlaceholderStyle
+	limits      Limits
+	readOnly    bool
 }
 
 // NewSQLExecutor builds a new SQLExecutor, parameters are passed to sql.Open
@@ -153,85 +865,258 @@ func NewSQLExecutor(driver, conn string) (*SQLExecutor, error) {
 		return nil, err
 	}
 
-	return &SQLExecutor{db: db}, nil
+	return newSQLExecutor(driver, db), nil
+}
+
+func newSQLExecutor(driver string, db *sql.DB) *SQLExecutor {
+	placeholder := QuestionPlaceholders
+	if driver == "postgres" {
+		placeholder = DollarPlaceholders
+	}
+
+	return &SQLExecutor{db: db, driver: driver, placeholder: placeholder}
+}
+
+// readOnlyTransactions lists the drivers which support read-only transactions,
+// started with SET TRANSACTION READ ONLY on postgres and START TRANSACTION READ
+// ONLY on mysql
+var readOnlyTransactions = map[string]bool{
+	"postgres": true,
+	"mysql":    true,
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	QueryContext(context.Context, string, ...interface{}) (*sql.Rows, error)
+}
+
+// Execute runs the query against the configured database, binding the given
+// arguments to the query's parameters. The query is cancelled if ctx is done.
+func (sql *SQLExecutor) Execute(ctx context.Context, query *Query, args Arguments) (*Result, error) {
+	recorder := newResultRecorder(0)
+	if err := sql.Stream(ctx, query, args, recorder); err != nil {
+		return nil, err
+	}
+
+	result, _ := recorder.Result()
+
+	return result, nil
 }
 
-// Execute runs the query against the configured database
-// returns the results as a CSV string
-func (sql *SQLExecutor) Execute(query *Query) (string, error) {
-	rows, err := sql.db.Query(query.Query)
+// Stream runs the query against the configured database, writing each row to
+// w as it is scanned. The query is cancelled if ctx is done.
+func (sql *SQLExecutor) Stream(ctx context.Context, query *Query, args Arguments, w RowWriter) error {
+	statement, bound, err := query.Statement(sql.placeholder, args)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	if sql.readOnly {
+		if err := CheckReadOnly(query.Query); err != nil {
+			return err
+		}
+	}
+
+	db, done, err := sql.conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	rows, err := db.QueryContext(ctx, statement, bound...)
+	if err != nil {
+		return err
 	}
 	defer rows.Close()
 
-	results, err := parseRows(rows)
+	if err := parseRows(rows, w, sql.limits.Within(query.Limits())); err != nil {
+		return err
+	}
+
+	return w.Close()
+}
+
+// conn returns what statements should be run with, a read-only transaction if
+// the executor is readOnly and the driver supports them, to be released with
+// the returned func once done
+func (executor *SQLExecutor) conn(ctx context.Context) (queryer, func(), error) {
+	if !executor.readOnly || !readOnlyTransactions[executor.driver] {
+		return executor.db, func() {}, nil
+	}
+
+	tx, err := executor.readOnlyTx(ctx)
 	if err != nil {
-		return "", err
+		return nil, nil, err
+	}
+
+	// nothing may have been written, so there is nothing to commit
+	return tx, func() { tx.Rollback() }, nil
+}
+
+// readOnlyTx begins a read-only transaction
+func (executor *SQLExecutor) readOnlyTx(ctx context.Context) (*sql.Tx, error) {
+	if executor.driver == "postgres" {
+		tx, err := executor.db.BeginTx(ctx, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := tx.ExecContext(ctx, "SET TRANSACTION READ ONLY"); err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+
+		return tx, nil
 	}
 
-	return resultsToCSVString(*results)
+	// the mysql driver starts these with START TRANSACTION READ ONLY
+	return executor.db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
 }
 
-func parseRows(rows *sql.Rows) (*[][]string, error) {
-	cols, err := rows.Columns()
+func parseColumns(rows *sql.Rows) ([]Column, error) {
+	types, err := rows.ColumnTypes()
 	if err != nil {
 		return nil, err
 	}
 
-	results := [][]string{cols}
+	columns := make([]Column, len(types))
+	for i, t := range types {
+		column := Column{Name: t.Name(), Type: strings.ToUpper(t.DatabaseTypeName())}
+
+		if nullable, ok := t.Nullable(); ok {
+			column.Nullable = &nullable
+		}
+
+		if precision, scale, ok := t.DecimalSize(); ok {
+			column.Precision = &precision
+			column.Scale = &scale
+		}
+
+		columns[i] = column
+	}
+
+	return columns, nil
+}
+
+// parseRows writes each of rows to w. Once a row would exceed limits scanning
+// stops, and w is told the result was truncated.
+func parseRows(rows *sql.Rows, w RowWriter, limits Limits) error {
+	cols, err := parseColumns(rows)
+	if err != nil {
+		return err
+	}
+
+	if err := w.WriteColumns(cols); err != nil {
+		return err
+	}
 
 	count := len(cols)
 	vals := make([]interface{}, count)
 	ptrs := make([]interface{}, count)
 
+	written := 0
+	bytes := 0
+	for _, column := range cols {
+		bytes += len(column.Name) + len(column.Type)
+	}
+
 	for rows.Next() {
-		row := make([]string, count)
+		if limits.Rows > 0 && written >= limits.Rows {
+			writeTruncated(w)
+			return nil
+		}
+
+		row := make([]interface{}, count)
 		for i := range cols {
 			ptrs[i] = &vals[i]
 		}
 
 		if err = rows.Scan(ptrs...); err != nil {
-			return nil, err
+			return err
 		}
 
-		for i := range cols {
-			row[i] = parseColumnValue(vals[i])
+		size := 0
+		for i, column := range cols {
+			row[i] = parseColumnValue(column, vals[i])
+			size += valueSize(row[i])
 		}
 
-		results = append(results, row)
-	}
-
-	if err := rows.Err(); err != nil {
-		return nil, err
-	}
+		if limits.Bytes > 0 && bytes+size > limits.Bytes {
+			writeTruncated(w)
+			return nil
+		}
 
-	return &results, nil
-}
+		written++
+		bytes += size
 
-func resultsToCSVString(rows [][]string) (string, error) {
-	buffer := bytes.Buffer{}
-	csvWriter := csv.NewWriter(&buffer)
-	if err := csvWriter.WriteAll(rows); err != nil {
-		return "", err
+		if err := w.WriteRow(row); err != nil {
+			return err
+		}
 	}
 
-	return buffer.String(), nil
+	return rows.Err()
 }
 
-func parseColumnValue(rawValue interface{}) string {
-	var value interface{}
+// parseColumnValue normalises a scanned value according to its column's type.
+// NULLs are preserved as nil, integers, floats and booleans keep their types,
+// exact decimals are returned as strings, timestamps as RFC 3339 strings and
+// binary values as base64 strings.
+func parseColumnValue(column Column, rawValue interface{}) interface{} {
+	kind := column.kind()
 
 	switch v := rawValue.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		if kind == kindDate {
+			return v.Format("2006-01-02")
+		}
+
+		return v.Format(time.RFC3339Nano)
 	case []byte:
-		value = string(v)
+		if kind == kindBinary {
+			return base64.StdEncoding.EncodeToString(v)
+		}
+
+		return parseTextValue(kind, string(v))
+	case string:
+		return parseTextValue(kind, v)
+	case float64:
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return strconv.FormatFloat(v, 'f', -1, 64)
+		}
+
+		return v
+	case float32:
+		return parseColumnValue(column, float64(v))
+	case int64, bool:
+		return v
 	default:
-		value = v
+		return fmt.Sprintf("%v", v)
 	}
+}
 
-	if value == nil {
-		return ""
+// parseTextValue parses values which drivers return in their text
+// representation (e.g. mysql without prepared statements, snowflake)
+func parseTextValue(kind columnKind, value string) interface{} {
+	switch kind {
+	case kindInteger:
+		if i, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return i
+		}
+	case kindFloat:
+		if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return f
+		}
+	case kindBoolean:
+		if b, err := strconv.ParseBool(value); err == nil {
+			return b
+		}
+	case kindTimestamp:
+		if t, err := time.Parse("2006-01-02 15:04:05.999999999", value); err == nil {
+			return t.Format(time.RFC3339Nano)
+		}
 	}
 
-	return fmt.Sprintf("%v", value)
+	return value
 }
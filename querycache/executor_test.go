@@ -1,7 +1,14 @@
 package querycache_test
 
 import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -12,6 +19,13 @@ import (
 	_ "github.com/lib/pq"
 )
 
+func echoResult(value string) *querycache.Result {
+	return &querycache.Result{
+		Columns: []querycache.Column{{Name: "query", Type: "TEXT"}},
+		Rows:    [][]interface{}{{value}},
+	}
+}
+
 func TestExecutePostgres(t *testing.T) {
 	t.Parallel()
 
@@ -24,9 +38,12 @@ func TestExecutePostgres(t *testing.T) {
 	expect.Ok(t, err)
 
 	query := &querycache.Query{Query: "SELECT * FROM (SELECT 1 a, 2 b) t"}
-	csv, err := executor.Execute(query)
+	result, err := executor.Execute(context.Background(), query, nil)
 	expect.Ok(t, err)
-	expect.Equal(t, "a,b\n1,2\n", csv)
+	expect.Equal(t, &querycache.Result{
+		Columns: []querycache.Column{{Name: "a", Type: "INT4"}, {Name: "b", Type: "INT4"}},
+		Rows:    [][]interface{}{{int64(1), int64(2)}},
+	}, result)
 }
 
 func TestCachedExecutorExecute(t *testing.T) {
@@ -51,23 +68,875 @@ func TestCachedExecutorExecute(t *testing.T) {
 		Lifetime:    querycache.Duration(time.Hour),
 		Query:       "SELECT 1;"}
 
-	result, err := executor.Execute(query)
+	result, err := executor.Execute(context.Background(), query, nil)
 	expect.Ok(t, err)
-	expect.Equal(t, "Got: SELECT 1;", result)
+	expect.Equal(t, echoResult("Got: SELECT 1;"), result)
 
 	query.Query = "SELECT 2;"
-	result, err = executor.Execute(query)
+	result, err = executor.Execute(context.Background(), query, nil)
 	expect.Ok(t, err)
-	expect.Equal(t, "Got: SELECT 1;", result)
+	expect.Equal(t, echoResult("Got: SELECT 1;"), result)
 
 	// When LastRefresh longer than Lifetime ago
-	result, err = executor.Execute(query)
+	result, err = executor.Execute(context.Background(), query, nil)
 	expect.Ok(t, err)
-	expect.Equal(t, "Got: SELECT 1;", result)
+	expect.Equal(t, echoResult("Got: SELECT 1;"), result)
 
 	query.LastRefresh = now.Add(-time.Duration(query.Lifetime)).Add(-time.Second)
 	query.Query = "SELECT 4;"
-	result, err = executor.Execute(query)
+	result, err = executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("Got: SELECT 4;"), result)
+}
+
+func TestExecutePostgresTypes(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{Query: `
+		SELECT NULL::text a, ''::text b, 1.50::numeric(4, 2) c, true d,
+			'2020-01-02T03:04:05Z'::timestamptz e, '2020-01-02'::date f, '\x0102'::bytea g`}
+	result, err := executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+
+	precision, scale := int64(4), int64(2)
+	expect.Equal(t, &querycache.Result{
+		Columns: []querycache.Column{
+			{Name: "a", Type: "TEXT"},
+			{Name: "b", Type: "TEXT"},
+			{Name: "c", Type: "NUMERIC", Precision: &precision, Scale: &scale},
+			{Name: "d", Type: "BOOL"},
+			{Name: "e", Type: "TIMESTAMPTZ"},
+			{Name: "f", Type: "DATE"},
+			{Name: "g", Type: "BYTEA"},
+		},
+		Rows: [][]interface{}{{nil, "", "1.50", true, "2020-01-02T03:04:05Z", "2020-01-02", "AQI="}},
+	}, result)
+}
+
+func TestExecutePostgresParams(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{Query: "SELECT {{a}}::int a, {{b}}::text b, {{a}}::int c"}
+	result, err := executor.Execute(context.Background(), query, querycache.Arguments{"a": int64(1), "b": "x"})
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.Result{
+		Columns: []querycache.Column{
+			{Name: "a", Type: "INT4"}, {Name: "b", Type: "TEXT"}, {Name: "c", Type: "INT4"}},
+		Rows: [][]interface{}{{int64(1), "x", int64(1)}},
+	}, result)
+}
+
+func TestExecutePostgresLimits(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{Query: "SELECT generate_series(1, 1000) n", MaxRows: 2}
+	result, err := executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.Result{
+		Columns:   []querycache.Column{{Name: "n", Type: "INT4"}},
+		Rows:      [][]interface{}{{int64(1)}, {int64(2)}},
+		Truncated: true,
+	}, result)
+
+	// the column takes 5 bytes, and each row 8
+	query = &querycache.Query{Query: "SELECT generate_series(1, 1000) n", MaxBytes: 30}
+	result, err = executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, 3, len(result.Rows))
+	expect.True(t, result.Truncated)
+
+	query = &querycache.Query{Query: "SELECT generate_series(1, 2) n", MaxRows: 2}
+	result, err = executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.False(t, result.Truncated)
+}
+
+func TestExecutePostgresReadOnly(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+	datasource := &querycache.Datasource{ID: uuid.New().String(), Type: "postgres", Options: url, ReadOnly: true}
+	defer connections.Close(datasource.ID)
+
+	executor, err := datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{Query: "SELECT current_setting('transaction_read_only') ro"}
+	result, err := executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, [][]interface{}{{"on"}}, result.Rows)
+
+	_, err = executor.Execute(context.Background(), &querycache.Query{Query: "CREATE TABLE t (id int)"}, nil)
+	expect.Equal(t, &querycache.ReadOnlyError{Statement: 1, Reason: "CREATE modifies the schema"}, err)
+
+	datasource.ReadOnly = false
+	executor, err = datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	result, err = executor.Execute(context.Background(), query, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, [][]interface{}{{"off"}}, result.Rows)
+}
+
+func TestExplainPostgres(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{
+		Query:  "SELECT n FROM generate_series(1, {{n}}) n",
+		Params: querycache.Parameters{{Name: "n", Type: querycache.ParameterInteger, Required: true}},
+	}
+	args, err := query.Params.ExplainArguments(nil)
+	expect.Ok(t, err)
+
+	plan, err := executor.Explain(context.Background(), query, args)
+	expect.Ok(t, err)
+
+	var plans []map[string]map[string]interface{}
+	expect.Ok(t, json.Unmarshal(plan, &plans))
+	expect.Equal(t, "Function Scan", plans[0]["Plan"]["Node Type"])
+
+	_, err = executor.Explain(context.Background(), &querycache.Query{Query: "SELEC 1"}, nil)
+
+	var explainErr *querycache.ExplainError
+	expect.True(t, errors.As(err, &explainErr))
+}
+
+func TestExplainPostgresReadOnly(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+	datasource := &querycache.Datasource{ID: uuid.New().String(), Type: "postgres", Options: url, ReadOnly: true}
+	defer connections.Close(datasource.ID)
+
+	executor, err := datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	explainer := executor.(querycache.Explainer)
+
+	_, err = explainer.Explain(context.Background(), &querycache.Query{Query: "SELECT 1"}, nil)
+	expect.Ok(t, err)
+
+	_, err = explainer.Explain(context.Background(),
+		&querycache.Query{Query: "DROP TABLE querycache_explained"}, nil)
+	expect.Equal(t, &querycache.ReadOnlyError{Statement: 1, Reason: "DROP modifies the schema"}, err)
+}
+
+func TestExplainMultipleStatements(t *testing.T) {
+	t.Parallel()
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+
+	// rejected before connecting, whether or not the datasource is read-only
+	for _, readOnly := range []bool{false, true} {
+		datasource := &querycache.Datasource{ID: uuid.New().String(), Type: "postgres",
+			Options: "host=127.0.0.1 port=1 sslmode=disable", ReadOnly: readOnly}
+		defer connections.Close(datasource.ID)
+
+		executor, err := datasource.NewExecutor(connections)
+		expect.Ok(t, err)
+
+		for _, statement := range []string{"SELECT 1; DROP TABLE t", "SELECT 1;; -- ;\n SELECT 2"} {
+			_, err = executor.(querycache.Explainer).Explain(context.Background(), &querycache.Query{Query: statement}, nil)
+			expect.True(t, errors.Is(err, querycache.ErrExplainMultipleStatements))
+
+			var explainErr *querycache.ExplainError
+			expect.True(t, errors.As(err, &explainErr))
+		}
+	}
+}
+
+func TestExecutePostgresTimeout(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	executor, err := querycache.NewSQLExecutor("postgres", url)
 	expect.Ok(t, err)
-	expect.Equal(t, "Got: SELECT 4;", result)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	query := &querycache.Query{Query: "SELECT pg_sleep(5)"}
+	_, err = executor.Execute(ctx, query, nil)
+	expect.Error(t, err)
+	expect.True(t, ctx.Err() == context.DeadlineExceeded)
+}
+
+func TestExecuteCancelled(t *testing.T) {
+	t.Parallel()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	executor := &querycache.TestExecutor{}
+	_, err := executor.Execute(ctx, &querycache.Query{Query: "SELECT 1"}, nil)
+	expect.True(t, err == context.Canceled)
+}
+
+func TestCachedExecutorExecuteArguments(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	id := uuid.New().String()
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	store := newTestQueryStore(db, now, id)
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Store:    store,
+		Executor: &querycache.TestExecutor{},
+		Clock:    &utils.TestClock{Time: now},
+	}
+
+	query := &querycache.Query{
+		ID:       "1",
+		Lifetime: querycache.Duration(time.Hour),
+		Query:    "SELECT {{a}};"}
+
+	result, err := executor.Execute(context.Background(), query, querycache.Arguments{"a": int64(1)})
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("Got: SELECT {{a}};"), result)
+
+	// same arguments are served from the cache
+	query.Query = "SELECT {{a}}, 2;"
+	result, err = executor.Execute(context.Background(), query, querycache.Arguments{"a": int64(1)})
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("Got: SELECT {{a}};"), result)
+
+	// different arguments have their own entry
+	result, err = executor.Execute(context.Background(), query, querycache.Arguments{"a": int64(2)})
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("Got: SELECT {{a}}, 2;"), result)
+}
+
+// countingExecutor streams a fixed result, or fails with err if set, counting
+// how often it is executed
+type countingExecutor struct {
+	result  *querycache.Result
+	err     error
+	calls   int
+	streams int
+}
+
+func (c *countingExecutor) Execute(ctx context.Context, query *querycache.Query, args querycache.Arguments) (*querycache.Result, error) {
+	c.calls++
+
+	if c.err != nil {
+		return nil, c.err
+	}
+
+	return c.result, nil
+}
+
+func (c *countingExecutor) Stream(ctx context.Context, query *querycache.Query, args querycache.Arguments, w querycache.RowWriter) error {
+	c.calls++
+	c.streams++
+
+	if c.err != nil {
+		return c.err
+	}
+
+	return c.result.Write(w)
+}
+
+type failingWriter struct {
+	querycache.RowWriter
+}
+
+func (f *failingWriter) WriteRow([]interface{}) error {
+	return errors.New("client went away")
+}
+
+func TestCachedExecutorStream(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	source := &countingExecutor{result: testResult()}
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: source,
+		Clock:    &utils.TestClock{Time: now},
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+	csv := func() string {
+		buffer := &bytes.Buffer{}
+		writer := querycache.Formats[0].New(buffer, querycache.DefaultFormatOptions())
+		expect.Ok(t, executor.Stream(context.Background(), query, args, writer))
+
+		return buffer.String()
+	}
+
+	failing := func() error {
+		return executor.Stream(context.Background(), query, args, &failingWriter{
+			RowWriter: querycache.Formats[0].New(&bytes.Buffer{}, querycache.DefaultFormatOptions())})
+	}
+
+	// a stream failing to write to its client is still cached
+	expect.Error(t, failing())
+	expect.Equal(t, 1, source.calls)
+
+	// served from the cache
+	expect.Equal(t, "id,name\n1,\"a,b\"\n2,<c>\n3,\n", csv())
+	expect.Equal(t, 1, source.calls)
+
+	// results larger than MaxBytes are streamed but not cached
+	executor.MaxBytes = 4
+	args = querycache.Arguments{"a": int64(2)}
+
+	expect.Equal(t, "id,name\n1,\"a,b\"\n2,<c>\n3,\n", csv())
+	expect.Equal(t, "id,name\n1,\"a,b\"\n2,<c>\n3,\n", csv())
+	expect.Equal(t, 3, source.calls)
+
+	// which are aborted once writing to the client fails
+	expect.Error(t, failing())
+	expect.Equal(t, 4, source.calls)
+}
+
+// resultWriter records the columns and rows written to it
+type resultWriter struct {
+	columns []querycache.Column
+	rows    [][]interface{}
+}
+
+func (r *resultWriter) WriteColumns(columns []querycache.Column) error {
+	r.columns = columns
+
+	return nil
+}
+
+func (r *resultWriter) WriteRow(row []interface{}) error {
+	r.rows = append(r.rows, row)
+
+	return nil
+}
+
+func (r *resultWriter) Close() error {
+	return nil
+}
+
+func (r *resultWriter) result() *querycache.Result {
+	return &querycache.Result{Columns: r.columns, Rows: r.rows}
+}
+
+// infoWriter records the CacheInfo it is given
+type infoWriter struct {
+	querycache.RowWriter
+	info *querycache.CacheInfo
+}
+
+func (i *infoWriter) WriteCacheInfo(info querycache.CacheInfo) {
+	i.info = &info
+}
+
+// truncatedWriter records whether it was told the result was truncated
+type truncatedWriter struct {
+	querycache.RowWriter
+	truncated bool
+}
+
+func (w *truncatedWriter) WriteTruncated() {
+	w.truncated = true
+}
+
+func TestCachedExecutorTruncated(t *testing.T) {
+	t.Parallel()
+
+	truncated := echoResult("Got: SELECT 1")
+	truncated.Truncated = true
+
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: &countingExecutor{result: truncated},
+		Clock:    &utils.RealClock{},
+	}
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+
+	for i := 0; i < 2; i++ {
+		writer := &truncatedWriter{RowWriter: &resultWriter{}}
+		expect.Ok(t, executor.Stream(context.Background(), query, querycache.Arguments{"a": "b"}, writer))
+		expect.True(t, writer.truncated)
+	}
+
+	result, err := executor.Execute(context.Background(), query, querycache.Arguments{"a": "b"})
+	expect.Ok(t, err)
+	expect.True(t, result.Truncated)
+}
+
+func TestCachedExecutorRefreshingStream(t *testing.T) {
+	t.Parallel()
+
+	source := &countingExecutor{result: testResult()}
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: source,
+		Clock:    &utils.RealClock{},
+	}
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": "b"}
+
+	// refreshing streams from the configured executor even once cached
+	for i := 1; i <= 2; i++ {
+		recorder := &resultWriter{}
+		refreshed := &infoWriter{RowWriter: recorder}
+		expect.Ok(t, querycache.Stream(context.Background(), executor.Refreshing(), query, args, refreshed))
+		expect.Equal(t, i, source.streams)
+		expect.Equal(t, testResult().Rows, recorder.rows)
+		expect.True(t, refreshed.info == nil)
+	}
+
+	// while still caching the result
+	hit := &infoWriter{RowWriter: &resultWriter{}}
+	expect.Ok(t, executor.Stream(context.Background(), query, args, hit))
+	expect.Equal(t, 2, source.calls)
+	expect.True(t, hit.info != nil)
+}
+
+func TestCachedExecutorStale(t *testing.T) {
+	t.Parallel()
+
+	now := time.Now()
+	clock := &utils.TestClock{Time: now}
+	cache := querycache.NewInMemoryCache()
+	source := &countingExecutor{result: echoResult("first")}
+	executor := &querycache.CachedExecutor{
+		Cache:    cache,
+		Executor: source,
+		Clock:    clock,
+	}
+
+	query := &querycache.Query{
+		ID:                   "1",
+		Lifetime:             querycache.Duration(time.Hour),
+		StaleWhileRevalidate: querycache.Duration(time.Hour),
+		StaleIfError:         querycache.Duration(2 * time.Hour),
+	}
+	args := querycache.Arguments{"a": int64(1)}
+	stream := func() (*querycache.Result, *querycache.CacheInfo, error) {
+		recorder := &resultWriter{}
+		writer := &infoWriter{RowWriter: recorder}
+		err := executor.Stream(context.Background(), query, args, writer)
+
+		return recorder.result(), writer.info, err
+	}
+
+	result, info, err := stream()
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("first"), result)
+	expect.True(t, info == nil)
+
+	// fresh results are served from the cache
+	clock.Time = now.Add(30 * time.Minute)
+	result, info, err = stream()
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("first"), result)
+	expect.Equal(t, &querycache.CacheInfo{Age: 30 * time.Minute, ExecutedAt: now, Hash: info.Hash}, info)
+	expect.Equal(t, 1, source.calls)
+	firstHash := info.Hash
+	expect.True(t, firstHash != "")
+
+	// stale results are served while being refreshed in the background
+	clock.Time = now.Add(90 * time.Minute)
+	source.result = echoResult("second")
+	result, info, err = stream()
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("first"), result)
+	expect.Equal(t, &querycache.CacheInfo{Age: 90 * time.Minute, Stale: true, ExecutedAt: now, Hash: firstHash}, info)
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		value, _ := cache.Get(cacheKey(t, query, args))
+		if strings.Contains(value, "second") {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	expect.Equal(t, 2, source.calls)
+
+	result, info, err = stream()
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("second"), result)
+	expect.Equal(t, &querycache.CacheInfo{ExecutedAt: clock.Time, Hash: info.Hash}, info)
+	expect.True(t, info.Hash != firstHash)
+
+	// stale results are served when the executor fails
+	clock.Time = now.Add(240 * time.Minute)
+	source.err = errors.New("warehouse unavailable")
+	result, info, err = stream()
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("second"), result)
+	expect.Equal(t, &querycache.CacheInfo{
+		Age: 150 * time.Minute, Stale: true, Failed: true, ExecutedAt: now.Add(90 * time.Minute), Hash: info.Hash}, info)
+
+	executed, err := executor.Execute(context.Background(), query, args)
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("second"), executed)
+
+	// but not once they are older than the StaleIfError window
+	clock.Time = now.Add(300 * time.Minute)
+	_, _, err = stream()
+	expect.Error(t, err)
+}
+
+// blockingExecutor returns a fixed result once release is closed, counting
+// how often it is executed
+type blockingExecutor struct {
+	result  *querycache.Result
+	release chan struct{}
+	calls   int32
+}
+
+func (b *blockingExecutor) Execute(ctx context.Context, query *querycache.Query, args querycache.Arguments) (*querycache.Result, error) {
+	atomic.AddInt32(&b.calls, 1)
+	<-b.release
+
+	return b.result, nil
+}
+
+func (b *blockingExecutor) waitForCall(t *testing.T) {
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt32(&b.calls) == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+
+	expect.Equal(t, int32(1), atomic.LoadInt32(&b.calls))
+}
+
+func TestInMemoryCacheEvict(t *testing.T) {
+	t.Parallel()
+
+	cache := querycache.NewInMemoryCache()
+	for _, key := range []string{"1", "1:abc", "1:def", "10", "10:abc", "run:1"} {
+		expect.Ok(t, cache.Set(key, key, 0))
+	}
+
+	expect.Ok(t, cache.Evict("1"))
+
+	for key, cached := range map[string]bool{
+		"1": false, "1:abc": false, "1:def": false, "10": true, "10:abc": true, "run:1": true,
+	} {
+		_, ok := cache.Get(key)
+		expect.Equal(t, cached, ok)
+	}
+}
+
+func TestCachedExecutorCoalesce(t *testing.T) {
+	t.Parallel()
+
+	source := &blockingExecutor{result: echoResult("shared"), release: make(chan struct{})}
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: source,
+		Clock:    &utils.TestClock{Time: time.Now()},
+		Flights:  querycache.NewFlights(),
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+
+	results := make(chan *querycache.Result, 5)
+	execute := func() {
+		result, err := executor.Execute(context.Background(), query, args)
+		expect.Ok(t, err)
+		results <- result
+	}
+
+	go execute()
+	source.waitForCall(t)
+
+	for i := 0; i < 4; i++ {
+		go execute()
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	close(source.release)
+
+	for i := 0; i < 5; i++ {
+		expect.Equal(t, echoResult("shared"), <-results)
+	}
+	expect.Equal(t, int32(1), atomic.LoadInt32(&source.calls))
+}
+
+func TestCachedExecutorCoalesceWriteError(t *testing.T) {
+	t.Parallel()
+
+	source := &blockingExecutor{result: echoResult("shared"), release: make(chan struct{})}
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: source,
+		Clock:    &utils.TestClock{Time: time.Now()},
+		Flights:  querycache.NewFlights(),
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+
+	// the leader's client goes away, which must not fail the waiter
+	leader := make(chan error, 1)
+	go func() {
+		leader <- executor.Stream(context.Background(), query, args, &failingWriter{RowWriter: &resultWriter{}})
+	}()
+	source.waitForCall(t)
+
+	waiter := &resultWriter{}
+	waited := make(chan error, 1)
+	go func() {
+		waited <- executor.Stream(context.Background(), query, args, waiter)
+	}()
+
+	time.Sleep(20 * time.Millisecond)
+	close(source.release)
+
+	expect.Error(t, <-leader)
+	expect.Ok(t, <-waited)
+	expect.Equal(t, echoResult("shared"), waiter.result())
+
+	// and the result is still cached
+	result, err := executor.Execute(context.Background(), query, args)
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("shared"), result)
+	expect.Equal(t, int32(1), atomic.LoadInt32(&source.calls))
+}
+
+func TestCachedExecutorLock(t *testing.T) {
+	t.Parallel()
+
+	cache := querycache.NewInMemoryCache()
+	source := &blockingExecutor{result: echoResult("shared"), release: make(chan struct{})}
+
+	// two instances sharing a cache, but not their Flights
+	instance := func() *querycache.CachedExecutor {
+		return &querycache.CachedExecutor{
+			Cache:    cache,
+			Executor: source,
+			Clock:    &utils.TestClock{Time: time.Now()},
+			Flights:  querycache.NewFlights(),
+			LockPoll: 5 * time.Millisecond,
+		}
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+
+	results := make(chan *querycache.Result, 2)
+	execute := func(executor *querycache.CachedExecutor) {
+		result, err := executor.Execute(context.Background(), query, args)
+		expect.Ok(t, err)
+		results <- result
+	}
+
+	go execute(instance())
+	source.waitForCall(t)
+
+	go execute(instance())
+	time.Sleep(20 * time.Millisecond)
+	close(source.release)
+
+	expect.Equal(t, echoResult("shared"), <-results)
+	expect.Equal(t, echoResult("shared"), <-results)
+	expect.Equal(t, int32(1), atomic.LoadInt32(&source.calls))
+}
+
+func TestCachedExecutorLockExpired(t *testing.T) {
+	t.Parallel()
+
+	cache := querycache.NewInMemoryCache()
+	source := &countingExecutor{result: echoResult("shared")}
+	executor := &querycache.CachedExecutor{
+		Cache:    cache,
+		Executor: source,
+		Clock:    &utils.TestClock{Time: time.Now()},
+		LockPoll: 5 * time.Millisecond,
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+
+	// a holder that crashed without releasing its lock
+	_, ok, err := cache.Lock(cacheKey(t, query, args), 30*time.Millisecond)
+	expect.Ok(t, err)
+	expect.True(t, ok)
+
+	result, err := executor.Execute(context.Background(), query, args)
+	expect.Ok(t, err)
+	expect.Equal(t, echoResult("shared"), result)
+	expect.Equal(t, 1, source.calls)
+}
+
+// memoryRunStore records created Runs in memory
+type memoryRunStore struct {
+	runs []*querycache.CreateRun
+}
+
+func (m *memoryRunStore) Create(cr *querycache.CreateRun) (*querycache.Run, error) {
+	m.runs = append(m.runs, cr)
+
+	return &querycache.Run{}, nil
+}
+
+func (m *memoryRunStore) Get(string, string) (*querycache.Run, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRunStore) Update(string, *querycache.UpdateRun) (*querycache.Run, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *memoryRunStore) List(string, string, int, int) ([]*querycache.Run, error) {
+	return nil, nil
+}
+
+func (m *memoryRunStore) Prune(time.Time) (int64, error) {
+	return 0, nil
+}
+
+// memorySnapshotStore records created Snapshots and prunes in memory
+type memorySnapshotStore struct {
+	snapshots []*querycache.CreateSnapshot
+	prunes    []int
+}
+
+func (m *memorySnapshotStore) Create(cs *querycache.CreateSnapshot) (*querycache.Snapshot, error) {
+	m.snapshots = append(m.snapshots, cs)
+
+	return &querycache.Snapshot{}, nil
+}
+
+func (m *memorySnapshotStore) Get(string, string, string) (*querycache.Snapshot, error) {
+	return nil, sql.ErrNoRows
+}
+
+func (m *memorySnapshotStore) List(string, string, string, int, int) ([]*querycache.Snapshot, error) {
+	return nil, nil
+}
+
+func (m *memorySnapshotStore) Prune(queryID, argsHash string, keep int, before time.Time) (int64, error) {
+	m.prunes = append(m.prunes, keep)
+
+	return 0, nil
+}
+
+func TestCachedExecutorSnapshots(t *testing.T) {
+	t.Parallel()
+
+	snapshots := &memorySnapshotStore{}
+	executor := &querycache.CachedExecutor{
+		Cache:     querycache.NewInMemoryCache(),
+		Executor:  &countingExecutor{result: echoResult("first")},
+		Snapshots: snapshots,
+		Clock:     &utils.TestClock{Time: time.Now()},
+	}
+
+	query := &querycache.Query{ID: "1", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+
+	// snapshots are opt-in
+	_, err := executor.Refresh(context.Background(), query, args)
+	expect.Ok(t, err)
+	expect.Equal(t, 0, len(snapshots.snapshots))
+
+	query.SnapshotCount = 5
+	_, err = executor.Refresh(context.Background(), query, args)
+	expect.Ok(t, err)
+
+	// results served from the cache aren't snapshotted again
+	_, err = executor.Execute(context.Background(), query, args)
+	expect.Ok(t, err)
+
+	expect.Equal(t, 1, len(snapshots.snapshots))
+	argsHash, err := args.Hash()
+	expect.Ok(t, err)
+	expect.Equal(t, argsHash, snapshots.snapshots[0].ArgsHash)
+	expect.Equal(t, echoResult("first"), snapshots.snapshots[0].Result)
+	expect.True(t, snapshots.snapshots[0].Hash != "")
+	expect.Equal(t, []int{5}, snapshots.prunes)
+}
+
+func TestCachedExecutorRuns(t *testing.T) {
+	t.Parallel()
+
+	runs := &memoryRunStore{}
+	source := &countingExecutor{result: testResult()}
+	executor := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: source,
+		Runs:     runs,
+		Clock:    &utils.TestClock{Time: time.Now()},
+	}
+
+	query := &querycache.Query{ID: "1", DatasourceID: "2", Lifetime: querycache.Duration(time.Hour)}
+	args := querycache.Arguments{"a": int64(1)}
+	csv := querycache.Formats[0].New(&bytes.Buffer{}, querycache.DefaultFormatOptions())
+
+	expect.Ok(t, executor.Stream(context.Background(), query, args, csv))
+	expect.Ok(t, executor.Stream(context.Background(), query, args, csv))
+
+	source.err = errors.New("warehouse unavailable")
+	ctx := querycache.WithTrigger(context.Background(), querycache.TriggerScheduler)
+	_, err := executor.Refresh(ctx, query, args)
+	expect.Error(t, err)
+
+	expect.Equal(t, 3, len(runs.runs))
+
+	for i, hit := range []bool{false, true} {
+		run := runs.runs[i]
+		expect.Equal(t, "1", run.QueryID)
+		expect.Equal(t, "2", run.DatasourceID)
+		expect.Equal(t, querycache.TriggerRequest, run.Trigger)
+		expect.Equal(t, hit, run.CacheHit)
+		expect.Equal(t, 3, run.RowCount)
+		expect.True(t, run.Error == nil)
+	}
+
+	failed := runs.runs[2]
+	expect.Equal(t, querycache.TriggerScheduler, failed.Trigger)
+	expect.False(t, failed.CacheHit)
+	expect.Equal(t, "warehouse unavailable", *failed.Error)
 }
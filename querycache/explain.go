@@ -0,0 +1,151 @@
+package querycache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// ErrExplainUnsupported is returned when explaining queries against a driver
+// with no known EXPLAIN syntax
+var ErrExplainUnsupported = errors.New("explaining queries is not supported by this datasource")
+
+// ErrExplainMultipleStatements is returned when explaining a query of more than
+// one statement, as only the first would be explained and the rest run
+var ErrExplainMultipleStatements = errors.New("only queries of a single statement may be explained")
+
+// explainPrefixes are prepended to statements to have each driver return their
+// plan as JSON, without executing them
+var explainPrefixes = map[string]string{
+	"postgres":  "EXPLAIN (FORMAT JSON) ",
+	"mysql":     "EXPLAIN FORMAT=JSON ",
+	"snowflake": "EXPLAIN USING JSON ",
+}
+
+// The values bound to required Parameters with neither a value nor a default
+// when explaining a Query, plans do not depend on them
+var explainValues = map[string]string{
+	ParameterString:    "",
+	ParameterInteger:   "0",
+	ParameterNumber:    "0",
+	ParameterBoolean:   "false",
+	ParameterDate:      "1970-01-01",
+	ParameterTimestamp: "1970-01-01T00:00:00Z",
+}
+
+// Explainer is implemented by Executors which can return the plan of a query,
+// as JSON, without executing it
+type Explainer interface {
+	Explain(context.Context, *Query, Arguments) (json.RawMessage, error)
+}
+
+// ExplainError wraps the error a datasource returned explaining a query,
+// typically as it does not parse or refers to unknown tables or columns
+type ExplainError struct {
+	Err error
+}
+
+func (err *ExplainError) Error() string {
+	return fmt.Sprintf("failed to explain query: %v", err.Err)
+}
+
+// Unwrap returns the datasource's error
+func (err *ExplainError) Unwrap() error {
+	return err.Err
+}
+
+// ExplainArguments binds the given values to the Parameters as Bind does, but
+// binds required Parameters without a value or default to an arbitrary value
+// of their type, so that queries may be explained without every value they
+// require
+func (p Parameters) ExplainArguments(values map[string]string) (Arguments, error) {
+	bound := map[string]string{}
+	for name, value := range values {
+		bound[name] = value
+	}
+
+	for _, param := range p {
+		if _, ok := bound[param.Name]; ok || param.Default != nil || !param.Required {
+			continue
+		}
+
+		bound[param.Name] = explainValues[param.Type]
+	}
+
+	return p.Bind(bound)
+}
+
+// Explain returns the plan of the query against the configured database, the
+// query is not executed. The returned error is an *ExplainError if the
+// database failed to explain it or it has more than one statement, or a
+// *ReadOnlyError if the executor is read-only and the query isn't.
+func (sql *SQLExecutor) Explain(ctx context.Context, query *Query, args Arguments) (json.RawMessage, error) {
+	prefix, ok := explainPrefixes[sql.driver]
+	if !ok {
+		return nil, ErrExplainUnsupported
+	}
+
+	statement, bound, err := query.Statement(sql.placeholder, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// only the first statement is prefixed, any following it would be run
+	if countStatements(query.Query) > 1 {
+		return nil, &ExplainError{Err: ErrExplainMultipleStatements}
+	}
+
+	if sql.readOnly {
+		if err := CheckReadOnly(query.Query); err != nil {
+			return nil, err
+		}
+	}
+
+	db, done, err := sql.conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	rows, err := db.QueryContext(ctx, prefix+statement, bound...)
+	if err != nil {
+		return nil, &ExplainError{Err: err}
+	}
+	defer rows.Close()
+
+	// the plan is the only value returned, mysql names its column EXPLAIN
+	// and snowflake content
+	var plan string
+	if rows.Next() {
+		if err := rows.Scan(&plan); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, &ExplainError{Err: err}
+	}
+
+	if !json.Valid([]byte(plan)) {
+		return json.Marshal(plan)
+	}
+
+	return json.RawMessage(plan), nil
+}
+
+// Explain echoes the given query as its plan
+func (t *TestExecutor) Explain(ctx context.Context, query *Query, args Arguments) (json.RawMessage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(map[string]string{"query": query.Query})
+}
+
+// ExplainQuery describes a query to explain against a Datasource, without
+// saving it
+type ExplainQuery struct {
+	Query  string     `json:"query"`
+	Params Parameters `json:"params"`
+}
@@ -0,0 +1,104 @@
+package querycache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+func (c *Config) datasourceExplain(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	var explainQuery ExplainQuery
+	if err := utils.ParseJSONBody(r.Body, &explainQuery); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	if err := explainQuery.Params.Validate(explainQuery.Query); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	datasource, err := c.DatasourceStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	query := &Query{
+		UserID:       claims.UserID,
+		DatasourceID: datasource.ID,
+		Query:        explainQuery.Query,
+		Params:       explainQuery.Params,
+	}
+
+	return c.writePlan(w, r, datasource, query)
+}
+
+func (c *Config) queryExplain(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	query, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	datasource, err := c.DatasourceStore.Get(claims.UserID, query.DatasourceID)
+	if err != nil {
+		return err
+	}
+
+	return c.writePlan(w, r, datasource, query)
+}
+
+// writePlan explains the query against the datasource, with the arguments
+// passed in the request
+func (c *Config) writePlan(w http.ResponseWriter, r *http.Request, datasource *Datasource, query *Query) error {
+	args, err := query.Params.ExplainArguments(ArgumentValues(r.URL.Query()))
+	if err != nil {
+		return bindError(err)
+	}
+
+	plan, err := c.explain(r.Context(), datasource, query, args)
+	if err != nil || plan == nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(map[string]json.RawMessage{"plan": plan})
+}
+
+// explain returns the plan of the query against the datasource, bypassing the
+// cache. Queries which the datasource fails to explain are unprocessable.
+func (c *Config) explain(requestCtx context.Context, datasource *Datasource, query *Query, args Arguments) (json.RawMessage, error) {
+	executor, err := datasource.NewExecutor(c.Connections)
+	if err != nil {
+		return nil, err
+	}
+
+	explainer, ok := executor.(Explainer)
+	if !ok {
+		return nil, &handlerutils.HandlerError{
+			Err: ErrExplainUnsupported, Status: http.StatusNotImplemented}
+	}
+
+	timeout := queryTimeout(query, datasource, c.QueryTimeout)
+	ctx, cancel := withTimeout(requestCtx, timeout)
+	defer cancel()
+
+	plan, err := explainer.Explain(ctx, query, args)
+
+	var explainErr *ExplainError
+	switch {
+	case err == ErrExplainUnsupported:
+		return nil, &handlerutils.HandlerError{
+			Err: err, Status: http.StatusNotImplemented}
+	case errors.As(err, &explainErr) && ctx.Err() == nil:
+		return nil, &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	case err != nil:
+		return nil, executionError(requestCtx, ctx, query, timeout, err)
+	}
+
+	return plan, nil
+}
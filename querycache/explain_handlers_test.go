@@ -0,0 +1,133 @@
+package querycache_test
+
+import (
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/cga1123/bissy-api/utils/expecthttp"
+)
+
+func TestDatasourceExplain(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	json, err := utils.JSONBody(map[string]interface{}{
+		"query":  "SELECT {{a}}",
+		"params": []map[string]interface{}{{"name": "a", "type": "integer", "required": true}},
+	})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/datasources/"+datasource.ID+"/explain", json)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, map[string]interface{}{"plan": map[string]string{"query": "SELECT {{a}}"}}, response.Body)
+
+	// undeclared parameters
+	json, err = utils.JSONBody(map[string]string{"query": "SELECT {{a}}"})
+	expect.Ok(t, err)
+
+	request, err = http.NewRequest("POST", "/datasources/"+datasource.ID+"/explain", json)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+
+	// other users' datasources
+	json, err = utils.JSONBody(map[string]string{"query": "SELECT 1"})
+	expect.Ok(t, err)
+
+	request, err = http.NewRequest("POST", "/datasources/"+datasource.ID+"/explain", json)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
+
+func TestQueryExplain(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	cache := querycache.NewInMemoryCache()
+	config.Cache = cache
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	config.QueryStore = querycache.NewSQLQueryStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/explain", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, map[string]interface{}{"plan": map[string]string{"query": "SELECT 1"}}, response.Body)
+
+	// the cache is untouched
+	_, ok := cache.Get(cacheKey(t, query, nil))
+	expect.False(t, ok)
+}
+
+func TestQueryCreateExplain(t *testing.T) {
+	t.Parallel()
+
+	url, ok := os.LookupEnv("DATABASE_URL")
+	if !ok {
+		t.Fatal("DATABASE_URL not set")
+	}
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	config.ExplainQueries = true
+	config.Connections = querycache.NewConnections(querycache.ConnectionOptions{})
+	config.DatasourceStore = querycache.NewSQLDatasourceStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+
+	claims := testClaims()
+	readOnly := false
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{
+		Type: "postgres", Name: "Test", Options: url, ReadOnly: &readOnly})
+	expect.Ok(t, err)
+	defer config.Connections.Close(datasource.ID)
+
+	for statement, status := range map[string]int{
+		"SELEC 1":                          http.StatusUnprocessableEntity,
+		"SELECT * FROM querycache_missing": http.StatusUnprocessableEntity,
+		"SELECT 1; CREATE TABLE querycache_explained (id int)": http.StatusUnprocessableEntity,
+		"SELECT 1": http.StatusOK,
+	} {
+		json, err := utils.JSONBody(map[string]string{"query": statement, "datasourceId": datasource.ID})
+		expect.Ok(t, err)
+
+		request, err := http.NewRequest("POST", "/queries", json)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Status(t, status, response)
+	}
+
+	// statements following the explained one are never run
+	var missing bool
+	expect.Ok(t, db.QueryRow("SELECT to_regclass('querycache_explained') IS NULL").Scan(&missing))
+	expect.True(t, missing)
+}
@@ -0,0 +1,69 @@
+package querycache
+
+import (
+	"context"
+	"sync"
+)
+
+type flight struct {
+	done      chan struct{}
+	result    *Result
+	err       error
+	abandoned bool
+}
+
+// Flights coalesces concurrent executions sharing a key, so that only one of
+// them runs while the others wait for, and share, its result
+type Flights struct {
+	flights map[string]*flight
+	lock    sync.Mutex
+}
+
+// NewFlights builds a new, empty, Flights
+func NewFlights() *Flights {
+	return &Flights{flights: map[string]*flight{}}
+}
+
+// Do runs fn, unless a call for the same key is already in flight in which
+// case it waits for that call to return and shares its result.
+// Waiters give up when their ctx is done. If the running call was abandoned,
+// because its own ctx was done, waiters retry rather than share its error.
+func (f *Flights) Do(ctx context.Context, key string, fn func() (*Result, error)) (*Result, error) {
+	for {
+		f.lock.Lock()
+		current, ok := f.flights[key]
+		if !ok {
+			current = &flight{done: make(chan struct{})}
+			f.flights[key] = current
+			f.lock.Unlock()
+
+			return f.run(ctx, key, current, fn)
+		}
+		f.lock.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-current.done:
+		}
+
+		if !current.abandoned {
+			return current.result, current.err
+		}
+	}
+}
+
+func (f *Flights) run(ctx context.Context, key string, current *flight, fn func() (*Result, error)) (*Result, error) {
+	defer func() {
+		f.lock.Lock()
+		delete(f.flights, key)
+		f.lock.Unlock()
+
+		close(current.done)
+	}()
+
+	current.result, current.err = fn()
+	current.abandoned = ctx.Err() != nil
+
+	return current.result, current.err
+}
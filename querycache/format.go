@@ -0,0 +1,469 @@
+package querycache
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+// RowWriter receives the columns of a Result followed by each of its rows
+type RowWriter interface {
+	WriteColumns([]Column) error
+	WriteRow([]interface{}) error
+	Close() error
+}
+
+// TruncatedWriter may be implemented by a RowWriter to be told that the
+// Result it receives was truncated. WriteTruncated is called before
+// WriteColumns when this is known upfront, and otherwise before Close.
+type TruncatedWriter interface {
+	WriteTruncated()
+}
+
+func writeTruncated(w RowWriter) {
+	if truncatedWriter, ok := w.(TruncatedWriter); ok {
+		truncatedWriter.WriteTruncated()
+	}
+}
+
+// FormatOptions holds the dialect options for text formats, Null is the
+// string NULLs are rendered as
+type FormatOptions struct {
+	Delimiter rune
+	Header    bool
+	BOM       bool
+	Null      string
+}
+
+// DefaultFormatOptions returns the FormatOptions used when none are requested
+func DefaultFormatOptions() *FormatOptions {
+	return &FormatOptions{Delimiter: ',', Header: true}
+}
+
+// Format describes an output format for query results
+type Format struct {
+	Name        string
+	ContentType string
+	MediaTypes  []string
+	New         func(io.Writer, *FormatOptions) RowWriter
+}
+
+// Formats lists the supported result formats, the first is the default
+var Formats = []*Format{
+	{
+		Name:        "csv",
+		ContentType: handlerutils.ContentTypeCSV,
+		MediaTypes:  []string{"text/csv", "text/*"},
+		New:         newDelimitedWriter,
+	},
+	{
+		Name:        "tsv",
+		ContentType: handlerutils.ContentTypeTSV,
+		MediaTypes:  []string{"text/tab-separated-values"},
+		New: func(w io.Writer, options *FormatOptions) RowWriter {
+			tsv := *options
+			tsv.Delimiter = '\t'
+
+			return newDelimitedWriter(w, &tsv)
+		},
+	},
+	{
+		Name:        "json",
+		ContentType: handlerutils.ContentTypeJSON,
+		MediaTypes:  []string{"application/json", "application/*"},
+		New: func(w io.Writer, _ *FormatOptions) RowWriter {
+			return &jsonWriter{w: w}
+		},
+	},
+	{
+		Name:        "json-rows",
+		ContentType: handlerutils.ContentTypeJSON,
+		MediaTypes:  []string{"application/vnd.querycache.rows+json"},
+		New: func(w io.Writer, _ *FormatOptions) RowWriter {
+			return &jsonRowsWriter{w: w}
+		},
+	},
+	{
+		Name:        "ndjson",
+		ContentType: handlerutils.ContentTypeNDJSON,
+		MediaTypes:  []string{"application/x-ndjson"},
+		New: func(w io.Writer, _ *FormatOptions) RowWriter {
+			return &ndjsonWriter{w: w}
+		},
+	},
+	{
+		Name:        "html",
+		ContentType: handlerutils.ContentTypeHTML,
+		MediaTypes:  []string{"text/html"},
+		New: func(w io.Writer, options *FormatOptions) RowWriter {
+			return &htmlWriter{w: w, null: options.Null}
+		},
+	},
+}
+
+// FormatByName returns the Format with the given name
+func FormatByName(name string) (*Format, bool) {
+	for _, format := range Formats {
+		if format.Name == name {
+			return format, true
+		}
+	}
+
+	return nil, false
+}
+
+type acceptedType struct {
+	mediaType string
+	quality   float64
+}
+
+// NegotiateFormat picks the preferred Format given the value of an Accept
+// header. It returns false if none of the accepted types are supported.
+func NegotiateFormat(accept string) (*Format, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return Formats[0], true
+	}
+
+	accepted := []acceptedType{}
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+
+		for _, field := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if q, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					quality = q
+				}
+			}
+		}
+
+		if quality > 0 {
+			accepted = append(accepted, acceptedType{mediaType: mediaType, quality: quality})
+		}
+	}
+
+	sort.SliceStable(accepted, func(i, j int) bool {
+		return accepted[i].quality > accepted[j].quality
+	})
+
+	for _, a := range accepted {
+		if a.mediaType == "*/*" {
+			return Formats[0], true
+		}
+
+		for _, format := range Formats {
+			for _, mediaType := range format.MediaTypes {
+				if mediaType == a.mediaType {
+					return format, true
+				}
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// ParseFormatOptions builds FormatOptions from the delimiter, header, bom and
+// null query parameters
+func ParseFormatOptions(values map[string][]string) (*FormatOptions, error) {
+	options := DefaultFormatOptions()
+	params := func(key string) (string, bool) {
+		v, ok := values[key]
+		if !ok || len(v) == 0 {
+			return "", false
+		}
+
+		return v[0], true
+	}
+
+	if delimiter, ok := params("delimiter"); ok {
+		if utf8.RuneCountInString(delimiter) != 1 {
+			return nil, fmt.Errorf("delimiter must be a single character")
+		}
+
+		options.Delimiter, _ = utf8.DecodeRuneInString(delimiter)
+	}
+
+	if header, ok := params("header"); ok {
+		value, err := strconv.ParseBool(header)
+		if err != nil {
+			return nil, fmt.Errorf("header must be a boolean")
+		}
+
+		options.Header = value
+	}
+
+	if bom, ok := params("bom"); ok {
+		value, err := strconv.ParseBool(bom)
+		if err != nil {
+			return nil, fmt.Errorf("bom must be a boolean")
+		}
+
+		options.BOM = value
+	}
+
+	if null, ok := params("null"); ok {
+		options.Null = null
+	}
+
+	return options, nil
+}
+
+type delimitedWriter struct {
+	w       io.Writer
+	csv     *csv.Writer
+	options *FormatOptions
+}
+
+func newDelimitedWriter(w io.Writer, options *FormatOptions) RowWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = options.Delimiter
+
+	return &delimitedWriter{w: w, csv: writer, options: options}
+}
+
+func columnNames(columns []Column) []string {
+	names := make([]string, len(columns))
+	for i, column := range columns {
+		names[i] = column.Name
+	}
+
+	return names
+}
+
+func rowStrings(row []interface{}, null string) []string {
+	values := make([]string, len(row))
+	for i, value := range row {
+		values[i] = valueString(value, null)
+	}
+
+	return values
+}
+
+func (d *delimitedWriter) WriteColumns(columns []Column) error {
+	if d.options.BOM {
+		if _, err := io.WriteString(d.w, "\ufeff"); err != nil {
+			return err
+		}
+	}
+
+	if !d.options.Header {
+		return nil
+	}
+
+	return d.csv.Write(columnNames(columns))
+}
+
+func (d *delimitedWriter) WriteRow(row []interface{}) error {
+	return d.csv.Write(rowStrings(row, d.options.Null))
+}
+
+func (d *delimitedWriter) Close() error {
+	d.csv.Flush()
+
+	return d.csv.Error()
+}
+
+// writeObject writes the given row as a JSON object, keyed by columns and
+// preserving their order
+func writeObject(w io.Writer, columns []Column, row []interface{}) error {
+	buffer := bytes.Buffer{}
+	buffer.WriteByte('{')
+
+	for i, column := range columns {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+
+		key, err := json.Marshal(column.Name)
+		if err != nil {
+			return err
+		}
+
+		value, err := json.Marshal(row[i])
+		if err != nil {
+			return err
+		}
+
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+
+	buffer.WriteByte('}')
+
+	_, err := w.Write(buffer.Bytes())
+
+	return err
+}
+
+type jsonWriter struct {
+	w       io.Writer
+	columns []Column
+	rows    int
+}
+
+func (j *jsonWriter) WriteColumns(columns []Column) error {
+	j.columns = columns
+
+	_, err := io.WriteString(j.w, "[")
+
+	return err
+}
+
+func (j *jsonWriter) WriteRow(row []interface{}) error {
+	if j.rows > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.rows++
+
+	return writeObject(j.w, j.columns, row)
+}
+
+func (j *jsonWriter) Close() error {
+	_, err := io.WriteString(j.w, "]\n")
+
+	return err
+}
+
+type jsonRowsWriter struct {
+	w         io.Writer
+	rows      int
+	truncated bool
+}
+
+func (j *jsonRowsWriter) WriteColumns(columns []Column) error {
+	b, err := json.Marshal(columns)
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(j.w, `{"columns":%s,"rows":[`, b)
+
+	return err
+}
+
+func (j *jsonRowsWriter) WriteRow(row []interface{}) error {
+	if j.rows > 0 {
+		if _, err := io.WriteString(j.w, ","); err != nil {
+			return err
+		}
+	}
+	j.rows++
+
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+
+	_, err = j.w.Write(b)
+
+	return err
+}
+
+func (j *jsonRowsWriter) WriteTruncated() {
+	j.truncated = true
+}
+
+func (j *jsonRowsWriter) Close() error {
+	_, err := fmt.Fprintf(j.w, `],"truncated":%v}`+"\n", j.truncated)
+
+	return err
+}
+
+// ndjsonWriter writes each row as a JSON object on its own line, followed by a
+// {"truncated":true} line if the result was truncated
+type ndjsonWriter struct {
+	w         io.Writer
+	columns   []Column
+	truncated bool
+}
+
+func (n *ndjsonWriter) WriteColumns(columns []Column) error {
+	n.columns = columns
+
+	return nil
+}
+
+func (n *ndjsonWriter) WriteRow(row []interface{}) error {
+	if err := writeObject(n.w, n.columns, row); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(n.w, "\n")
+
+	return err
+}
+
+func (n *ndjsonWriter) WriteTruncated() {
+	n.truncated = true
+}
+
+func (n *ndjsonWriter) Close() error {
+	if !n.truncated {
+		return nil
+	}
+
+	_, err := io.WriteString(n.w, `{"truncated":true}`+"\n")
+
+	return err
+}
+
+type htmlWriter struct {
+	w    io.Writer
+	null string
+}
+
+func (h *htmlWriter) writeCells(tag string, cells []string) error {
+	buffer := bytes.Buffer{}
+	buffer.WriteString("<tr>")
+
+	for _, cell := range cells {
+		buffer.WriteString("<" + tag + ">")
+		buffer.WriteString(html.EscapeString(cell))
+		buffer.WriteString("</" + tag + ">")
+	}
+
+	buffer.WriteString("</tr>\n")
+
+	_, err := h.w.Write(buffer.Bytes())
+
+	return err
+}
+
+func (h *htmlWriter) WriteColumns(columns []Column) error {
+	if _, err := io.WriteString(h.w, "<table>\n<thead>\n"); err != nil {
+		return err
+	}
+
+	if err := h.writeCells("th", columnNames(columns)); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(h.w, "</thead>\n<tbody>\n")
+
+	return err
+}
+
+func (h *htmlWriter) WriteRow(row []interface{}) error {
+	return h.writeCells("td", rowStrings(row, h.null))
+}
+
+func (h *htmlWriter) Close() error {
+	_, err := io.WriteString(h.w, "</tbody>\n</table>\n")
+
+	return err
+}
@@ -0,0 +1,137 @@
+package querycache_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func testResult() *querycache.Result {
+	return &querycache.Result{
+		Columns: []querycache.Column{{Name: "id", Type: "INT8"}, {Name: "name", Type: "TEXT"}},
+		Rows:    [][]interface{}{{int64(1), "a,b"}, {int64(2), "<c>"}, {int64(3), nil}},
+	}
+}
+
+func renderResult(t *testing.T, name string, options *querycache.FormatOptions) string {
+	t.Helper()
+
+	format, ok := querycache.FormatByName(name)
+	expect.True(t, ok)
+
+	buffer := &bytes.Buffer{}
+	expect.Ok(t, testResult().Write(format.New(buffer, options)))
+
+	return buffer.String()
+}
+
+func TestFormats(t *testing.T) {
+	t.Parallel()
+
+	options := querycache.DefaultFormatOptions()
+
+	expect.Equal(t, "id,name\n1,\"a,b\"\n2,<c>\n3,\n", renderResult(t, "csv", options))
+	expect.Equal(t, "id\tname\n1\ta,b\n2\t<c>\n3\t\n", renderResult(t, "tsv", options))
+	expect.Equal(t,
+		`[{"id":1,"name":"a,b"},{"id":2,"name":"\u003cc\u003e"},{"id":3,"name":null}]`+"\n",
+		renderResult(t, "json", options))
+	expect.Equal(t,
+		`{"columns":[{"name":"id","type":"INT8"},{"name":"name","type":"TEXT"}],`+
+			`"rows":[[1,"a,b"],[2,"\u003cc\u003e"],[3,null]],"truncated":false}`+"\n",
+		renderResult(t, "json-rows", options))
+	expect.Equal(t,
+		`{"id":1,"name":"a,b"}`+"\n"+`{"id":2,"name":"\u003cc\u003e"}`+"\n"+`{"id":3,"name":null}`+"\n",
+		renderResult(t, "ndjson", options))
+	expect.Equal(t,
+		"<table>\n<thead>\n<tr><th>id</th><th>name</th></tr>\n</thead>\n<tbody>\n"+
+			"<tr><td>1</td><td>a,b</td></tr>\n<tr><td>2</td><td>&lt;c&gt;</td></tr>\n"+
+			"<tr><td>3</td><td></td></tr>\n</tbody>\n</table>\n",
+		renderResult(t, "html", options))
+}
+
+func TestFormatCSVDialect(t *testing.T) {
+	t.Parallel()
+
+	options, err := querycache.ParseFormatOptions(map[string][]string{
+		"delimiter": {";"},
+		"header":    {"false"},
+		"bom":       {"true"},
+		"null":      {"NULL"},
+	})
+	expect.Ok(t, err)
+
+	expect.Equal(t, "\ufeff1;a,b\n2;<c>\n3;NULL\n", renderResult(t, "csv", options))
+
+	_, err = querycache.ParseFormatOptions(map[string][]string{"delimiter": {";;"}})
+	expect.Error(t, err)
+
+	_, err = querycache.ParseFormatOptions(map[string][]string{"header": {"maybe"}})
+	expect.Error(t, err)
+}
+
+func TestFormatTruncated(t *testing.T) {
+	t.Parallel()
+
+	for name, suffix := range map[string]string{
+		"json-rows": `"truncated":true}` + "\n",
+		"ndjson":    `{"id":3,"name":null}` + "\n" + `{"truncated":true}` + "\n",
+		"json":      `{"id":3,"name":null}]` + "\n",
+	} {
+		format, ok := querycache.FormatByName(name)
+		expect.True(t, ok)
+
+		result := testResult()
+		result.Truncated = true
+
+		buffer := &bytes.Buffer{}
+		expect.Ok(t, result.Write(format.New(buffer, querycache.DefaultFormatOptions())))
+		expect.True(t, strings.HasSuffix(buffer.String(), suffix))
+	}
+
+	// complete results are not marked
+	format, ok := querycache.FormatByName("ndjson")
+	expect.True(t, ok)
+
+	buffer := &bytes.Buffer{}
+	expect.Ok(t, testResult().Write(format.New(buffer, querycache.DefaultFormatOptions())))
+	expect.False(t, strings.Contains(buffer.String(), "truncated"))
+}
+
+func TestLimitsWithin(t *testing.T) {
+	t.Parallel()
+
+	expect.Equal(t, querycache.Limits{Rows: 10, Bytes: 100},
+		querycache.Limits{Rows: 10}.Within(querycache.Limits{Bytes: 100}))
+	expect.Equal(t, querycache.Limits{Rows: 5, Bytes: 100},
+		querycache.Limits{Rows: 10, Bytes: 100}.Within(querycache.Limits{Rows: 5, Bytes: 200}))
+	expect.Equal(t, querycache.Limits{}, querycache.Limits{}.Within(querycache.Limits{}))
+}
+
+func TestNegotiateFormat(t *testing.T) {
+	t.Parallel()
+
+	cases := map[string]string{
+		"":                                     "csv",
+		"*/*":                                  "csv",
+		"application/json":                     "json",
+		"text/html,application/xhtml+xml":      "html",
+		"text/csv;q=0.5, application/json":     "json",
+		"application/x-ndjson":                 "ndjson",
+		"application/vnd.querycache.rows+json": "json-rows",
+	}
+
+	for accept, expected := range cases {
+		format, ok := querycache.NegotiateFormat(accept)
+		expect.True(t, ok)
+		expect.Equal(t, expected, format.Name)
+	}
+
+	_, ok := querycache.NegotiateFormat("image/png")
+	expect.False(t, ok)
+
+	_, ok = querycache.NegotiateFormat("text/csv;q=0")
+	expect.False(t, ok)
+}
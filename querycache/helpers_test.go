@@ -3,11 +3,13 @@ package querycache_test
 import (
 	"net/http"
 	"net/http/httptest"
+	"testing"
 	"time"
 
 	"github.com/cga1123/bissy-api/auth"
 	"github.com/cga1123/bissy-api/querycache"
 	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
 	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
@@ -38,6 +40,7 @@ func testConfig(db *hnysqlx.DB) (time.Time, string, *querycache.Config) {
 	return now, id, &querycache.Config{
 		QueryStore:      newTestQueryStore(db, now, id),
 		DatasourceStore: newTestDatasourceStore(db, now, id),
+		RunStore:        querycache.NewSQLRunStore(db, &utils.UUIDGenerator{}),
 		Executor:        &querycache.TestExecutor{}}
 }
 
@@ -52,3 +55,10 @@ func testHandler(claims *auth.Claims, c *querycache.Config, r *http.Request) *ht
 
 	return recorder
 }
+
+func cacheKey(t *testing.T, query *querycache.Query, args querycache.Arguments) string {
+	key, err := querycache.CacheKey(query, args)
+	expect.Ok(t, err)
+
+	return key
+}
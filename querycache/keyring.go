@@ -0,0 +1,205 @@
+package querycache
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// redacted replaces secrets in redacted datasource options
+const redacted = "xxxxx"
+
+// sensitiveOptionRegex matches the values of secret key=value options, in
+// postgres connection strings and the query strings of URLs and DSNs alike
+var sensitiveOptionRegex = regexp.MustCompile(
+	`(?i)\b([a-z_]*(?:password|passcode|secret|token|private_?key)[a-z_]*)\s*=\s*('(?:[^'\\]|\\.)*'|[^\s&]*)`)
+
+// keyValueOptionsRegex matches key=value connection strings, which are only
+// redacted by sensitiveOptionRegex
+var keyValueOptionsRegex = regexp.MustCompile(`^\s*[A-Za-z_]+\s*=`)
+
+// hostRegex matches the host following the @ of credentials, up to the path,
+// query string or fragment: a host name and port, or a DSN's protocol(address)
+var hostRegex = regexp.MustCompile(`^(?:[A-Za-z0-9_.\-]+\([^()]*\)|[A-Za-z0-9_.\-%\[\]:]*)(?:[/?#]|$)`)
+
+// Keyring holds the AEAD keys datasource options are encrypted with, by ID.
+// Values are encrypted with the primary key, and may be decrypted with any key
+// of the Keyring so that keys can be rotated.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring builds a Keyring of AES-256-GCM keys, each of which must be 32
+// bytes long, encrypting with the primary key
+func NewKeyring(primary string, keys map[string][]byte) (*Keyring, error) {
+	if _, ok := keys[primary]; !ok {
+		return nil, fmt.Errorf("primary key %q is not in the keyring", primary)
+	}
+
+	keyring := &Keyring{primary: primary, keys: map[string]cipher.AEAD{}}
+
+	for id, key := range keys {
+		if id == "" || strings.ContainsAny(id, ":,") {
+			return nil, fmt.Errorf("invalid key id %q", id)
+		}
+
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes long, got %v", id, len(key))
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring.keys[id] = aead
+	}
+
+	return keyring, nil
+}
+
+// ParseKeyring builds a Keyring from a comma separated list of id:key pairs,
+// whose keys are base64 encoded. The first key is the primary one.
+func ParseKeyring(spec string) (*Keyring, error) {
+	keys := map[string][]byte{}
+	primary := ""
+
+	for _, pair := range strings.Split(spec, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("keys must be given as id:key pairs")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("key %q is not valid base64: %v", parts[0], err)
+		}
+
+		if primary == "" {
+			primary = parts[0]
+		}
+
+		keys[parts[0]] = key
+	}
+
+	return NewKeyring(primary, keys)
+}
+
+// Primary returns the ID of the key values are encrypted with
+func (k *Keyring) Primary() string {
+	if k == nil {
+		return ""
+	}
+
+	return k.primary
+}
+
+// Encrypt encrypts the plaintext with the primary key, authenticating it along
+// with additional data, returning the base64 encoded ciphertext and the ID of
+// the key. A nil Keyring leaves the plaintext as is, with an empty key ID.
+func (k *Keyring) Encrypt(plaintext, additional string) (string, string, error) {
+	if k == nil {
+		return plaintext, "", nil
+	}
+
+	aead := k.keys[k.primary]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(additional))
+
+	return base64.StdEncoding.EncodeToString(sealed), k.primary, nil
+}
+
+// Decrypt decrypts the ciphertext encrypted with the given key and additional
+// data. Values with an empty key ID were never encrypted and are returned as is.
+func (k *Keyring) Decrypt(keyID, ciphertext, additional string) (string, error) {
+	if keyID == "" {
+		return ciphertext, nil
+	}
+
+	var aead cipher.AEAD
+	if k != nil {
+		aead = k.keys[keyID]
+	}
+
+	if aead == nil {
+		return "", fmt.Errorf("key %q is not in the keyring", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", fmt.Errorf("ciphertext is too short")
+	}
+
+	nonce, sealed := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+
+	plaintext, err := aead.Open(nil, nonce, sealed, []byte(additional))
+	if err != nil {
+		return "", err
+	}
+
+	return string(plaintext), nil
+}
+
+// RedactOptions hides the secrets of datasource options: the password of
+// user:password@ credentials, in URLs and DSNs, and the values of options
+// such as password, token or private_key
+func RedactOptions(options string) string {
+	options = sensitiveOptionRegex.ReplaceAllString(options, "${1}="+redacted)
+
+	// key=value connection strings may name users by email
+	if keyValueOptionsRegex.MatchString(options) {
+		return options
+	}
+
+	prefix, rest := "", options
+	if i := strings.Index(options, "://"); i >= 0 {
+		prefix, rest = options[:i+3], options[i+3:]
+	}
+
+	at := credentialsEnd(rest)
+	if at < 0 {
+		return options
+	}
+
+	colon := strings.Index(rest[:at], ":")
+	if colon < 0 {
+		return options
+	}
+
+	return prefix + rest[:colon+1] + redacted + rest[at:]
+}
+
+// credentialsEnd returns the index of the @ ending the credentials of a URL or
+// DSN, or -1 if there are none. Passwords may contain any of @, /, ? or #, so
+// it is the last @ followed by a host, or failing that the last @, which may
+// hide more than the password but never less.
+func credentialsEnd(rest string) int {
+	last := strings.LastIndex(rest, "@")
+
+	for at := last; at >= 0; at = strings.LastIndex(rest[:at], "@") {
+		if hostRegex.MatchString(rest[at+1:]) {
+			return at
+		}
+	}
+
+	return last
+}
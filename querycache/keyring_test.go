@@ -0,0 +1,99 @@
+package querycache_test
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func testKey(b byte) []byte {
+	return bytes.Repeat([]byte{b}, 32)
+}
+
+func TestKeyring(t *testing.T) {
+	t.Parallel()
+
+	old, err := querycache.NewKeyring("1", map[string][]byte{"1": testKey(1)})
+	expect.Ok(t, err)
+
+	ciphertext, keyID, err := old.Encrypt("password=secret", "datasource")
+	expect.Ok(t, err)
+	expect.Equal(t, "1", keyID)
+	expect.False(t, strings.Contains(ciphertext, "secret"))
+
+	plaintext, err := old.Decrypt(keyID, ciphertext, "datasource")
+	expect.Ok(t, err)
+	expect.Equal(t, "password=secret", plaintext)
+
+	// ciphertexts are bound to their additional data
+	_, err = old.Decrypt(keyID, ciphertext, "other")
+	expect.Error(t, err)
+
+	// rotated keyrings decrypt with previous keys, and encrypt with the new one
+	rotated, err := querycache.ParseKeyring(
+		"2:" + base64.StdEncoding.EncodeToString(testKey(2)) + ", 1:" + base64.StdEncoding.EncodeToString(testKey(1)))
+	expect.Ok(t, err)
+	expect.Equal(t, "2", rotated.Primary())
+
+	plaintext, err = rotated.Decrypt(keyID, ciphertext, "datasource")
+	expect.Ok(t, err)
+	expect.Equal(t, "password=secret", plaintext)
+
+	_, keyID, err = rotated.Encrypt("password=secret", "datasource")
+	expect.Ok(t, err)
+	expect.Equal(t, "2", keyID)
+
+	_, err = old.Decrypt("2", ciphertext, "datasource")
+	expect.Error(t, err)
+
+	// values with no key were never encrypted
+	var none *querycache.Keyring
+	plaintext, err = none.Decrypt("", "password=secret", "datasource")
+	expect.Ok(t, err)
+	expect.Equal(t, "password=secret", plaintext)
+
+	for _, spec := range []string{"1", "1:not base64", "1:" + base64.StdEncoding.EncodeToString([]byte("short"))} {
+		_, err := querycache.ParseKeyring(spec)
+		expect.Error(t, err)
+	}
+}
+
+func TestRedactOptions(t *testing.T) {
+	t.Parallel()
+
+	for options, expected := range map[string]string{
+		"":                "",
+		"sslmode=disable": "sslmode=disable",
+		"host=db user=bissy password=secret sslmode=require":        "host=db user=bissy password=xxxxx sslmode=require",
+		"host=db user=me@example.com password='a b\\' c' port=5432": "host=db user=me@example.com password=xxxxx port=5432",
+		"postgres://bissy:s3cr@t@db:5432/bissy?sslmode=disable":     "postgres://bissy:xxxxx@db:5432/bissy?sslmode=disable",
+		"postgres://bissy@db/bissy?password=secret&sslmode=disable": "postgres://bissy@db/bissy?password=xxxxx&sslmode=disable",
+		"bissy:secret@tcp(db:3306)/bissy?parseTime=true":            "bissy:xxxxx@tcp(db:3306)/bissy?parseTime=true",
+		"bissy:secret@account/db/public?warehouse=wh&role=reader":   "bissy:xxxxx@account/db/public?warehouse=wh&role=reader",
+		"bissy@account/db?authenticator=jwt&privateKey=abc":         "bissy@account/db?authenticator=jwt&privateKey=xxxxx",
+
+		// passwords containing the delimiters of URLs and DSNs
+		"postgres://bob:se?cret@db/app":                   "postgres://bob:xxxxx@db/app",
+		"postgres://bob:se#cret@db/app?sslmode=disable":   "postgres://bob:xxxxx@db/app?sslmode=disable",
+		"postgres://bob:se@cr@t@db:5432/app":              "postgres://bob:xxxxx@db:5432/app",
+		"postgres://bob:se/cret@db/app":                   "postgres://bob:xxxxx@db/app",
+		"user:pa?ss@tcp(db:3306)/app":                     "user:xxxxx@tcp(db:3306)/app",
+		"user:pa#ss@tcp(db:3306)/app?parseTime=true":      "user:xxxxx@tcp(db:3306)/app?parseTime=true",
+		"user:p@ss@tcp(db:3306)/app":                      "user:xxxxx@tcp(db:3306)/app",
+		"user:p/a?s#s@w@unix(/tmp/mysql.sock)/app":        "user:xxxxx@unix(/tmp/mysql.sock)/app",
+		"bissy:a/b?c@account/db/public?warehouse=wh":      "bissy:xxxxx@account/db/public?warehouse=wh",
+		"postgres://bob@db/app?application_name=a@b":      "postgres://bob@db/app?application_name=a@b",
+		"postgres://bob:secret@db/app?application_name=a": "postgres://bob:xxxxx@db/app?application_name=a",
+	} {
+		expect.Equal(t, expected, querycache.RedactOptions(options))
+	}
+
+	b, err := json.Marshal(querycache.Datasource{Options: "postgres://bissy:secret@db/bissy"})
+	expect.Ok(t, err)
+	expect.True(t, strings.Contains(string(b), `"options":"postgres://bissy:xxxxx@db/bissy"`))
+}
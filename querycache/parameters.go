@@ -0,0 +1,315 @@
+package querycache
+
+import (
+	"crypto/sha256"
+	"database/sql/driver"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The supported Parameter types
+const (
+	ParameterString    = "string"
+	ParameterInteger   = "integer"
+	ParameterNumber    = "number"
+	ParameterBoolean   = "boolean"
+	ParameterDate      = "date"
+	ParameterTimestamp = "timestamp"
+)
+
+// ParameterPrefix is the prefix of query string keys that are bound to a
+// Query's Parameters, e.g. ?param.customer_id=42
+const ParameterPrefix = "param."
+
+var (
+	parameterNameRegex      = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	parameterReferenceRegex = regexp.MustCompile(`{{\s*([A-Za-z_][A-Za-z0-9_]*)\s*}}`)
+)
+
+// Parameter describes a named, typed bind variable which may be referenced in
+// a Query as {{name}}
+type Parameter struct {
+	Name     string      `json:"name"`
+	Type     string      `json:"type"`
+	Default  interface{} `json:"default,omitempty"`
+	Required bool        `json:"required"`
+}
+
+// Parameters is the list of Parameter declared on a Query, it is persisted as
+// JSON
+type Parameters []*Parameter
+
+// Value satisfies the driver.Valuer interface
+func (p Parameters) Value() (driver.Value, error) {
+	if p == nil {
+		return "[]", nil
+	}
+
+	b, err := json.Marshal(p)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan satisfies the sql.Scanner interface
+func (p *Parameters) Scan(src interface{}) error {
+	var b []byte
+
+	switch v := src.(type) {
+	case []byte:
+		b = v
+	case string:
+		b = []byte(v)
+	case nil:
+		*p = nil
+		return nil
+	default:
+		return fmt.Errorf("cannot scan %T into Parameters", src)
+	}
+
+	var params Parameters
+	if err := json.Unmarshal(b, &params); err != nil {
+		return err
+	}
+
+	if len(params) == 0 {
+		params = nil
+	}
+
+	*p = params
+
+	return nil
+}
+
+// Validate checks that the Parameters are well formed and that every
+// reference in the given SQL is declared
+func (p Parameters) Validate(sql string) error {
+	declared := map[string]bool{}
+
+	for _, param := range p {
+		if !parameterNameRegex.MatchString(param.Name) {
+			return fmt.Errorf("invalid parameter name %q", param.Name)
+		}
+
+		if declared[param.Name] {
+			return fmt.Errorf("parameter %q declared more than once", param.Name)
+		}
+		declared[param.Name] = true
+
+		if _, err := parseParameter(param.Type, ""); err == errUnknownParameterType {
+			return fmt.Errorf("parameter %q has unknown type %q", param.Name, param.Type)
+		}
+
+		if param.Default != nil {
+			value, err := defaultString(param.Default)
+			if err != nil {
+				return fmt.Errorf("parameter %q: %v", param.Name, err)
+			}
+
+			if _, err := parseParameter(param.Type, value); err != nil {
+				return fmt.Errorf("parameter %q has invalid default: %v", param.Name, err)
+			}
+		}
+	}
+
+	for _, match := range parameterReferenceRegex.FindAllStringSubmatch(sql, -1) {
+		if !declared[match[1]] {
+			return fmt.Errorf("query references undeclared parameter %q", match[1])
+		}
+	}
+
+	return nil
+}
+
+// Bind parses the given raw values against the Parameters, applying defaults
+// and checking required values are set
+func (p Parameters) Bind(values map[string]string) (Arguments, error) {
+	args := Arguments{}
+	declared := map[string]bool{}
+
+	for _, param := range p {
+		declared[param.Name] = true
+
+		raw, ok := values[param.Name]
+		if !ok && param.Default != nil {
+			value, err := defaultString(param.Default)
+			if err != nil {
+				return nil, fmt.Errorf("parameter %q: %v", param.Name, err)
+			}
+
+			raw, ok = value, true
+		}
+
+		if !ok {
+			if param.Required {
+				return nil, fmt.Errorf("parameter %q is required", param.Name)
+			}
+
+			args[param.Name] = nil
+			continue
+		}
+
+		value, err := parseParameter(param.Type, raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter %q: %w", param.Name, err)
+		}
+
+		args[param.Name] = value
+	}
+
+	for name := range values {
+		if !declared[name] {
+			return nil, fmt.Errorf("unknown parameter %q", name)
+		}
+	}
+
+	return args, nil
+}
+
+var errUnknownParameterType = fmt.Errorf("unknown parameter type")
+
+var errNonFiniteNumber = errors.New("numbers must be finite")
+
+func parseParameter(kind, raw string) (interface{}, error) {
+	switch kind {
+	case ParameterString:
+		return raw, nil
+	case ParameterInteger:
+		return strconv.ParseInt(raw, 10, 64)
+	case ParameterNumber:
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		// NaN and infinities can't be hashed into cache keys, as JSON has no
+		// representation of them
+		if math.IsNaN(value) || math.IsInf(value, 0) {
+			return nil, errNonFiniteNumber
+		}
+
+		return value, nil
+	case ParameterBoolean:
+		return strconv.ParseBool(raw)
+	case ParameterDate:
+		return time.Parse("2006-01-02", raw)
+	case ParameterTimestamp:
+		return time.Parse(time.RFC3339, raw)
+	default:
+		return nil, errUnknownParameterType
+	}
+}
+
+func defaultString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported default value %v", value)
+	}
+}
+
+// Arguments holds the typed values bound to a Query's Parameters for a single
+// execution
+type Arguments map[string]interface{}
+
+// Hash returns a canonical hash of the Arguments, suitable for use in cache
+// keys. It returns an empty string when there are no Arguments, and an error
+// if they can't be encoded.
+func (a Arguments) Hash() (string, error) {
+	if len(a) == 0 {
+		return "", nil
+	}
+
+	// encoding/json sorts map keys, giving us a canonical encoding
+	b, err := json.Marshal(a)
+	if err != nil {
+		return "", fmt.Errorf("failed to hash arguments: %w", err)
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// ArgumentValues extracts the raw parameter values from a set of query string
+// values, keys are expected to be prefixed with ParameterPrefix
+func ArgumentValues(values map[string][]string) map[string]string {
+	raw := map[string]string{}
+
+	for key, value := range values {
+		if !strings.HasPrefix(key, ParameterPrefix) || len(value) == 0 {
+			continue
+		}
+
+		raw[strings.TrimPrefix(key, ParameterPrefix)] = value[0]
+	}
+
+	return raw
+}
+
+// PlaceholderStyle describes how a driver expects bind variables to be written
+type PlaceholderStyle int
+
+// The supported PlaceholderStyles
+const (
+	// QuestionPlaceholders are positional ? placeholders (mysql, snowflake)
+	QuestionPlaceholders PlaceholderStyle = iota
+	// DollarPlaceholders are numbered $1, $2, ... placeholders (postgres)
+	DollarPlaceholders
+)
+
+func (style PlaceholderStyle) placeholder(n int) string {
+	if style == DollarPlaceholders {
+		return "$" + strconv.Itoa(n)
+	}
+
+	return "?"
+}
+
+// Statement rewrites the Query's parameter references into driver
+// placeholders, returning the SQL and the arguments to bind in order.
+func (query *Query) Statement(style PlaceholderStyle, args Arguments) (string, []interface{}, error) {
+	var err error
+	bound := []interface{}{}
+	positions := map[string]string{}
+
+	statement := parameterReferenceRegex.ReplaceAllStringFunc(query.Query, func(ref string) string {
+		name := parameterReferenceRegex.FindStringSubmatch(ref)[1]
+
+		value, ok := args[name]
+		if !ok {
+			err = fmt.Errorf("parameter %q not bound", name)
+			return ref
+		}
+
+		// numbered placeholders may be referenced more than once
+		if position, ok := positions[name]; ok && style == DollarPlaceholders {
+			return position
+		}
+
+		bound = append(bound, value)
+		positions[name] = style.placeholder(len(bound))
+
+		return positions[name]
+	})
+
+	if err != nil {
+		return "", nil, err
+	}
+
+	return statement, bound, nil
+}
@@ -0,0 +1,165 @@
+package querycache_test
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func testParameters() querycache.Parameters {
+	return querycache.Parameters{
+		{Name: "customer_id", Type: querycache.ParameterInteger, Required: true},
+		{Name: "since", Type: querycache.ParameterDate, Default: "2020-01-01"},
+		{Name: "country", Type: querycache.ParameterString},
+	}
+}
+
+func TestParametersValidate(t *testing.T) {
+	t.Parallel()
+
+	params := testParameters()
+	expect.Ok(t, params.Validate("SELECT * FROM t WHERE id = {{customer_id}} AND at > {{ since }}"))
+
+	// undeclared reference
+	expect.Error(t, params.Validate("SELECT {{other}}"))
+
+	// bad name
+	expect.Error(t, querycache.Parameters{{Name: "1abc", Type: querycache.ParameterString}}.Validate(""))
+
+	// unknown type
+	expect.Error(t, querycache.Parameters{{Name: "a", Type: "uuid"}}.Validate(""))
+
+	// duplicate name
+	expect.Error(t, querycache.Parameters{
+		{Name: "a", Type: querycache.ParameterString},
+		{Name: "a", Type: querycache.ParameterString},
+	}.Validate(""))
+
+	// invalid default
+	expect.Error(t, querycache.Parameters{{Name: "a", Type: querycache.ParameterInteger, Default: "x"}}.Validate(""))
+	expect.Ok(t, querycache.Parameters{{Name: "a", Type: querycache.ParameterInteger, Default: float64(42)}}.Validate(""))
+}
+
+func TestParametersBind(t *testing.T) {
+	t.Parallel()
+
+	params := testParameters()
+
+	args, err := params.Bind(map[string]string{"customer_id": "42"})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Arguments{
+		"customer_id": int64(42),
+		"since":       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"country":     nil,
+	}, args)
+
+	// missing required
+	_, err = params.Bind(map[string]string{})
+	expect.Error(t, err)
+
+	// wrong type
+	_, err = params.Bind(map[string]string{"customer_id": "abc"})
+	expect.Error(t, err)
+
+	// numbers must be finite
+	numbers := querycache.Parameters{{Name: "n", Type: querycache.ParameterNumber}}
+	for _, value := range []string{"NaN", "Inf", "-Inf", "1e400"} {
+		_, err = numbers.Bind(map[string]string{"n": value})
+		expect.Error(t, err)
+	}
+
+	args, err = numbers.Bind(map[string]string{"n": "1.5"})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Arguments{"n": 1.5}, args)
+
+	// undeclared
+	_, err = params.Bind(map[string]string{"customer_id": "42", "other": "1"})
+	expect.Error(t, err)
+}
+
+func TestParametersExplainArguments(t *testing.T) {
+	t.Parallel()
+
+	params := testParameters()
+
+	args, err := params.ExplainArguments(nil)
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Arguments{
+		"customer_id": int64(0),
+		"since":       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"country":     nil,
+	}, args)
+
+	args, err = params.ExplainArguments(map[string]string{"customer_id": "42", "country": "GB"})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Arguments{
+		"customer_id": int64(42),
+		"since":       time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		"country":     "GB",
+	}, args)
+
+	// wrong type
+	_, err = params.ExplainArguments(map[string]string{"customer_id": "abc"})
+	expect.Error(t, err)
+}
+
+func TestArgumentsHash(t *testing.T) {
+	t.Parallel()
+
+	hash := func(args querycache.Arguments) string {
+		hash, err := args.Hash()
+		expect.Ok(t, err)
+
+		return hash
+	}
+
+	expect.Equal(t, "", hash(querycache.Arguments{}))
+
+	a := querycache.Arguments{"a": int64(1), "b": "x"}
+	b := querycache.Arguments{"b": "x", "a": int64(1)}
+	c := querycache.Arguments{"a": int64(2), "b": "x"}
+
+	expect.Equal(t, hash(a), hash(b))
+	expect.NotEqual(t, hash(a), hash(c))
+
+	// values JSON can't represent can't be hashed, rather than sharing a key
+	_, err := querycache.Arguments{"a": math.NaN()}.Hash()
+	expect.Error(t, err)
+
+	_, err = querycache.CacheKey(&querycache.Query{ID: "1"}, querycache.Arguments{"a": math.Inf(1)})
+	expect.Error(t, err)
+}
+
+func TestArgumentValues(t *testing.T) {
+	t.Parallel()
+
+	values := querycache.ArgumentValues(map[string][]string{
+		"param.customer_id": {"42"},
+		"format":            {"csv"},
+	})
+
+	expect.Equal(t, map[string]string{"customer_id": "42"}, values)
+}
+
+func TestQueryStatement(t *testing.T) {
+	t.Parallel()
+
+	query := &querycache.Query{Query: "SELECT {{a}}, {{b}}, {{ a }}"}
+	args := querycache.Arguments{"a": int64(1), "b": "x"}
+
+	statement, bound, err := query.Statement(querycache.DollarPlaceholders, args)
+	expect.Ok(t, err)
+	expect.Equal(t, "SELECT $1, $2, $1", statement)
+	expect.Equal(t, []interface{}{int64(1), "x"}, bound)
+
+	statement, bound, err = query.Statement(querycache.QuestionPlaceholders, args)
+	expect.Ok(t, err)
+	expect.Equal(t, "SELECT ?, ?, ?", statement)
+	expect.Equal(t, []interface{}{int64(1), "x", int64(1)}, bound)
+
+	_, _, err = query.Statement(querycache.DollarPlaceholders, querycache.Arguments{})
+	expect.Error(t, err)
+}
@@ -1,13 +1,22 @@
 package querycache
 
 import (
+	"context"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/cga1123/bissy-api/auth"
 	"github.com/cga1123/bissy-api/utils"
 	"github.com/cga1123/bissy-api/utils/handlerutils"
+	"github.com/google/uuid"
 )
 
 func (c *Config) queriesList(claims *auth.Claims, w http.ResponseWriter, r *http.Request) error {
@@ -17,7 +26,19 @@ func (c *Config) queriesList(claims *auth.Claims, w http.ResponseWriter, r *http
 	page := params.MaybeInt("page", 1)
 	per := params.MaybeInt("per", 25)
 
-	queries, err := c.QueryStore.List(claims.UserID, page, per)
+	filter := &QueryFilter{Tags: r.URL.Query()["tag"]}
+	filter.Search, _ = params.Get("q")
+
+	if datasourceID, ok := params.Get("datasourceId"); ok {
+		if _, err := uuid.Parse(datasourceID); err != nil {
+			return &handlerutils.HandlerError{
+				Err: fmt.Errorf("invalid datasourceId %q", datasourceID), Status: http.StatusBadRequest}
+		}
+
+		filter.DatasourceID = datasourceID
+	}
+
+	queries, err := c.QueryStore.List(claims.UserID, filter, page, per)
 	if err != nil {
 		return &handlerutils.HandlerError{
 			Err: err, Status: http.StatusInternalServerError}
@@ -35,12 +56,32 @@ func (c *Config) queriesCreate(claims *auth.Claims, w http.ResponseWriter, r *ht
 			Err: err, Status: http.StatusUnprocessableEntity}
 	}
 
+	if err := createQuery.Params.Validate(createQuery.Query); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	err := c.validateStatement(r.Context(), &Query{
+		UserID:       claims.UserID,
+		DatasourceID: createQuery.DatasourceID,
+		Query:        createQuery.Query,
+		Params:       createQuery.Params,
+		Timeout:      createQuery.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+
 	query, err := c.QueryStore.Create(claims.UserID, &createQuery)
 	if err != nil {
 		return &handlerutils.HandlerError{
 			Err: err, Status: http.StatusUnprocessableEntity}
 	}
 
+	if err := c.revise(claims.UserID, query, nil); err != nil {
+		return err
+	}
+
 	return json.NewEncoder(w).Encode(query)
 }
 
@@ -59,6 +100,8 @@ func (c *Config) queryDelete(claims *auth.Claims, id string, w http.ResponseWrit
 		return err
 	}
 
+	c.evict(query.ID)
+
 	return json.NewEncoder(w).Encode(query)
 }
 
@@ -69,7 +112,32 @@ func (c *Config) queryUpdate(claims *auth.Claims, id string, w http.ResponseWrit
 			Err: err, Status: http.StatusUnprocessableEntity}
 	}
 
-	query, err := c.QueryStore.Update(claims.UserID, id, &updateQuery)
+	current, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	if updateQuery.Query != nil || updateQuery.DatasourceID != nil {
+		edited := *current
+		if updateQuery.Query != nil {
+			edited.Query = *updateQuery.Query
+		}
+
+		if updateQuery.DatasourceID != nil {
+			edited.DatasourceID = *updateQuery.DatasourceID
+		}
+
+		if err := edited.Params.Validate(edited.Query); err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusUnprocessableEntity}
+		}
+
+		if err := c.validateStatement(r.Context(), &edited); err != nil {
+			return err
+		}
+	}
+
+	query, err := c.reviseQuery(claims.UserID, current, &updateQuery, nil)
 	if err != nil {
 		return err
 	}
@@ -77,38 +145,537 @@ func (c *Config) queryUpdate(claims *auth.Claims, id string, w http.ResponseWrit
 	return json.NewEncoder(w).Encode(query)
 }
 
+// validateStatement rejects statements which are not read-only when they are
+// to run against a read-only datasource, and when ExplainQueries is set those
+// which the datasource fails to explain
+func (c *Config) validateStatement(ctx context.Context, query *Query) error {
+	datasource, err := c.DatasourceStore.Get(query.UserID, query.DatasourceID)
+	if err == sql.ErrNoRows {
+		return &handlerutils.HandlerError{
+			Err: fmt.Errorf("datasource %v does not exist", query.DatasourceID), Status: http.StatusUnprocessableEntity}
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if datasource.ReadOnly {
+		if err := CheckReadOnly(query.Query); err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusUnprocessableEntity}
+		}
+	}
+
+	if !c.ExplainQueries {
+		return nil
+	}
+
+	args, err := query.Params.ExplainArguments(nil)
+	if err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	_, err = c.explain(ctx, datasource, query, args)
+
+	// datasources which cannot explain queries are not validated
+	if handlerErr, ok := err.(*handlerutils.HandlerError); ok && handlerErr.Err == ErrExplainUnsupported {
+		return nil
+	}
+
+	return err
+}
+
+func resultFormat(r *http.Request) (*Format, error) {
+	if name := r.URL.Query().Get("format"); name != "" {
+		format, ok := FormatByName(name)
+		if !ok {
+			return nil, &handlerutils.HandlerError{
+				Err: fmt.Errorf("unknown format %q", name), Status: http.StatusBadRequest}
+		}
+
+		return format, nil
+	}
+
+	format, ok := NegotiateFormat(r.Header.Get("Accept"))
+	if !ok {
+		return nil, &handlerutils.HandlerError{
+			Err: fmt.Errorf("no acceptable format"), Status: http.StatusNotAcceptable}
+	}
+
+	return format, nil
+}
+
+// resultFormatOptions returns the requested format and its options
+func resultFormatOptions(r *http.Request) (*Format, *FormatOptions, error) {
+	format, err := resultFormat(r)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	options, err := ParseFormatOptions(r.URL.Query())
+	if err != nil {
+		return nil, nil, &handlerutils.HandlerError{
+			Err: err, Status: http.StatusBadRequest}
+	}
+
+	return format, options, nil
+}
+
 func (c *Config) queryResult(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
-	handlerutils.ContentType(w, handlerutils.ContentTypeCSV)
+	format, options, err := resultFormatOptions(r)
+	if err != nil {
+		return err
+	}
 
-	query, err := c.QueryStore.Get(claims.UserID, id)
+	view, err := ParseResultView(r.URL.Query())
+	if err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusBadRequest}
+	}
+
+	query, args, err := c.boundQuery(claims, id, r)
 	if err != nil {
 		return err
 	}
 
-	result, err := c.executeQuery(query)
+	executor, timeout, err := c.queryExecutor(query)
 	if err != nil {
 		return err
 	}
 
-	_, err = fmt.Fprintf(w, result)
+	// Cache-Control: no-cache asks for a freshly executed result
+	if cached, ok := executor.(*CachedExecutor); ok && noCache(r) {
+		executor = cached.Refreshing()
+	}
+
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
 
-	return err
+	handlerutils.ContentType(w, format.ContentType)
+	w.Header().Set("Vary", "Accept")
+
+	var writer RowWriter = newQueryResultWriter(w, r, format, options, query)
+	if view != nil {
+		writer = &viewWriter{RowWriter: writer, view: view, url: r.URL, header: w.Header()}
+	}
+
+	err = Stream(ctx, executor, query, args, writer)
+
+	return executionError(r.Context(), ctx, query, timeout, err)
 }
 
-func (c *Config) executeQuery(query *Query) (string, error) {
-	datasource, err := c.DatasourceStore.Get(query.UserID, query.DatasourceID)
+func (c *Config) queryResultSchema(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	query, args, err := c.boundQuery(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	executor, timeout, err := c.queryExecutor(query)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(r.Context(), timeout)
+	defer cancel()
+
+	result, err := executor.Execute(ctx, query, args)
+	if err != nil {
+		return executionError(r.Context(), ctx, query, timeout, err)
+	}
+
+	return json.NewEncoder(w).Encode(map[string][]Column{"columns": result.Columns})
+}
+
+// boundQuery fetches the given query and binds its parameters to the values
+// passed in the request
+func (c *Config) boundQuery(claims *auth.Claims, id string, r *http.Request) (*Query, Arguments, error) {
+	query, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	args, err := query.Params.Bind(ArgumentValues(r.URL.Query()))
+	if err != nil {
+		return nil, nil, bindError(err)
+	}
+
+	return query, args, nil
+}
+
+// bindError returns the HandlerError for values which failed to bind, values
+// which parse but can't be used are unprocessable
+func bindError(err error) error {
+	if errors.Is(err, errNonFiniteNumber) {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	return &handlerutils.HandlerError{
+		Err: err, Status: http.StatusBadRequest}
+}
+
+func (c *Config) queryRuns(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if _, err := c.QueryStore.Get(claims.UserID, id); err != nil {
+		return err
+	}
+
+	runs := []*Run{}
+
+	if c.RunStore != nil {
+		params := handlerutils.Params(r)
+		page := params.MaybeInt("page", 1)
+		per := params.MaybeInt("per", 25)
+
+		var err error
+		runs, err = c.RunStore.List(claims.UserID, id, page, per)
+		if err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusInternalServerError}
+		}
+	}
+
+	return json.NewEncoder(w).Encode(runs)
+}
+
+// truncatedHeader is set on responses whose result was truncated
+const truncatedHeader = "X-Querycache-Truncated"
+
+// cacheHeaderWriter sets the Age and Warning headers of the response when a
+// result is served from the cache, and the truncated header when it was
+// truncated. Results found to be truncated once streaming has started can
+// only be flagged through a trailer, which is declared before the columns are
+// written.
+// When query is set it also sets the HTTP caching headers of the result, and
+// answers conditional requests for cached results with 304 Not Modified. Only
+// cached results have an ETag, as the hash of results streamed while they are
+// executed is not known until after the headers are sent.
+type cacheHeaderWriter struct {
+	RowWriter
+	header    http.Header
+	truncated bool
+
+	response    http.ResponseWriter
+	request     *http.Request
+	format      *Format
+	query       *Query
+	cached      bool
+	notModified bool
+}
+
+func newQueryResultWriter(w http.ResponseWriter, r *http.Request, format *Format, options *FormatOptions, query *Query) *cacheHeaderWriter {
+	return &cacheHeaderWriter{
+		RowWriter: format.New(w, options),
+		header:    w.Header(),
+		response:  w,
+		request:   r,
+		format:    format,
+		query:     query,
+	}
+}
+
+func (c *cacheHeaderWriter) WriteCacheInfo(info CacheInfo) {
+	c.header.Set("Age", strconv.Itoa(int(info.Age.Seconds())))
+
+	if info.Stale {
+		c.header.Add("Warning", `110 - "Response is Stale"`)
+	}
+
+	if info.Failed {
+		c.header.Add("Warning", `111 - "Revalidation Failed"`)
+	}
+
+	if c.query == nil {
+		return
+	}
+
+	c.cached = true
+
+	// the same result is rendered differently by each format
+	etag := fmt.Sprintf(`"%v-%v"`, info.Hash, c.format.Name)
+
+	c.header.Set("X-Cache", "HIT")
+	c.header.Set("ETag", etag)
+	c.header.Set("Last-Modified", info.ExecutedAt.UTC().Format(http.TimeFormat))
+	c.header.Set("Cache-Control", c.cacheControl(time.Duration(c.query.Lifetime)-info.Age))
+
+	if notModified(c.request, etag, info.ExecutedAt) {
+		c.notModified = true
+		c.response.WriteHeader(http.StatusNotModified)
+	}
+}
+
+// cacheControl returns the Cache-Control header of a result which remains
+// fresh for the given duration
+func (c *cacheHeaderWriter) cacheControl(fresh time.Duration) string {
+	if c.query.Lifetime <= 0 {
+		return "no-cache"
+	}
+
+	if fresh < 0 {
+		fresh = 0
+	}
+
+	directives := []string{fmt.Sprintf("max-age=%v", int(fresh.Seconds()))}
+
+	if c.query.StaleWhileRevalidate > 0 {
+		directives = append(directives, fmt.Sprintf("stale-while-revalidate=%v",
+			int(time.Duration(c.query.StaleWhileRevalidate).Seconds())))
+	}
+
+	if c.query.StaleIfError > 0 {
+		directives = append(directives, fmt.Sprintf("stale-if-error=%v",
+			int(time.Duration(c.query.StaleIfError).Seconds())))
+	}
+
+	return strings.Join(directives, ", ")
+}
+
+// notModified determines whether the conditional request r is satisfied by a
+// result with the given etag and modification time. If-Modified-Since is only
+// considered without If-None-Match.
+func notModified(r *http.Request, etag string, modified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == "*" || candidate == etag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
 	if err != nil {
-		return "", err
+		return false
+	}
+
+	return !modified.Truncate(time.Second).After(since)
+}
+
+func (c *cacheHeaderWriter) WriteTruncated() {
+	c.truncated = true
+	c.header.Set(truncatedHeader, "true")
+
+	writeTruncated(c.RowWriter)
+}
+
+func (c *cacheHeaderWriter) WriteColumns(columns []Column) error {
+	if c.notModified {
+		return nil
+	}
+
+	if c.query != nil && !c.cached {
+		c.header.Set("X-Cache", "MISS")
+		c.header.Set("Age", "0")
+		c.header.Set("Cache-Control", c.cacheControl(time.Duration(c.query.Lifetime)))
+
+		if !c.query.LastRefresh.IsZero() {
+			c.header.Set("Last-Modified", c.query.LastRefresh.UTC().Format(http.TimeFormat))
+		}
+	}
+
+	if !c.truncated {
+		c.header.Set("Trailer", truncatedHeader)
+	}
+
+	return c.RowWriter.WriteColumns(columns)
+}
+
+func (c *cacheHeaderWriter) WriteRow(row []interface{}) error {
+	if c.notModified {
+		return nil
 	}
 
-	executor, err := datasource.NewExecutor()
+	return c.RowWriter.WriteRow(row)
+}
+
+func (c *cacheHeaderWriter) Close() error {
+	if c.notModified {
+		return nil
+	}
+
+	return c.RowWriter.Close()
+}
+
+// viewWriter buffers the result written to it, and writes the page of it
+// described by its ResultView on Close. The total number of matching rows is
+// set in the X-Total-Count header, and links to the next and previous pages in
+// the Link header.
+type viewWriter struct {
+	RowWriter
+	view   *ResultView
+	url    *url.URL
+	header http.Header
+	result Result
+}
+
+func (v *viewWriter) WriteCacheInfo(info CacheInfo) {
+	if infoWriter, ok := v.RowWriter.(CacheInfoWriter); ok {
+		infoWriter.WriteCacheInfo(info)
+	}
+}
+
+func (v *viewWriter) WriteTruncated() {
+	v.result.Truncated = true
+}
+
+// WriteColumns fails before anything is written if the view refers to columns
+// the result does not have
+func (v *viewWriter) WriteColumns(columns []Column) error {
+	if err := v.view.Validate(columns); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusBadRequest}
+	}
+
+	v.result.Columns = columns
+
+	return nil
+}
+
+func (v *viewWriter) WriteRow(row []interface{}) error {
+	v.result.Rows = append(v.result.Rows, row)
+
+	return nil
+}
+
+func (v *viewWriter) Close() error {
+	page, total, err := v.view.Apply(&v.result)
 	if err != nil {
-		return "", err
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusBadRequest}
+	}
+
+	v.header.Set("X-Total-Count", strconv.Itoa(total))
+
+	links := []string{}
+	if v.view.Limit > 0 && v.view.Offset+v.view.Limit < total {
+		links = append(links, v.pageLink(v.view.Offset+v.view.Limit, "next"))
+	}
+
+	if v.view.Offset > 0 {
+		previous := v.view.Offset - v.view.Limit
+		if v.view.Limit == 0 || previous < 0 {
+			previous = 0
+		}
+
+		links = append(links, v.pageLink(previous, "prev"))
+	}
+
+	if len(links) > 0 {
+		v.header.Set("Link", strings.Join(links, ", "))
+	}
+
+	return page.Write(v.RowWriter)
+}
+
+func (v *viewWriter) pageLink(offset int, rel string) string {
+	values := v.url.Query()
+	values.Set("offset", strconv.Itoa(offset))
+
+	return fmt.Sprintf(`<%v?%v>; rel="%v"`, v.url.Path, values.Encode(), rel)
+}
+
+// queryExecutor builds the Executor for the given query, along with the
+// timeout it should be executed with
+func (c *Config) queryExecutor(query *Query) (Executor, time.Duration, error) {
+	executor, timeout, err := c.datasourceExecutor(query, c.QueryTimeout)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	if c.Cache != nil {
-		executor = NewCachedExecutor(c.Cache, c.QueryStore, c.Clock, executor)
+		return c.cachedExecutor(executor), timeout, nil
 	}
 
-	return executor.Execute(query)
+	return executor, timeout, nil
+}
+
+// datasourceExecutor builds the uncached Executor for the datasource of the
+// given query, along with the timeout it should be executed with, falling back
+// to the given timeout
+func (c *Config) datasourceExecutor(query *Query, fallback time.Duration) (Executor, time.Duration, error) {
+	datasource, err := c.DatasourceStore.Get(query.UserID, query.DatasourceID)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	executor, err := datasource.NewExecutor(c.Connections)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return executor, queryTimeout(query, datasource, fallback), nil
+}
+
+// cachedExecutor wraps executor with the cache, coalescing executions with
+// those of every other request
+func (c *Config) cachedExecutor(executor Executor) *CachedExecutor {
+	c.flightsOnce.Do(func() { c.flights = NewFlights() })
+
+	cached := NewCachedExecutor(c.Cache, c.QueryStore, c.Clock, executor)
+	cached.MaxBytes = c.MaxCacheBytes
+	cached.Flights = c.flights
+	cached.Runs = c.RunStore
+	cached.Snapshots = c.SnapshotStore
+
+	return cached
+}
+
+func (c *Config) now() time.Time {
+	if c.Clock == nil {
+		return time.Now()
+	}
+
+	return c.Clock.Now()
+}
+
+// queryTimeout returns the timeout of the query, falling back to that of its
+// datasource and then the given default. Zero means no timeout.
+func queryTimeout(query *Query, datasource *Datasource, fallback time.Duration) time.Duration {
+	if query.Timeout > 0 {
+		return time.Duration(query.Timeout)
+	}
+
+	if datasource.Timeout > 0 {
+		return time.Duration(datasource.Timeout)
+	}
+
+	return fallback
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, timeout)
+}
+
+// executionError maps errors from executing a query within ctx, derived from
+// the request context, into the appropriate response.
+func executionError(requestCtx, ctx context.Context, query *Query, timeout time.Duration, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if requestCtx.Err() != nil {
+		log.Printf("querycache: client went away executing query %v: %v", query.ID, err)
+
+		return nil
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return &handlerutils.HandlerError{
+			Err:    fmt.Errorf("query %v timed out after %v", query.ID, timeout),
+			Status: http.StatusGatewayTimeout}
+	}
+
+	var readOnlyErr *ReadOnlyError
+	if errors.As(err, &readOnlyErr) {
+		return &handlerutils.HandlerError{Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	return err
 }
@@ -1,8 +1,10 @@
 package querycache_test
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
@@ -74,6 +76,75 @@ func TestQueryCreateBadRequest(t *testing.T) {
 	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
 }
 
+func TestQueryCreateInvalidParams(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	json, err := utils.JSONBody(map[string]interface{}{
+		"lifetime":     "1h",
+		"query":        "SELECT {{customer_id}};",
+		"datasourceID": datasource.ID,
+		"params":       []map[string]string{{"name": "other", "type": "integer"}},
+	})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/queries", json)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+}
+
+func TestQueryCreateReadOnly(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+	expect.True(t, datasource.ReadOnly)
+
+	json, err := utils.JSONBody(map[string]string{
+		"query":        "SELECT 1; DELETE FROM users",
+		"datasourceID": datasource.ID,
+	})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/queries", json)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+	expecthttp.StringBody(t, "statement 2 is not read-only: DELETE modifies data; "+
+		"read-only datasources only run SELECT, WITH, VALUES, TABLE, SHOW, DESCRIBE and EXPLAIN statements\n", response)
+
+	readOnly := false
+	_, err = config.DatasourceStore.Update(claims.UserID, datasource.ID, &querycache.UpdateDatasource{ReadOnly: &readOnly})
+	expect.Ok(t, err)
+
+	json, err = utils.JSONBody(map[string]string{
+		"query":        "SELECT 1; DELETE FROM users",
+		"datasourceID": datasource.ID,
+	})
+	expect.Ok(t, err)
+
+	request, err = http.NewRequest("POST", "/queries", json)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+}
+
 func TestQueryGet(t *testing.T) {
 	t.Parallel()
 
@@ -148,7 +219,7 @@ func TestQueryDelete(t *testing.T) {
 	expecthttp.ContentType(t, handlerutils.ContentTypeJSON, response)
 	expecthttp.JSONBody(t, query, response.Body)
 
-	queries, err := config.QueryStore.List(claims.UserID, 1, 1)
+	queries, err := config.QueryStore.List(claims.UserID, nil, 1, 1)
 	expect.Ok(t, err)
 	expect.Equal(t, []*querycache.Query{}, queries)
 }
@@ -283,6 +354,55 @@ func TestQueryList(t *testing.T) {
 	expecthttp.JSONBody(t, queries[5:10], response.Body)
 }
 
+func TestQueryListFilter(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, &utils.RealClock{}, &utils.UUIDGenerator{}),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, &utils.RealClock{}, &utils.UUIDGenerator{}),
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	queries := []*querycache.Query{}
+	for _, name := range []string{"Daily orders", "Weekly orders", "Daily signups"} {
+		query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+			Name:         name,
+			Tags:         querycache.Tags{strings.ToLower(strings.Fields(name)[0])},
+			DatasourceID: datasource.ID,
+			Query:        "SELECT 1"})
+		expect.Ok(t, err)
+
+		queries = append(queries, query)
+	}
+
+	for path, expected := range map[string][]*querycache.Query{
+		"/queries?tag=daily":                                     {queries[0], queries[2]},
+		"/queries?tag=daily&q=orders":                            {queries[0]},
+		"/queries?datasourceId=" + datasource.ID + "&tag=weekly": {queries[1]},
+		"/queries?datasourceId=" + uuid.New().String():           {},
+	} {
+		request, err := http.NewRequest("GET", path, nil)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Ok(t, response)
+		expecthttp.JSONBody(t, expected, response.Body)
+	}
+
+	request, err := http.NewRequest("GET", "/queries?datasourceId=nope", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusBadRequest, response)
+}
+
 func TestQueryResult(t *testing.T) {
 	t.Parallel()
 
@@ -311,7 +431,191 @@ func TestQueryResult(t *testing.T) {
 	response := testHandler(claims, config, request)
 	expecthttp.Ok(t, response)
 	expecthttp.ContentType(t, handlerutils.ContentTypeCSV, response)
-	expecthttp.StringBody(t, "Got: SELECT * FROM users", response)
+	expecthttp.StringBody(t, "query\nGot: SELECT * FROM users\n", response)
+}
+
+func TestQueryResultFormats(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	// ?format= takes precedence over Accept
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result?format=json", nil)
+	expect.Ok(t, err)
+	request.Header.Set("Accept", "text/csv")
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.ContentType(t, handlerutils.ContentTypeJSON, response)
+	expecthttp.StringBody(t, "[{\"query\":\"Got: SELECT 1\"}]\n", response)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/result", nil)
+	expect.Ok(t, err)
+	request.Header.Set("Accept", "text/tab-separated-values")
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.ContentType(t, handlerutils.ContentTypeTSV, response)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/result", nil)
+	expect.Ok(t, err)
+	request.Header.Set("Accept", "image/png")
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusNotAcceptable, response)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/result?format=xml", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusBadRequest, response)
+}
+
+func TestQueryResultTruncated(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	cache := querycache.NewInMemoryCache()
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		Cache:           cache,
+		Clock:           clock,
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", Lifetime: querycache.Duration(time.Hour), DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	now := time.Now()
+	query, err = config.QueryStore.Update(claims.UserID, query.ID, &querycache.UpdateQuery{LastRefresh: now})
+	expect.Ok(t, err)
+
+	entry := fmt.Sprintf(`{"columns":[{"name":"n","type":"INT8"}],"rows":[[1]],"truncated":true,"executedAt":%q,"hash":"h"}`,
+		now.Format(time.RFC3339Nano))
+	expect.Ok(t, cache.Set(cacheKey(t, query, nil), entry, 0))
+
+	// every format flags truncated results in a header, ndjson in its body too
+	for format, body := range map[string]string{
+		"json":      `[{"n":1}]` + "\n",
+		"json-rows": `{"columns":[{"name":"n","type":"INT8"}],"rows":[[1]],"truncated":true}` + "\n",
+		"ndjson":    `{"n":1}` + "\n" + `{"truncated":true}` + "\n",
+		"csv":       "n\n1\n",
+	} {
+		request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result?format="+format, nil)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Ok(t, response)
+		expect.Equal(t, "HIT", response.Header().Get("X-Cache"))
+		expect.Equal(t, "true", response.Header().Get("X-Querycache-Truncated"))
+		expecthttp.StringBody(t, body, response)
+	}
+}
+
+func TestQueryResultMissingParam(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query:        "SELECT {{id}}",
+		DatasourceID: datasource.ID,
+		Params: querycache.Parameters{
+			{Name: "id", Type: querycache.ParameterInteger, Required: true},
+			{Name: "ratio", Type: querycache.ParameterNumber}}})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusBadRequest, response)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/result?param.id=42", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	// numbers which aren't finite are unprocessable
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/result?param.id=42&param.ratio=NaN", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+}
+
+func TestQueryResultSchema(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result/schema", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.ContentType(t, handlerutils.ContentTypeJSON, response)
+	expecthttp.JSONBody(t, map[string][]querycache.Column{
+		"columns": {{Name: "query", Type: "TEXT"}},
+	}, response.Body)
 }
 
 func TestQueryResultPostgres(t *testing.T) {
@@ -344,3 +648,264 @@ func TestQueryResultPostgres(t *testing.T) {
 	expecthttp.ContentType(t, handlerutils.ContentTypeCSV, response)
 	expecthttp.StringBody(t, "?column?\n1\n", response)
 }
+
+func TestQueryResultView(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{
+		Type: "postgres", Name: "PG Test", Options: os.Getenv("DATABASE_URL")})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT n, n % 2 = 0 even FROM generate_series(1, 10) n", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	path := "/queries/" + query.ID + "/result"
+	request, err := http.NewRequest("GET", path+"?columns=n&filter[even]=true&filter[n][gt]=2&sort=-n&limit=2&offset=1", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.StringBody(t, "n\n8\n6\n", response)
+	expect.Equal(t, "4", response.Header().Get("X-Total-Count"))
+	expect.Equal(t,
+		`<`+path+`?columns=n&filter%5Beven%5D=true&filter%5Bn%5D%5Bgt%5D=2&limit=2&offset=3&sort=-n>; rel="next", `+
+			`<`+path+`?columns=n&filter%5Beven%5D=true&filter%5Bn%5D%5Bgt%5D=2&limit=2&offset=0&sort=-n>; rel="prev"`,
+		response.Header().Get("Link"))
+
+	request, err = http.NewRequest("GET", path+"?sort=missing", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusBadRequest, response)
+
+	// an unknown column only fails its own request, the executed result is
+	// still cached
+	config.Cache = querycache.NewInMemoryCache()
+	config.Clock = clock
+
+	request, err = http.NewRequest("GET", path+"?filter[missing]=1", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusBadRequest, response)
+
+	request, err = http.NewRequest("GET", path+"?limit=1", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.StringBody(t, "n,even\n1,false\n", response)
+	expect.Equal(t, "HIT", response.Header().Get("X-Cache"))
+}
+
+func TestQueryResultConditional(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		Cache:           querycache.NewInMemoryCache(),
+		Clock:           clock,
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query:                "SELECT 1",
+		Lifetime:             querycache.Duration(time.Hour),
+		StaleWhileRevalidate: querycache.Duration(10 * time.Minute),
+		DatasourceID:         datasource.ID,
+	})
+	expect.Ok(t, err)
+
+	get := func(modify func(*http.Request)) *httptest.ResponseRecorder {
+		request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result", nil)
+		expect.Ok(t, err)
+		modify(request)
+
+		return testHandler(claims, config, request)
+	}
+
+	response := get(func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expect.Equal(t, "MISS", response.Header().Get("X-Cache"))
+	expect.Equal(t, "max-age=3600, stale-while-revalidate=600", response.Header().Get("Cache-Control"))
+
+	// executed results have no ETag, and were last modified when last refreshed
+	expect.Equal(t, "", response.Header().Get("ETag"))
+	expect.Equal(t, query.LastRefresh.UTC().Format(http.TimeFormat), response.Header().Get("Last-Modified"))
+	expect.Equal(t, "X-Querycache-Truncated", response.Header().Get("Trailer"))
+
+	response = get(func(*http.Request) {})
+	expecthttp.Ok(t, response)
+	expecthttp.StringBody(t, "query\nGot: SELECT 1\n", response)
+	expect.Equal(t, "HIT", response.Header().Get("X-Cache"))
+	expect.Equal(t, "Accept", response.Header().Get("Vary"))
+
+	etag := response.Header().Get("ETag")
+	lastModified := response.Header().Get("Last-Modified")
+	expect.True(t, strings.HasSuffix(etag, `-csv"`))
+	expect.True(t, lastModified != "")
+
+	response = get(func(r *http.Request) { r.Header.Set("If-None-Match", `"other", `+etag) })
+	expecthttp.Status(t, http.StatusNotModified, response)
+	expecthttp.StringBody(t, "", response)
+	expect.Equal(t, etag, response.Header().Get("ETag"))
+
+	response = get(func(r *http.Request) { r.Header.Set("If-None-Match", `"other"`) })
+	expecthttp.Ok(t, response)
+
+	response = get(func(r *http.Request) { r.Header.Set("If-Modified-Since", lastModified) })
+	expecthttp.Status(t, http.StatusNotModified, response)
+
+	// each format has its own ETag
+	response = get(func(r *http.Request) {
+		r.Header.Set("If-None-Match", etag)
+		r.Header.Set("Accept", "application/json")
+	})
+	expecthttp.Ok(t, response)
+	expect.True(t, response.Header().Get("ETag") != etag)
+}
+
+func TestQuerySnapshots(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+	config.SnapshotStore = querycache.NewSQLSnapshotStore(db, &utils.UUIDGenerator{})
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", DatasourceID: datasource.ID, SnapshotCount: 5, SnapshotKey: "id"})
+	expect.Ok(t, err)
+
+	before, err := config.SnapshotStore.Create(&querycache.CreateSnapshot{
+		UserID: claims.UserID, QueryID: query.ID, Result: testResult(), CreatedAt: time.Now()})
+	expect.Ok(t, err)
+
+	result := testResult()
+	result.Rows = [][]interface{}{{int64(1), "a,b"}, {int64(2), "c"}}
+	after, err := config.SnapshotStore.Create(&querycache.CreateSnapshot{
+		UserID: claims.UserID, QueryID: query.ID, Result: result, CreatedAt: time.Now()})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/snapshots", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	var snapshots []*querycache.Snapshot
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&snapshots))
+	expect.Equal(t, 2, len(snapshots))
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/snapshots/"+before.ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	request, err = http.NewRequest("GET",
+		"/queries/"+query.ID+"/snapshots/"+before.ID+"/diff/"+after.ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, map[string]interface{}{
+		"key":     "id",
+		"added":   []interface{}{},
+		"removed": []interface{}{map[string]interface{}{"id": 3.0, "name": nil}},
+		"changed": []interface{}{map[string]interface{}{
+			"key":    2.0,
+			"before": map[string]interface{}{"id": 2.0, "name": "<c>"},
+			"after":  map[string]interface{}{"id": 2.0, "name": "c"},
+		}},
+	}, response.Body)
+
+	// snapshots are scoped to their query
+	request, err = http.NewRequest("GET", "/queries/"+uuid.New().String()+"/snapshots/"+before.ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
+
+func TestQueryRuns(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		RunStore:        querycache.NewSQLRunStore(db, generator),
+		Cache:           querycache.NewInMemoryCache(),
+		Clock:           clock,
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", Lifetime: querycache.Duration(time.Hour), DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	for i := 0; i < 2; i++ {
+		request, err := http.NewRequest("GET", "/queries/"+query.ID+"/result", nil)
+		expect.Ok(t, err)
+		expecthttp.Ok(t, testHandler(claims, config, request))
+	}
+
+	request, err := http.NewRequest("GET", "/queries/"+query.ID+"/runs?per=1", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	var runs []*querycache.Run
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&runs))
+	expect.Equal(t, 1, len(runs))
+	expect.Equal(t, query.ID, runs[0].QueryID)
+	expect.Equal(t, datasource.ID, runs[0].DatasourceID)
+	expect.Equal(t, querycache.TriggerRequest, runs[0].Trigger)
+	expect.Equal(t, 1, runs[0].RowCount)
+	expect.True(t, runs[0].CacheHit)
+	expect.True(t, runs[0].Error == nil)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/runs", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
@@ -8,6 +8,11 @@ import (
 	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
 )
 
+// getter is implemented by both *hnysqlx.DB and *hnysqlx.Tx
+type getter interface {
+	Get(dest interface{}, query string, args ...interface{}) error
+}
+
 // SQLQueryStore defines an SQL implementation of a QueryStore
 type SQLQueryStore struct {
 	db          *hnysqlx.DB
@@ -39,12 +44,12 @@ func (s *SQLQueryStore) Create(userID string, ca *CreateQuery) (*Query, error) {
 	id := s.idGenerator.Generate()
 
 	queryStr := `
-		INSERT INTO querycache_queries (id, user_id, query, lifetime, datasource_id, created_at, updated_at, last_refresh)
-		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		INSERT INTO querycache_queries (id, user_id, query, lifetime, timeout, auto_refresh, stale_while_revalidate, stale_if_error, max_rows, max_bytes, snapshot_count, snapshot_retention, snapshot_key, datasource_id, params, created_at, updated_at, last_refresh, name, description, tags)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20, $21)
 		RETURNING *`
 
 	var query Query
-	if err := s.db.Get(&query, queryStr, id, userID, ca.Query, ca.Lifetime, ca.DatasourceID, now, now, now); err != nil {
+	if err := s.db.Get(&query, queryStr, id, userID, ca.Query, ca.Lifetime, ca.Timeout, ca.AutoRefresh, ca.StaleWhileRevalidate, ca.StaleIfError, ca.MaxRows, ca.MaxBytes, ca.SnapshotCount, ca.SnapshotRetention, ca.SnapshotKey, ca.DatasourceID, ca.Params, now, now, now, ca.Name, ca.Description, ca.Tags.Normalize()); err != nil {
 		return nil, err
 	}
 
@@ -66,13 +71,73 @@ func (s *SQLQueryStore) Delete(userID, id string) (*Query, error) {
 
 // Update updates the Query with associated id from the store
 func (s *SQLQueryStore) Update(userID, id string, uq *UpdateQuery) (*Query, error) {
+	return s.update(s.db, userID, id, uq)
+}
+
+// Revise updates the Query as Update does, recording a Revision edited by
+// userID within the same transaction when its SQL or datasource change, or
+// when restoredFrom is set
+func (s *SQLQueryStore) Revise(userID, id string, uq *UpdateQuery, restoredFrom *string) (*Query, error) {
+	tx, err := s.db.Beginx()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var current Query
+	queryStr := "SELECT * FROM querycache_queries WHERE id = $1 AND user_id = $2 FOR UPDATE"
+	if err := tx.Get(&current, queryStr, id, userID); err != nil {
+		return nil, err
+	}
+
+	query, err := s.update(tx, userID, id, uq)
+	if err != nil {
+		return nil, err
+	}
+
+	if restoredFrom != nil || query.Query != current.Query || query.DatasourceID != current.DatasourceID {
+		_, err := createRevision(tx, s.idGenerator.Generate(), &CreateRevision{
+			UserID:       userID,
+			QueryID:      query.ID,
+			Query:        query.Query,
+			DatasourceID: query.DatasourceID,
+			RestoredFrom: restoredFrom,
+			CreatedAt:    query.UpdatedAt,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return query, nil
+}
+
+func (s *SQLQueryStore) update(db getter, userID, id string, uq *UpdateQuery) (*Query, error) {
 	var query Query
 
 	queryStr := `
 		UPDATE querycache_queries
 		SET lifetime = COALESCE($3, lifetime),
 				last_refresh = COALESCE($4, last_refresh),
-				updated_at = $5
+				updated_at = $5,
+				timeout = COALESCE($6, timeout),
+				auto_refresh = COALESCE($7, auto_refresh),
+				stale_while_revalidate = COALESCE($8, stale_while_revalidate),
+				stale_if_error = COALESCE($9, stale_if_error),
+				max_rows = COALESCE($10, max_rows),
+				max_bytes = COALESCE($11, max_bytes),
+				snapshot_count = COALESCE($12, snapshot_count),
+				snapshot_retention = COALESCE($13, snapshot_retention),
+				snapshot_key = COALESCE($14, snapshot_key),
+				name = COALESCE($15, name),
+				description = COALESCE($16, description),
+				tags = COALESCE($17, tags),
+				query = COALESCE($18, query),
+				datasource_id = COALESCE($19, datasource_id)
 		WHERE 1=1
 		AND id = $1
 		AND user_id = $2
@@ -85,7 +150,15 @@ func (s *SQLQueryStore) Update(userID, id string, uq *UpdateQuery) (*Query, erro
 		lastRefresh = sql.NullTime{Time: uq.LastRefresh, Valid: true}
 	}
 
-	err := s.db.Get(&query, queryStr, id, userID, uq.Lifetime, lastRefresh, s.clock.Now())
+	// nil Tags are left unchanged, rather than emptied
+	var tags interface{}
+	if uq.Tags != nil {
+		tags = uq.Tags.Normalize()
+	}
+
+	err := db.Get(&query, queryStr, id, userID, uq.Lifetime, lastRefresh, s.clock.Now(),
+		uq.Timeout, uq.AutoRefresh, uq.StaleWhileRevalidate, uq.StaleIfError, uq.MaxRows, uq.MaxBytes,
+		uq.SnapshotCount, uq.SnapshotRetention, uq.SnapshotKey, uq.Name, uq.Description, tags, uq.Query, uq.DatasourceID)
 	if err != nil {
 		return nil, err
 	}
@@ -93,24 +166,59 @@ func (s *SQLQueryStore) Update(userID, id string, uq *UpdateQuery) (*Query, erro
 	return &query, nil
 }
 
-// List returns the requests Queries from the Store, ordered by createdAt
-func (s *SQLQueryStore) List(userID string, page, per int) ([]*Query, error) {
+// querySearchDocument is the text Queries are searched by, it must match the
+// expression of the querycache_queries_search_idx index for it to be used
+const querySearchDocument = "to_tsvector('english', name || ' ' || description || ' ' || query)"
+
+// List returns the requests Queries from the Store matching the filter,
+// ordered by createdAt
+func (s *SQLQueryStore) List(userID string, filter *QueryFilter, page, per int) ([]*Query, error) {
 	if page < 1 || per < 1 {
 		return nil,
 			fmt.Errorf("page and per must be greater than 0 (page %v) (per %v)",
 				page, per)
 	}
 
+	if filter == nil {
+		filter = &QueryFilter{}
+	}
+
+	var datasourceID sql.NullString
+	if filter.DatasourceID != "" {
+		datasourceID = sql.NullString{String: filter.DatasourceID, Valid: true}
+	}
+
 	queries := []*Query{}
 
 	queryStr := `
 		SELECT *
 		FROM querycache_queries
 		WHERE user_id = $1
+		AND ($2::uuid IS NULL OR datasource_id = $2)
+		AND tags @> $3
+		AND ($4 = '' OR ` + querySearchDocument + ` @@ plainto_tsquery('english', $4))
 		ORDER BY created_at
-		OFFSET $2
-		LIMIT $3`
-	if err := s.db.Select(&queries, queryStr, userID, (page-1)*per, per); err != nil {
+		OFFSET $5
+		LIMIT $6`
+	err := s.db.Select(&queries, queryStr, userID, datasourceID, filter.Tags.Normalize(), filter.Search, (page-1)*per, per)
+	if err != nil {
+		return nil, err
+	}
+
+	return queries, nil
+}
+
+// ListAutoRefresh returns all Queries, across users, that should be refreshed
+// in the background
+func (s *SQLQueryStore) ListAutoRefresh() ([]*Query, error) {
+	queries := []*Query{}
+
+	queryStr := `
+		SELECT *
+		FROM querycache_queries
+		WHERE auto_refresh
+		ORDER BY last_refresh`
+	if err := s.db.Select(&queries, queryStr); err != nil {
 		return nil, err
 	}
 
@@ -1,22 +1,42 @@
 package querycache
 
 import (
+	"database/sql/driver"
 	"encoding/json"
 	"errors"
+	"strings"
 	"time"
+
+	"github.com/lib/pq"
 )
 
 // Query describes an SQL query on a given datasource that should be cached for
-// a given Lifetime value
+// a given Lifetime value. Its Description is markdown.
+// Snapshots of its results are retained if SnapshotCount, the number of most
+// recent Snapshots kept, or SnapshotRetention, how long they are kept for, are
+// set. SnapshotKey is the column identifying rows when diffing Snapshots.
 type Query struct {
-	ID           string    `json:"id"`
-	UserID       string    `json:"userId" db:"user_id"`
-	Query        string    `json:"query"`
-	DatasourceID string    `json:"datasourceId" db:"datasource_id"`
-	Lifetime     Duration  `json:"lifetime"`
-	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
-	UpdatedAt    time.Time `json:"updatedAt" db:"updated_at"`
-	LastRefresh  time.Time `json:"lastRefresh" db:"last_refresh"`
+	ID                   string     `json:"id"`
+	UserID               string     `json:"userId" db:"user_id"`
+	Name                 string     `json:"name"`
+	Description          string     `json:"description"`
+	Tags                 Tags       `json:"tags"`
+	Query                string     `json:"query"`
+	DatasourceID         string     `json:"datasourceId" db:"datasource_id"`
+	Lifetime             Duration   `json:"lifetime"`
+	Timeout              Duration   `json:"timeout"`
+	AutoRefresh          bool       `json:"autoRefresh" db:"auto_refresh"`
+	StaleWhileRevalidate Duration   `json:"staleWhileRevalidate" db:"stale_while_revalidate"`
+	StaleIfError         Duration   `json:"staleIfError" db:"stale_if_error"`
+	MaxRows              int        `json:"maxRows" db:"max_rows"`
+	MaxBytes             int        `json:"maxBytes" db:"max_bytes"`
+	SnapshotCount        int        `json:"snapshotCount" db:"snapshot_count"`
+	SnapshotRetention    Duration   `json:"snapshotRetention" db:"snapshot_retention"`
+	SnapshotKey          string     `json:"snapshotKey" db:"snapshot_key"`
+	Params               Parameters `json:"params"`
+	CreatedAt            time.Time  `json:"createdAt" db:"created_at"`
+	UpdatedAt            time.Time  `json:"updatedAt" db:"updated_at"`
+	LastRefresh          time.Time  `json:"lastRefresh" db:"last_refresh"`
 }
 
 // Fresh determines whether a query was last refreshed within Lifetime of the
@@ -28,17 +48,104 @@ func (query *Query) Fresh(now time.Time) bool {
 	return refreshedRecently
 }
 
+// Limits returns the Limits on the size of the Query's results
+func (query *Query) Limits() Limits {
+	return Limits{Rows: query.MaxRows, Bytes: query.MaxBytes}
+}
+
 // CreateQuery describes the required parameter to create a new Query
 type CreateQuery struct {
-	Query        string   `json:"query"`
-	Lifetime     Duration `json:"lifetime"`
-	DatasourceID string   `json:"datasourceId"`
+	Name                 string     `json:"name"`
+	Description          string     `json:"description"`
+	Tags                 Tags       `json:"tags"`
+	Query                string     `json:"query"`
+	Lifetime             Duration   `json:"lifetime"`
+	Timeout              Duration   `json:"timeout"`
+	AutoRefresh          bool       `json:"autoRefresh"`
+	DatasourceID         string     `json:"datasourceId"`
+	Params               Parameters `json:"params"`
+	StaleWhileRevalidate Duration   `json:"staleWhileRevalidate"`
+	StaleIfError         Duration   `json:"staleIfError"`
+	MaxRows              int        `json:"maxRows"`
+	MaxBytes             int        `json:"maxBytes"`
+	SnapshotCount        int        `json:"snapshotCount"`
+	SnapshotRetention    Duration   `json:"snapshotRetention"`
+	SnapshotKey          string     `json:"snapshotKey"`
 }
 
 // UpdateQuery describes the paramater which may be updated on a Query
 type UpdateQuery struct {
-	Lifetime    *Duration `json:"lifetime"`
-	LastRefresh time.Time `json:"lastRefresh"`
+	Query                *string   `json:"query"`
+	DatasourceID         *string   `json:"datasourceId"`
+	Name                 *string   `json:"name"`
+	Description          *string   `json:"description"`
+	Tags                 Tags      `json:"tags"`
+	Lifetime             *Duration `json:"lifetime"`
+	Timeout              *Duration `json:"timeout"`
+	AutoRefresh          *bool     `json:"autoRefresh"`
+	LastRefresh          time.Time `json:"lastRefresh"`
+	StaleWhileRevalidate *Duration `json:"staleWhileRevalidate"`
+	StaleIfError         *Duration `json:"staleIfError"`
+	MaxRows              *int      `json:"maxRows"`
+	MaxBytes             *int      `json:"maxBytes"`
+	SnapshotCount        *int      `json:"snapshotCount"`
+	SnapshotRetention    *Duration `json:"snapshotRetention"`
+	SnapshotKey          *string   `json:"snapshotKey"`
+}
+
+// Tags label a Query, they are persisted as a Postgres array
+type Tags []string
+
+// Normalize trims the Tags, dropping empty and repeated ones
+func (t Tags) Normalize() Tags {
+	normalized := Tags{}
+	seen := map[string]bool{}
+
+	for _, tag := range t {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	return normalized
+}
+
+// Value satisfies the driver.Valuer interface
+func (t Tags) Value() (driver.Value, error) {
+	if t == nil {
+		return "{}", nil
+	}
+
+	return pq.StringArray(t).Value()
+}
+
+// Scan satisfies the sql.Scanner interface
+func (t *Tags) Scan(src interface{}) error {
+	var tags pq.StringArray
+	if err := tags.Scan(src); err != nil {
+		return err
+	}
+
+	// no tags are scanned as nil, the zero value
+	*t = nil
+	if len(tags) > 0 {
+		*t = Tags(tags).Normalize()
+	}
+
+	return nil
+}
+
+// MarshalJSON marshals Tags into JSON, as an empty list when nil
+func (t Tags) MarshalJSON() ([]byte, error) {
+	if t == nil {
+		return []byte("[]"), nil
+	}
+
+	return json.Marshal([]string(t))
 }
 
 // Duration is an alias to time.Duration to allow for defining JSON marshalling
@@ -72,11 +179,26 @@ func (d *Duration) UnmarshalJSON(b []byte) error {
 	}
 }
 
-// QueryStore describes a generic Store for Queries
+// QueryFilter narrows listed Queries to those against DatasourceID, labelled
+// with all of Tags and whose name, description or SQL match the full-text
+// Search, for each that is set
+type QueryFilter struct {
+	DatasourceID string
+	Tags         Tags
+	Search       string
+}
+
+// QueryStore describes a generic Store for Queries, a nil QueryFilter lists
+// every Query.
+// Revise updates a Query as Update does, recording a Revision of it as part of
+// the same update when its SQL or datasource change, or when it is restored
+// from the Revision given.
 type QueryStore interface {
 	Get(string, string) (*Query, error)
 	Create(string, *CreateQuery) (*Query, error)
-	List(string, int, int) ([]*Query, error)
+	List(string, *QueryFilter, int, int) ([]*Query, error)
 	Delete(string, string) (*Query, error)
 	Update(string, string, *UpdateQuery) (*Query, error)
+	Revise(string, string, *UpdateQuery, *string) (*Query, error)
+	ListAutoRefresh() ([]*Query, error)
 }
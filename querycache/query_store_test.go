@@ -2,7 +2,9 @@ package querycache_test
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -130,38 +132,86 @@ func testQueryList(t *testing.T, datasourceStore querycache.DatasourceStore, sto
 		expectedQueries = append(expectedQueries, query)
 	}
 
-	_, err = store.List(userID, 0, 1)
+	_, err = store.List(userID, nil, 0, 1)
 	expect.Error(t, err)
 
-	_, err = store.List(userID, 1, 0)
+	_, err = store.List(userID, nil, 1, 0)
 	expect.Error(t, err)
 
 	// with another user
-	queries, err := store.List(uuid.New().String(), 1, 10)
+	queries, err := store.List(uuid.New().String(), nil, 1, 10)
 	expect.Ok(t, err)
 	expect.Equal(t, []*querycache.Query{}, queries)
 
-	queries, err = store.List(userID, 1, 10)
+	queries, err = store.List(userID, nil, 1, 10)
 	expect.Ok(t, err)
 	expect.Equal(t, expectedQueries, queries)
 
-	queries, err = store.List(userID, 2, 3)
+	queries, err = store.List(userID, nil, 2, 3)
 	expect.Ok(t, err)
 	expect.Equal(t, expectedQueries[3:6], queries)
 
-	queries, err = store.List(userID, 4, 3)
+	queries, err = store.List(userID, nil, 4, 3)
 	expect.Ok(t, err)
 	expect.Equal(t, expectedQueries[9:10], queries)
 
-	queries, err = store.List(userID, 10, 3)
+	queries, err = store.List(userID, nil, 10, 3)
 	expect.Ok(t, err)
 	expect.Equal(t, []*querycache.Query{}, queries)
 
-	queries, err = store.List(userID, 1, 30)
+	queries, err = store.List(userID, nil, 1, 30)
 	expect.Ok(t, err)
 	expect.Equal(t, expectedQueries, queries)
 }
 
+func testQueryListFilter(t *testing.T, datasourceStore querycache.DatasourceStore, store querycache.QueryStore) {
+	userID := uuid.New().String()
+	datasource, err := datasourceStore.Create(userID, &querycache.CreateDatasource{})
+	expect.Ok(t, err)
+
+	other, err := datasourceStore.Create(userID, &querycache.CreateDatasource{})
+	expect.Ok(t, err)
+
+	revenue, err := store.Create(userID, &querycache.CreateQuery{
+		Name:         "Monthly revenue",
+		Description:  "Revenue per **month**, for the finance team",
+		Tags:         querycache.Tags{"finance", " reporting ", "finance", ""},
+		Query:        "SELECT month, sum(amount) FROM payments GROUP BY month",
+		DatasourceID: datasource.ID,
+	})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Tags{"finance", "reporting"}, revenue.Tags)
+
+	signups, err := store.Create(userID, &querycache.CreateQuery{
+		Name:         "Signups",
+		Tags:         querycache.Tags{"growth", "reporting"},
+		Query:        "SELECT count(*) FROM users",
+		DatasourceID: other.ID,
+	})
+	expect.Ok(t, err)
+
+	for _, tc := range []struct {
+		filter   *querycache.QueryFilter
+		expected []*querycache.Query
+	}{
+		{&querycache.QueryFilter{}, []*querycache.Query{revenue, signups}},
+		{&querycache.QueryFilter{DatasourceID: other.ID}, []*querycache.Query{signups}},
+		{&querycache.QueryFilter{Tags: querycache.Tags{"reporting"}}, []*querycache.Query{revenue, signups}},
+		{&querycache.QueryFilter{Tags: querycache.Tags{"reporting", "finance"}}, []*querycache.Query{revenue}},
+		{&querycache.QueryFilter{Tags: querycache.Tags{"reporting"}, DatasourceID: datasource.ID}, []*querycache.Query{revenue}},
+		{&querycache.QueryFilter{Tags: querycache.Tags{"marketing"}}, []*querycache.Query{}},
+		// name, description and SQL are searched, stemmed
+		{&querycache.QueryFilter{Search: "revenues"}, []*querycache.Query{revenue}},
+		{&querycache.QueryFilter{Search: "finance team"}, []*querycache.Query{revenue}},
+		{&querycache.QueryFilter{Search: "users"}, []*querycache.Query{signups}},
+		{&querycache.QueryFilter{Search: "users", Tags: querycache.Tags{"finance"}}, []*querycache.Query{}},
+	} {
+		queries, err := store.List(userID, tc.filter, 1, 10)
+		expect.Ok(t, err)
+		expect.Equal(t, tc.expected, queries)
+	}
+}
+
 func testQueryDelete(t *testing.T, datasourceStore querycache.DatasourceStore, store querycache.QueryStore, id string, now time.Time) {
 	userID := uuid.New().String()
 	datasource, err := datasourceStore.Create(userID, &querycache.CreateDatasource{})
@@ -199,7 +249,7 @@ func testQueryDelete(t *testing.T, datasourceStore querycache.DatasourceStore, s
 	expect.Ok(t, err)
 	expect.Equal(t, expected, *query)
 
-	queries, err := store.List(userID, 1, 1)
+	queries, err := store.List(userID, nil, 1, 1)
 	expect.Ok(t, err)
 
 	expect.Equal(t, []*querycache.Query{}, queries)
@@ -262,6 +312,24 @@ func testQueryUpdate(t *testing.T, datasourceStore querycache.DatasourceStore, s
 	expect.Equal(t, newLifetime, query.Lifetime)
 	expect.Equal(t, now.Add(time.Hour), query.LastRefresh)
 
+	// Updating name, description and tags
+	name, description := "Ones", "Always _one_"
+	query, err = store.Update(userID, id, &querycache.UpdateQuery{
+		Name: &name, Description: &description, Tags: querycache.Tags{"a", "b"}})
+	expect.Ok(t, err)
+	expect.Equal(t, name, query.Name)
+	expect.Equal(t, description, query.Description)
+	expect.Equal(t, querycache.Tags{"a", "b"}, query.Tags)
+
+	// tags are kept unless set, and cleared when empty
+	query, err = store.Update(userID, id, &querycache.UpdateQuery{Lifetime: &newLifetime})
+	expect.Ok(t, err)
+	expect.Equal(t, querycache.Tags{"a", "b"}, query.Tags)
+
+	query, err = store.Update(userID, id, &querycache.UpdateQuery{Tags: querycache.Tags{}})
+	expect.Ok(t, err)
+	expect.True(t, query.Tags == nil)
+
 	// Updating not existing query
 	_, err = store.Update(userID, uuid.New().String(), &updateQuery)
 	expect.Error(t, err)
@@ -321,6 +389,63 @@ func TestSQLQueryUpdate(t *testing.T) {
 	withTestSQLQueryStore(t, testQueryUpdate)
 }
 
+func TestSQLQueryRevise(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	store := querycache.NewSQLQueryStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+	datasourceStore := querycache.NewSQLDatasourceStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+	revisionStore := querycache.NewSQLRevisionStore(db, &utils.UUIDGenerator{})
+
+	userID := uuid.New().String()
+	datasource, err := datasourceStore.Create(userID, &querycache.CreateDatasource{})
+	expect.Ok(t, err)
+
+	query, err := store.Create(userID, &querycache.CreateQuery{Query: "SELECT 1;", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	revisions := func() []*querycache.Revision {
+		revisions, err := revisionStore.List(userID, query.ID, 1, 25)
+		expect.Ok(t, err)
+
+		return revisions
+	}
+
+	// edits which leave the SQL and datasource alone aren't revisions
+	name := "renamed"
+	updated, err := store.Revise(userID, query.ID, &querycache.UpdateQuery{Name: &name}, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, "renamed", updated.Name)
+	expect.Equal(t, 0, len(revisions()))
+
+	statement := "SELECT 2;"
+	updated, err = store.Revise(userID, query.ID, &querycache.UpdateQuery{Query: &statement}, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, "SELECT 2;", updated.Query)
+
+	edited := revisions()
+	expect.Equal(t, 1, len(edited))
+	expect.Equal(t, "SELECT 2;", edited[0].Query)
+	expect.Equal(t, updated.UpdatedAt, edited[0].CreatedAt)
+	expect.True(t, edited[0].RestoredFrom == nil)
+
+	// restoring a revision always records one
+	restoredFrom := edited[0].ID
+	_, err = store.Revise(userID, query.ID, &querycache.UpdateQuery{}, &restoredFrom)
+	expect.Ok(t, err)
+
+	restored := revisions()
+	expect.Equal(t, 2, len(restored))
+	expect.Equal(t, &restoredFrom, restored[0].RestoredFrom)
+
+	// neither is made for other users' queries
+	_, err = store.Revise(uuid.New().String(), query.ID, &querycache.UpdateQuery{Query: &statement}, nil)
+	expect.True(t, err == sql.ErrNoRows)
+	expect.Equal(t, 2, len(revisions()))
+}
+
 func TestSQLQueryList(t *testing.T) {
 	t.Parallel()
 
@@ -332,3 +457,32 @@ func TestSQLQueryList(t *testing.T) {
 
 	testQueryList(t, datasourceStore, store)
 }
+
+func TestSQLQueryListFilter(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	store := querycache.NewSQLQueryStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+	datasourceStore := querycache.NewSQLDatasourceStore(db, &utils.RealClock{}, &utils.UUIDGenerator{})
+
+	testQueryListFilter(t, datasourceStore, store)
+}
+
+func TestTags(t *testing.T) {
+	t.Parallel()
+
+	expect.Equal(t, querycache.Tags{"a", "b c"}, querycache.Tags{" a", "", "b c", "a "}.Normalize())
+
+	b, err := json.Marshal(&querycache.Query{})
+	expect.Ok(t, err)
+	expect.True(t, strings.Contains(string(b), `"tags":[]`))
+
+	var tags querycache.Tags
+	expect.Ok(t, tags.Scan(`{a,"b c"}`))
+	expect.Equal(t, querycache.Tags{"a", "b c"}, tags)
+
+	expect.Ok(t, tags.Scan(`{}`))
+	expect.True(t, tags == nil)
+}
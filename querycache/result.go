@@ -0,0 +1,352 @@
+package querycache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Column describes a column of a Result, as reported by the driver.
+// Nullable, Precision and Scale are only set where the driver reports them.
+type Column struct {
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Nullable  *bool  `json:"nullable,omitempty"`
+	Precision *int64 `json:"precision,omitempty"`
+	Scale     *int64 `json:"scale,omitempty"`
+}
+
+type columnKind int
+
+const (
+	kindString columnKind = iota
+	kindInteger
+	kindFloat
+	kindDecimal
+	kindBoolean
+	kindBinary
+	kindDate
+	kindTimestamp
+)
+
+var integerTypes = map[string]bool{
+	"INT": true, "INT2": true, "INT4": true, "INT8": true, "INTEGER": true,
+	"TINYINT": true, "SMALLINT": true, "MEDIUMINT": true, "BIGINT": true,
+	"SERIAL": true, "BIGSERIAL": true, "YEAR": true,
+}
+
+func (column Column) kind() columnKind {
+	t := column.Type
+
+	switch {
+	case t == "FIXED":
+		// snowflake reports all NUMBER columns as FIXED
+		if column.Scale != nil && *column.Scale > 0 {
+			return kindDecimal
+		}
+		return kindInteger
+	case integerTypes[strings.TrimPrefix(t, "UNSIGNED ")]:
+		return kindInteger
+	case strings.HasPrefix(t, "FLOAT") || t == "DOUBLE" || t == "REAL":
+		return kindFloat
+	case t == "NUMERIC" || t == "DECIMAL" || t == "NUMBER" || t == "MONEY":
+		return kindDecimal
+	case strings.HasPrefix(t, "BOOL"):
+		return kindBoolean
+	case t == "BYTEA" || strings.HasSuffix(t, "BINARY") || strings.HasSuffix(t, "BLOB"):
+		return kindBinary
+	case t == "DATE":
+		return kindDate
+	case strings.HasPrefix(t, "TIMESTAMP") || t == "DATETIME":
+		return kindTimestamp
+	default:
+		return kindString
+	}
+}
+
+// Result is the structured output of executing a Query, it may be rendered
+// into any of the supported Formats.
+// Row values are nil for NULLs, or one of string, int64, float64, bool or
+// json.Number (when read back from a cache).
+// Truncated is set when rows were dropped because the Result exceeded its
+// Limits.
+type Result struct {
+	Columns   []Column        `json:"columns"`
+	Rows      [][]interface{} `json:"rows"`
+	Truncated bool            `json:"truncated,omitempty"`
+}
+
+// Limits caps the size of a Result, Rows is the maximum number of rows and
+// Bytes the maximum size of its values, as counted by Result.size. Zero values
+// mean no limit.
+type Limits struct {
+	Rows  int
+	Bytes int
+}
+
+func tightest(a, b int) int {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+
+	return a
+}
+
+// Within returns the tightest of both Limits
+func (l Limits) Within(other Limits) Limits {
+	return Limits{Rows: tightest(l.Rows, other.Rows), Bytes: tightest(l.Bytes, other.Bytes)}
+}
+
+// Write passes the Result through the given RowWriter
+func (result *Result) Write(w RowWriter) error {
+	if result.Truncated {
+		writeTruncated(w)
+	}
+
+	if err := w.WriteColumns(result.Columns); err != nil {
+		return err
+	}
+
+	for _, row := range result.Rows {
+		if err := w.WriteRow(row); err != nil {
+			return err
+		}
+	}
+
+	return w.Close()
+}
+
+// cacheEntry is a Result as it is stored in the cache, along with the time it
+// was executed at and a hash of its content
+type cacheEntry struct {
+	*Result
+	ExecutedAt time.Time `json:"executedAt"`
+	Hash       string    `json:"hash"`
+}
+
+// hash returns the hex encoded SHA-256 of the JSON representation of the Result
+func (result *Result) hash() (string, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.Sum256(b)
+
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func marshalEntry(entry *cacheEntry) (string, error) {
+	hash, err := entry.Result.hash()
+	if err != nil {
+		return "", err
+	}
+
+	entry.Hash = hash
+
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+
+	return string(b), nil
+}
+
+func unmarshalEntry(value string) (*cacheEntry, error) {
+	var entry cacheEntry
+
+	// preserve integers and exact numbers
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+
+	if err := decoder.Decode(&entry); err != nil {
+		return nil, err
+	}
+
+	if entry.Result == nil {
+		entry.Result = &Result{}
+	}
+
+	// entries cached before hashes were recorded
+	if entry.Hash == "" {
+		hash, err := entry.Result.hash()
+		if err != nil {
+			return nil, err
+		}
+
+		entry.Hash = hash
+	}
+
+	return &entry, nil
+}
+
+// valueString renders a Result value as text, NULLs are rendered as null
+func valueString(value interface{}, null string) string {
+	switch v := value.(type) {
+	case nil:
+		return null
+	case string:
+		return v
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return v.String()
+	default:
+		return fmt.Sprintf("%v", v)
+	}
+}
+
+func valueSize(value interface{}) int {
+	switch v := value.(type) {
+	case string:
+		return len(v)
+	case json.Number:
+		return len(v)
+	default:
+		return 8
+	}
+}
+
+// size returns the number of rows of the Result, and its size in bytes as
+// counted by a resultRecorder
+func (result *Result) size() (int, int) {
+	bytes := 0
+	for _, column := range result.Columns {
+		bytes += len(column.Name) + len(column.Type)
+	}
+
+	for _, row := range result.Rows {
+		for _, value := range row {
+			bytes += valueSize(value)
+		}
+	}
+
+	return len(result.Rows), bytes
+}
+
+// resultRecorder is a RowWriter which records a Result, it stops recording
+// once the values written exceed maxBytes (if set)
+type resultRecorder struct {
+	result   *Result
+	maxBytes int
+	rows     int
+	bytes    int
+	overflow bool
+}
+
+func newResultRecorder(maxBytes int) *resultRecorder {
+	return &resultRecorder{result: &Result{Rows: [][]interface{}{}}, maxBytes: maxBytes}
+}
+
+func (r *resultRecorder) count(size int) {
+	r.bytes += size
+
+	if r.maxBytes > 0 && r.bytes > r.maxBytes {
+		r.overflow = true
+		r.result = nil
+	}
+}
+
+func (r *resultRecorder) WriteColumns(columns []Column) error {
+	for _, column := range columns {
+		r.count(len(column.Name) + len(column.Type))
+	}
+
+	if !r.overflow {
+		r.result.Columns = columns
+	}
+
+	return nil
+}
+
+func (r *resultRecorder) WriteRow(row []interface{}) error {
+	r.rows++
+
+	for _, value := range row {
+		r.count(valueSize(value))
+	}
+
+	if !r.overflow {
+		r.result.Rows = append(r.result.Rows, row)
+	}
+
+	return nil
+}
+
+func (r *resultRecorder) WriteTruncated() {
+	if !r.overflow {
+		r.result.Truncated = true
+	}
+}
+
+func (r *resultRecorder) Close() error {
+	return nil
+}
+
+// size returns the number of rows and bytes written, including those written
+// after it grew beyond maxBytes
+func (r *resultRecorder) size() (int, int) {
+	return r.rows, r.bytes
+}
+
+// Result returns the recorded Result, or false if it grew beyond maxBytes
+func (r *resultRecorder) Result() (*Result, bool) {
+	return r.result, !r.overflow
+}
+
+// teeWriter writes to both a RowWriter and a resultRecorder. Once writing to
+// the primary fails, its error is kept in err and the primary is no longer
+// written to, while the result is still recorded so that it can be shared
+// and cached. The write is only aborted if the result is also too large to
+// record, as then there is nothing left to write it for.
+type teeWriter struct {
+	primary  RowWriter
+	recorder *resultRecorder
+	err      error
+}
+
+// write calls write on the primary unless it has already failed, returning
+// its error only once the recorder has overflowed
+func (t *teeWriter) write(write func() error) error {
+	if t.err == nil {
+		t.err = write()
+	}
+
+	if _, ok := t.recorder.Result(); !ok {
+		return t.err
+	}
+
+	return nil
+}
+
+func (t *teeWriter) WriteColumns(columns []Column) error {
+	_ = t.recorder.WriteColumns(columns)
+
+	return t.write(func() error { return t.primary.WriteColumns(columns) })
+}
+
+func (t *teeWriter) WriteRow(row []interface{}) error {
+	_ = t.recorder.WriteRow(row)
+
+	return t.write(func() error { return t.primary.WriteRow(row) })
+}
+
+func (t *teeWriter) WriteTruncated() {
+	t.recorder.WriteTruncated()
+
+	if t.err == nil {
+		writeTruncated(t.primary)
+	}
+}
+
+func (t *teeWriter) Close() error {
+	return t.write(t.primary.Close)
+}
@@ -0,0 +1,142 @@
+package querycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+var errRevisionsDisabled = &handlerutils.HandlerError{
+	Err: fmt.Errorf("revisions are not enabled"), Status: http.StatusNotImplemented}
+
+// revise records a Revision of the query's current SQL and datasource, edited
+// by userID, and evicts its cached results which no longer match them
+func (c *Config) revise(userID string, query *Query, restoredFrom *string) error {
+	c.evict(query.ID)
+
+	if c.RevisionStore == nil {
+		return nil
+	}
+
+	_, err := c.RevisionStore.Create(&CreateRevision{
+		UserID:       userID,
+		QueryID:      query.ID,
+		Query:        query.Query,
+		DatasourceID: query.DatasourceID,
+		RestoredFrom: restoredFrom,
+		CreatedAt:    query.UpdatedAt,
+	})
+
+	return err
+}
+
+// reviseQuery updates the current query, recording a Revision edited by userID
+// in the same transaction when its SQL or datasource change or it is restored
+// from a revision, and evicts its cached results which no longer match them
+func (c *Config) reviseQuery(userID string, current *Query, uq *UpdateQuery, restoredFrom *string) (*Query, error) {
+	var query *Query
+	var err error
+
+	if c.RevisionStore == nil {
+		query, err = c.QueryStore.Update(userID, current.ID, uq)
+	} else {
+		query, err = c.QueryStore.Revise(userID, current.ID, uq, restoredFrom)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if restoredFrom != nil || query.Query != current.Query || query.DatasourceID != current.DatasourceID {
+		c.evict(query.ID)
+	}
+
+	return query, nil
+}
+
+func (c *Config) queryRevisions(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if _, err := c.QueryStore.Get(claims.UserID, id); err != nil {
+		return err
+	}
+
+	revisions := []*Revision{}
+
+	if c.RevisionStore != nil {
+		params := handlerutils.Params(r)
+		page := params.MaybeInt("page", 1)
+		per := params.MaybeInt("per", 25)
+
+		var err error
+		revisions, err = c.RevisionStore.List(claims.UserID, id, page, per)
+		if err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusInternalServerError}
+		}
+	}
+
+	return json.NewEncoder(w).Encode(revisions)
+}
+
+func (c *Config) queryRevision(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	revision, err := c.getRevision(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(revision)
+}
+
+// queryRevisionRollback restores the SQL and datasource of a previous revision
+// of the query, as an edit recording a new revision
+func (c *Config) queryRevisionRollback(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	revision, err := c.getRevision(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	current, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	restored := *current
+	restored.Query = revision.Query
+	restored.DatasourceID = revision.DatasourceID
+
+	if err := restored.Params.Validate(restored.Query); err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	if err := c.validateStatement(r.Context(), &restored); err != nil {
+		return err
+	}
+
+	query, err := c.reviseQuery(claims.UserID, current, &UpdateQuery{
+		Query:        &revision.Query,
+		DatasourceID: &revision.DatasourceID,
+	}, &revision.ID)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(query)
+}
+
+func (c *Config) getRevision(claims *auth.Claims, id string, r *http.Request) (*Revision, error) {
+	if c.RevisionStore == nil {
+		return nil, errRevisionsDisabled
+	}
+
+	params := handlerutils.Params(r)
+	if err := params.Require("revision"); err != nil {
+		return nil, err
+	}
+
+	revisionID, _ := params.Get("revision")
+
+	return c.RevisionStore.Get(claims.UserID, id, revisionID)
+}
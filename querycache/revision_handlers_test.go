@@ -0,0 +1,158 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/cga1123/bissy-api/utils/expecthttp"
+)
+
+func TestQueryRevisions(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	cache := querycache.NewInMemoryCache()
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, &utils.RealClock{}, &utils.UUIDGenerator{}),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, &utils.RealClock{}, &utils.UUIDGenerator{}),
+		RevisionStore:   querycache.NewSQLRevisionStore(db, &utils.UUIDGenerator{}),
+		Cache:           cache,
+	}
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	other, err := config.DatasourceStore.Create(claims.UserID, &querycache.CreateDatasource{Type: "test", Name: "Other"})
+	expect.Ok(t, err)
+
+	body, err := utils.JSONBody(map[string]string{"query": "SELECT 1", "datasourceId": datasource.ID})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/queries", body)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	var query querycache.Query
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&query))
+
+	revisions := func() []*querycache.Revision {
+		request, err := http.NewRequest("GET", "/queries/"+query.ID+"/revisions", nil)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Ok(t, response)
+
+		var revisions []*querycache.Revision
+		expect.Ok(t, json.NewDecoder(response.Body).Decode(&revisions))
+
+		return revisions
+	}
+
+	patch := func(update map[string]string) *querycache.Query {
+		body, err := utils.JSONBody(update)
+		expect.Ok(t, err)
+
+		request, err := http.NewRequest("PATCH", "/queries/"+query.ID, body)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Ok(t, response)
+
+		var updated querycache.Query
+		expect.Ok(t, json.NewDecoder(response.Body).Decode(&updated))
+
+		return &updated
+	}
+
+	initial := revisions()
+	expect.Equal(t, 1, len(initial))
+	expect.Equal(t, "SELECT 1", initial[0].Query)
+	expect.Equal(t, claims.UserID, initial[0].UserID)
+
+	// edits evict cached results, and record a revision
+	expect.Ok(t, cache.Set(cacheKey(t, &query, nil), "cached", 0))
+
+	updated := patch(map[string]string{"query": "SELECT 2", "datasourceId": other.ID})
+	expect.Equal(t, "SELECT 2", updated.Query)
+	expect.Equal(t, other.ID, updated.DatasourceID)
+
+	_, ok := cache.Get(cacheKey(t, &query, nil))
+	expect.False(t, ok)
+
+	edited := revisions()
+	expect.Equal(t, 2, len(edited))
+	expect.Equal(t, "SELECT 2", edited[0].Query)
+	expect.Equal(t, other.ID, edited[0].DatasourceID)
+
+	// other edits do not
+	patch(map[string]string{"name": "Two"})
+	expect.Equal(t, 2, len(revisions()))
+
+	// edits are validated as on creation
+	for _, update := range []map[string]string{
+		{"query": "DELETE FROM users"},
+		{"query": "SELECT {{undeclared}}"},
+		{"datasourceId": query.ID},
+	} {
+		body, err := utils.JSONBody(update)
+		expect.Ok(t, err)
+
+		request, err := http.NewRequest("PATCH", "/queries/"+query.ID, body)
+		expect.Ok(t, err)
+
+		response := testHandler(claims, config, request)
+		expecthttp.Status(t, http.StatusUnprocessableEntity, response)
+	}
+
+	// rolling back restores the revision, as a new one
+	request, err = http.NewRequest("POST", "/queries/"+query.ID+"/revisions/"+initial[0].ID+"/rollback", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+
+	var restored querycache.Query
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&restored))
+	expect.Equal(t, "SELECT 1", restored.Query)
+	expect.Equal(t, datasource.ID, restored.DatasourceID)
+	expect.Equal(t, "Two", restored.Name)
+
+	rolledBack := revisions()
+	expect.Equal(t, 3, len(rolledBack))
+	expect.Equal(t, "SELECT 1", rolledBack[0].Query)
+	expect.Equal(t, &initial[0].ID, rolledBack[0].RestoredFrom)
+
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/revisions/"+edited[0].ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.JSONBody(t, edited[0], response.Body)
+
+	// other users cannot see them
+	request, err = http.NewRequest("GET", "/queries/"+query.ID+"/revisions/"+edited[0].ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
+
+func TestQueryRevisionsDisabled(t *testing.T) {
+	t.Parallel()
+
+	config := &querycache.Config{}
+	request, err := http.NewRequest("GET", "/queries/1/revisions/2", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotImplemented, response)
+}
@@ -0,0 +1,85 @@
+package querycache
+
+import (
+	"fmt"
+
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
+)
+
+// SQLRevisionStore defines an SQL implementation of a RevisionStore
+type SQLRevisionStore struct {
+	db          *hnysqlx.DB
+	idGenerator utils.IDGenerator
+}
+
+// NewSQLRevisionStore builds a new SQLRevisionStore
+func NewSQLRevisionStore(db *hnysqlx.DB, generator utils.IDGenerator) *SQLRevisionStore {
+	return &SQLRevisionStore{db: db, idGenerator: generator}
+}
+
+// Create records a new Revision
+func (s *SQLRevisionStore) Create(cr *CreateRevision) (*Revision, error) {
+	return createRevision(s.db, s.idGenerator.Generate(), cr)
+}
+
+func createRevision(db getter, id string, cr *CreateRevision) (*Revision, error) {
+	queryStr := `
+		INSERT INTO querycache_revisions (id, user_id, query_id, query, datasource_id, restored_from, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING *`
+
+	var revision Revision
+	err := db.Get(&revision, queryStr, id, cr.UserID, cr.QueryID,
+		cr.Query, cr.DatasourceID, cr.RestoredFrom, cr.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &revision, nil
+}
+
+// Get returns the Revision of the Query with associated id from the store
+func (s *SQLRevisionStore) Get(userID, queryID, id string) (*Revision, error) {
+	var revision Revision
+
+	queryStr := `
+		SELECT r.*
+		FROM querycache_revisions r
+		JOIN querycache_queries q ON q.id = r.query_id
+		WHERE r.id = $1
+		AND r.query_id = $2
+		AND q.user_id = $3`
+
+	if err := s.db.Get(&revision, queryStr, id, queryID, userID); err != nil {
+		return nil, err
+	}
+
+	return &revision, nil
+}
+
+// List returns the requested Revisions of a Query, most recent first
+func (s *SQLRevisionStore) List(userID, queryID string, page, per int) ([]*Revision, error) {
+	if page < 1 || per < 1 {
+		return nil,
+			fmt.Errorf("page and per must be greater than 0 (page %v) (per %v)",
+				page, per)
+	}
+
+	revisions := []*Revision{}
+
+	queryStr := `
+		SELECT r.*
+		FROM querycache_revisions r
+		JOIN querycache_queries q ON q.id = r.query_id
+		WHERE q.user_id = $1
+		AND r.query_id = $2
+		ORDER BY r.created_at DESC
+		OFFSET $3
+		LIMIT $4`
+	if err := s.db.Select(&revisions, queryStr, userID, queryID, (page-1)*per, per); err != nil {
+		return nil, err
+	}
+
+	return revisions, nil
+}
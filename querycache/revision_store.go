@@ -0,0 +1,36 @@
+package querycache
+
+import (
+	"time"
+)
+
+// Revision is an immutable record of the SQL and Datasource of a Query,
+// taken when it is created and each time either is edited by UserID.
+// RestoredFrom is set to the Revision it was rolled back to, if any.
+type Revision struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"userId" db:"user_id"`
+	QueryID      string    `json:"queryId" db:"query_id"`
+	Query        string    `json:"query"`
+	DatasourceID string    `json:"datasourceId" db:"datasource_id"`
+	RestoredFrom *string   `json:"restoredFrom" db:"restored_from"`
+	CreatedAt    time.Time `json:"createdAt" db:"created_at"`
+}
+
+// CreateRevision describes the parameters to record a new Revision
+type CreateRevision struct {
+	UserID       string
+	QueryID      string
+	Query        string
+	DatasourceID string
+	RestoredFrom *string
+	CreatedAt    time.Time
+}
+
+// RevisionStore describes a generic Store for Revisions, they are listed most
+// recent first
+type RevisionStore interface {
+	Create(*CreateRevision) (*Revision, error)
+	Get(userID, queryID, id string) (*Revision, error)
+	List(userID, queryID string, page, per int) ([]*Revision, error)
+}
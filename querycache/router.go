@@ -3,6 +3,8 @@ package querycache
 import (
 	"fmt"
 	"net/http"
+	"sync"
+	"time"
 
 	"github.com/cga1123/bissy-api/auth"
 	"github.com/cga1123/bissy-api/utils"
@@ -11,12 +13,41 @@ import (
 )
 
 // Config contains everything external required to setup querycache
+// MaxCacheBytes sets the size above which results are not cached, a zero value
+// means no limit.
+// Connections holds the pooled connections to datasources, a registry with
+// default options is used if unset.
+// QueryTimeout is the default timeout for queries whose datasource does not set
+// one, a zero value means no timeout.
+// RunStore records the history of query executions, if set.
+// SnapshotStore retains snapshots of query results, if set.
+// RevisionStore records revisions of queries' SQL and datasource, if set.
+// CatalogStore retains snapshots of datasources' schemas, if set.
+// CatalogLifetime is how long the schemas of datasources are cached for, a zero
+// value means they are not cached.
+// Runner executes queries asynchronously, the runs endpoints are disabled if
+// unset.
+// ExplainQueries validates queries as they are created by explaining them
+// against their datasource, rejecting those it fails to explain.
 type Config struct {
 	QueryStore      QueryStore
 	DatasourceStore DatasourceStore
+	RunStore        RunStore
+	SnapshotStore   SnapshotStore
+	RevisionStore   RevisionStore
+	CatalogStore    CatalogStore
+	Runner          *Runner
 	Executor        Executor
 	Cache           QueryCache
 	Clock           utils.Clock
+	Connections     *Connections
+	MaxCacheBytes   int
+	QueryTimeout    time.Duration
+	CatalogLifetime time.Duration
+	ExplainQueries  bool
+
+	flights     *Flights
+	flightsOnce sync.Once
 }
 
 func memberHandler(next func(*auth.Claims, string, http.ResponseWriter, *http.Request) error) http.Handler {
@@ -37,6 +68,10 @@ func memberHandler(next func(*auth.Claims, string, http.ResponseWriter, *http.Re
 
 // SetupHandlers mounts the querycache handlers onto the given mux
 func (c *Config) SetupHandlers(router *mux.Router) {
+	if c.Connections == nil {
+		c.Connections = NewConnections(ConnectionOptions{})
+	}
+
 	router.HandleFunc("/", c.home).Methods("OPTIONS", "GET")
 
 	// Queries
@@ -64,6 +99,67 @@ func (c *Config) SetupHandlers(router *mux.Router) {
 		Handle("/queries/{id}/result", memberHandler(c.queryResult)).
 		Methods("OPTIONS", "GET")
 
+	router.
+		Handle("/queries/{id}/result/schema", memberHandler(c.queryResultSchema)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/refresh", memberHandler(c.queryRefresh)).
+		Methods("OPTIONS", "POST")
+
+	router.
+		Handle("/queries/{id}/cache", memberHandler(c.queryCacheDelete)).
+		Methods("OPTIONS", "DELETE")
+
+	router.
+		Handle("/queries/{id}/explain", memberHandler(c.queryExplain)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/runs", memberHandler(c.queryRuns)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/runs", memberHandler(c.queryRunsCreate)).
+		Methods("OPTIONS", "POST")
+
+	router.
+		Handle("/queries/{id}/snapshots", memberHandler(c.querySnapshots)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/snapshots/{snapshot}", memberHandler(c.querySnapshot)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/snapshots/{a}/diff/{b}", memberHandler(c.querySnapshotDiff)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/revisions", memberHandler(c.queryRevisions)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/revisions/{revision}", memberHandler(c.queryRevision)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/queries/{id}/revisions/{revision}/rollback", memberHandler(c.queryRevisionRollback)).
+		Methods("OPTIONS", "POST")
+
+	// Runs
+	router.
+		Handle("/runs/{id}", memberHandler(c.runGet)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/runs/{id}", memberHandler(c.runDelete)).
+		Methods("OPTIONS", "DELETE")
+
+	router.
+		Handle("/runs/{id}/result", memberHandler(c.runResult)).
+		Methods("OPTIONS", "GET")
+
 	// Datasources
 	router.
 		Handle("/datasources", auth.BuildHandler(c.datasourcesList)).
@@ -73,6 +169,10 @@ func (c *Config) SetupHandlers(router *mux.Router) {
 		Handle("/datasources", auth.BuildHandler(c.datasourcesCreate)).
 		Methods("OPTIONS", "POST")
 
+	router.
+		Handle("/datasources/types", auth.BuildHandler(c.datasourceTypes)).
+		Methods("OPTIONS", "GET")
+
 	router.
 		Handle("/datasources/{id}", memberHandler(c.datasourceGet)).
 		Methods("OPTIONS", "GET")
@@ -84,6 +184,30 @@ func (c *Config) SetupHandlers(router *mux.Router) {
 	router.
 		Handle("/datasources/{id}", memberHandler(c.datasourceUpdate)).
 		Methods("OPTIONS", "PATCH")
+
+	router.
+		Handle("/datasources/{id}/schema", memberHandler(c.datasourceSchema)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/datasources/{id}/schema/snapshots", memberHandler(c.datasourceSchemaSnapshots)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/datasources/{id}/schema/snapshots/{snapshot}", memberHandler(c.datasourceSchemaSnapshot)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/datasources/{id}/schema/snapshots/{a}/diff/{b}", memberHandler(c.datasourceSchemaDiff)).
+		Methods("OPTIONS", "GET")
+
+	router.
+		Handle("/datasources/{id}/test", memberHandler(c.datasourceTest)).
+		Methods("OPTIONS", "POST")
+
+	router.
+		Handle("/datasources/{id}/explain", memberHandler(c.datasourceExplain)).
+		Methods("OPTIONS", "POST")
 }
 
 func (c *Config) home(w http.ResponseWriter, r *http.Request) {
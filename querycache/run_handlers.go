@@ -0,0 +1,96 @@
+package querycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+var errRunsDisabled = &handlerutils.HandlerError{
+	Err: fmt.Errorf("asynchronous runs are not enabled"), Status: http.StatusNotImplemented}
+
+func (c *Config) queryRunsCreate(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.Runner == nil {
+		return errRunsDisabled
+	}
+
+	query, args, err := c.boundQuery(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	run, err := c.Runner.Enqueue(query, args)
+	if err == ErrRunQueueFull {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusServiceUnavailable}
+	} else if err != nil {
+		return err
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+
+	return json.NewEncoder(w).Encode(run)
+}
+
+func (c *Config) runGet(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.Runner == nil {
+		return errRunsDisabled
+	}
+
+	run, err := c.RunStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(run)
+}
+
+func (c *Config) runDelete(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.Runner == nil {
+		return errRunsDisabled
+	}
+
+	run, err := c.Runner.Cancel(claims.UserID, id)
+	if err == ErrRunFinished {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusConflict}
+	} else if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(run)
+}
+
+func (c *Config) runResult(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.Runner == nil {
+		return errRunsDisabled
+	}
+
+	format, options, err := resultFormatOptions(r)
+	if err != nil {
+		return err
+	}
+
+	run, err := c.RunStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	if run.Status != RunSucceeded {
+		return &handlerutils.HandlerError{
+			Err: fmt.Errorf("run %v is %v", run.ID, run.Status), Status: http.StatusConflict}
+	}
+
+	result, ok := c.Runner.Result(run.ID)
+	if !ok {
+		return &handlerutils.HandlerError{
+			Err: fmt.Errorf("result of run %v is no longer available", run.ID), Status: http.StatusGone}
+	}
+
+	handlerutils.ContentType(w, format.ContentType)
+
+	return result.Write(&cacheHeaderWriter{RowWriter: format.New(w, options), header: w.Header()})
+}
@@ -0,0 +1,108 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/cga1123/bissy-api/utils/expecthttp"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+func TestRunsAsync(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	clock := &utils.RealClock{}
+	generator := &utils.UUIDGenerator{}
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, clock, generator),
+		DatasourceStore: querycache.NewSQLDatasourceStore(db, clock, generator),
+		RunStore:        querycache.NewSQLRunStore(db, generator),
+		Cache:           querycache.NewInMemoryCache(),
+		Clock:           clock,
+	}
+	config.Runner = querycache.NewRunner(config, querycache.RunnerOptions{
+		Concurrency: 1, Backlog: 1, ResultLifetime: time.Hour}).Start()
+	defer config.Runner.Stop()
+
+	claims := testClaims()
+	datasource, err := config.DatasourceStore.Create(claims.UserID,
+		&querycache.CreateDatasource{Type: "test", Name: "Test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(claims.UserID, &querycache.CreateQuery{
+		Query: "SELECT 1", Lifetime: querycache.Duration(time.Hour), DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	request, err := http.NewRequest("POST", "/queries/"+query.ID+"/runs", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusAccepted, response)
+
+	var run querycache.Run
+	expect.Ok(t, json.NewDecoder(response.Body).Decode(&run))
+	expect.Equal(t, query.ID, run.QueryID)
+
+	deadline := time.Now().Add(time.Second)
+	for run.Status != querycache.RunSucceeded && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+
+		request, err = http.NewRequest("GET", "/runs/"+run.ID, nil)
+		expect.Ok(t, err)
+
+		response = testHandler(claims, config, request)
+		expecthttp.Ok(t, response)
+		expect.Ok(t, json.NewDecoder(response.Body).Decode(&run))
+	}
+	expect.Equal(t, querycache.RunSucceeded, run.Status)
+	expect.Equal(t, 1, run.RowCount)
+
+	request, err = http.NewRequest("GET", "/runs/"+run.ID+"/result", nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Ok(t, response)
+	expecthttp.ContentType(t, handlerutils.ContentTypeCSV, response)
+	expecthttp.StringBody(t, "query\nGot: SELECT 1\n", response)
+
+	// the result is also cached for the query
+	_, ok := config.Cache.Get(query.ID)
+	expect.True(t, ok)
+
+	// finished runs can't be cancelled
+	request, err = http.NewRequest("DELETE", "/runs/"+run.ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(claims, config, request)
+	expecthttp.Status(t, http.StatusConflict, response)
+
+	// runs are scoped to their user
+	request, err = http.NewRequest("GET", "/runs/"+run.ID, nil)
+	expect.Ok(t, err)
+
+	response = testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotFound, response)
+}
+
+func TestRunsDisabled(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	_, _, config := testConfig(db)
+
+	request, err := http.NewRequest("GET", "/runs/1", nil)
+	expect.Ok(t, err)
+
+	response := testHandler(testClaims(), config, request)
+	expecthttp.Status(t, http.StatusNotImplemented, response)
+}
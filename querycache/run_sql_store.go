@@ -0,0 +1,114 @@
+package querycache
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
+)
+
+// SQLRunStore defines an SQL implementation of a RunStore
+type SQLRunStore struct {
+	db          *hnysqlx.DB
+	idGenerator utils.IDGenerator
+}
+
+// NewSQLRunStore builds a new SQLRunStore
+func NewSQLRunStore(db *hnysqlx.DB, generator utils.IDGenerator) *SQLRunStore {
+	return &SQLRunStore{db: db, idGenerator: generator}
+}
+
+// Create records a new Run
+func (s *SQLRunStore) Create(cr *CreateRun) (*Run, error) {
+	queryStr := `
+		INSERT INTO querycache_runs (id, user_id, query_id, datasource_id, trigger, status, started_at, ended_at, row_count, bytes, cache_hit, error)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING *`
+
+	var run Run
+	err := s.db.Get(&run, queryStr, s.idGenerator.Generate(), cr.UserID, cr.QueryID,
+		cr.DatasourceID, cr.Trigger, cr.Status, cr.StartedAt, cr.EndedAt, cr.RowCount,
+		cr.Bytes, cr.CacheHit, cr.Error)
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// Get returns the Run with associated id from the store
+func (s *SQLRunStore) Get(userID, id string) (*Run, error) {
+	var run Run
+
+	queryStr := "SELECT * FROM querycache_runs WHERE id = $1 AND user_id = $2"
+
+	if err := s.db.Get(&run, queryStr, id, userID); err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// Update updates the Run with associated id, unless it has reached a final
+// status
+func (s *SQLRunStore) Update(id string, ur *UpdateRun) (*Run, error) {
+	var run Run
+
+	queryStr := `
+		UPDATE querycache_runs
+		SET status = COALESCE($2, status),
+				started_at = COALESCE($3, started_at),
+				ended_at = COALESCE($4, ended_at),
+				row_count = COALESCE($5, row_count),
+				bytes = COALESCE($6, bytes),
+				cache_hit = COALESCE($7, cache_hit),
+				error = COALESCE($8, error)
+		WHERE id = $1
+		AND status IN ($9, $10)
+		RETURNING *`
+
+	err := s.db.Get(&run, queryStr, id, ur.Status, ur.StartedAt, ur.EndedAt,
+		ur.RowCount, ur.Bytes, ur.CacheHit, ur.Error, RunQueued, RunRunning)
+	if err != nil {
+		return nil, err
+	}
+
+	return &run, nil
+}
+
+// List returns the requested Runs of a Query, most recent first
+func (s *SQLRunStore) List(userID, queryID string, page, per int) ([]*Run, error) {
+	if page < 1 || per < 1 {
+		return nil,
+			fmt.Errorf("page and per must be greater than 0 (page %v) (per %v)",
+				page, per)
+	}
+
+	runs := []*Run{}
+
+	queryStr := `
+		SELECT *
+		FROM querycache_runs
+		WHERE user_id = $1
+		AND query_id = $2
+		ORDER BY started_at DESC
+		OFFSET $3
+		LIMIT $4`
+	if err := s.db.Select(&runs, queryStr, userID, queryID, (page-1)*per, per); err != nil {
+		return nil, err
+	}
+
+	return runs, nil
+}
+
+// Prune deletes Runs started before the given time, returning how many were
+// deleted
+func (s *SQLRunStore) Prune(before time.Time) (int64, error) {
+	result, err := s.db.Exec("DELETE FROM querycache_runs WHERE started_at < $1", before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
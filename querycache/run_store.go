@@ -0,0 +1,134 @@
+package querycache
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/cga1123/bissy-api/utils"
+)
+
+// The triggers a Run may be recorded with
+const (
+	TriggerRequest   = "request"
+	TriggerScheduler = "scheduler"
+	TriggerManual    = "manual"
+)
+
+// The statuses of a Run, succeeded, failed and cancelled are final
+const (
+	RunQueued    = "queued"
+	RunRunning   = "running"
+	RunSucceeded = "succeeded"
+	RunFailed    = "failed"
+	RunCancelled = "cancelled"
+)
+
+type triggerKey struct{}
+
+// runOutcome returns the final status, and error message, of a Run executed
+// within ctx which returned err
+func runOutcome(ctx context.Context, err error) (string, *string) {
+	if err == nil {
+		return RunSucceeded, nil
+	}
+
+	message := err.Error()
+	if ctx.Err() == context.Canceled {
+		return RunCancelled, &message
+	}
+
+	return RunFailed, &message
+}
+
+// WithTrigger returns a context recording executions within it as being
+// caused by the given trigger
+func WithTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+// Trigger returns the trigger of executions within ctx, defaulting to
+// TriggerRequest
+func Trigger(ctx context.Context) string {
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok {
+		return trigger
+	}
+
+	return TriggerRequest
+}
+
+// Run records a single execution of a Query, whether it was served from the
+// cache or not. Error is set if the execution failed.
+type Run struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"userId" db:"user_id"`
+	QueryID      string    `json:"queryId" db:"query_id"`
+	DatasourceID string    `json:"datasourceId" db:"datasource_id"`
+	Trigger      string    `json:"trigger"`
+	Status       string    `json:"status"`
+	StartedAt    time.Time `json:"startedAt" db:"started_at"`
+	EndedAt      time.Time `json:"endedAt" db:"ended_at"`
+	RowCount     int       `json:"rowCount" db:"row_count"`
+	Bytes        int       `json:"bytes"`
+	CacheHit     bool      `json:"cacheHit" db:"cache_hit"`
+	Error        *string   `json:"error"`
+}
+
+// CreateRun describes the parameters to record a new Run
+type CreateRun struct {
+	UserID       string
+	QueryID      string
+	DatasourceID string
+	Trigger      string
+	Status       string
+	StartedAt    time.Time
+	EndedAt      time.Time
+	RowCount     int
+	Bytes        int
+	CacheHit     bool
+	Error        *string
+}
+
+// UpdateRun describes the parameters which may be updated on a Run
+type UpdateRun struct {
+	Status    *string
+	StartedAt *time.Time
+	EndedAt   *time.Time
+	RowCount  *int
+	Bytes     *int
+	CacheHit  *bool
+	Error     *string
+}
+
+// RunStore describes a generic Store for Runs.
+// Update must not update Runs which have reached a final status, returning
+// sql.ErrNoRows instead.
+type RunStore interface {
+	Create(*CreateRun) (*Run, error)
+	Get(string, string) (*Run, error)
+	Update(string, *UpdateRun) (*Run, error)
+	List(string, string, int, int) ([]*Run, error)
+	Prune(time.Time) (int64, error)
+}
+
+// PruneRuns deletes Runs older than retention from the store every interval,
+// until ctx is done
+func PruneRuns(ctx context.Context, store RunStore, clock utils.Clock, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		pruned, err := store.Prune(clock.Now().Add(-retention))
+		if err != nil {
+			log.Printf("querycache: failed to prune runs: %v", err)
+		} else if pruned > 0 {
+			log.Printf("querycache: pruned %v runs", pruned)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,249 @@
+package querycache
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cga1123/bissy-api/utils/pool"
+)
+
+// ErrRunQueueFull is returned when a Run can't be enqueued because the
+// Runner's backlog is full
+var ErrRunQueueFull = errors.New("run queue is full")
+
+// ErrRunFinished is returned when cancelling a Run which has already finished
+var ErrRunFinished = errors.New("run has already finished")
+
+// RunnerOptions configures a Runner.
+// Concurrency is the number of Runs executed at once and Backlog how many may
+// be queued. Timeout is the timeout of Runs whose query and datasource don't
+// set one, a zero value means no timeout. ResultLifetime is how long the
+// results of Runs are kept for.
+type RunnerOptions struct {
+	Concurrency    int
+	Backlog        int
+	Timeout        time.Duration
+	ResultLifetime time.Duration
+}
+
+// Runner executes queries asynchronously, recording each execution as a Run
+// and keeping its result in the cache, as well as caching it as usual.
+type Runner struct {
+	config  *Config
+	options RunnerOptions
+	pool    pool.Pool
+	cancels map[string]context.CancelFunc
+	lock    sync.Mutex
+	ctx     context.Context
+	cancel  context.CancelFunc
+}
+
+// NewRunner builds a new Runner executing queries with the stores, cache and
+// connections of the given Config, which must have a Cache and RunStore set
+func NewRunner(config *Config, options RunnerOptions) *Runner {
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Runner{
+		config:  config,
+		options: options,
+		pool:    pool.New(options.Concurrency, options.Backlog),
+		cancels: map[string]context.CancelFunc{},
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Start kicks off the Runner's workers
+func (r *Runner) Start() *Runner {
+	r.pool.Start()
+
+	return r
+}
+
+// Stop cancels all queued and running Runs and waits for them to return
+func (r *Runner) Stop() {
+	r.cancel()
+	r.pool.Stop()
+}
+
+func runResultKey(id string) string {
+	return "run:" + id
+}
+
+// Enqueue records a new queued Run of the query with the given arguments, and
+// queues it for execution
+func (r *Runner) Enqueue(query *Query, args Arguments) (*Run, error) {
+	return r.EnqueueTrigger(query, args, TriggerRequest)
+}
+
+// EnqueueTrigger enqueues a Run as Enqueue does, recording it as caused by the
+// given trigger
+func (r *Runner) EnqueueTrigger(query *Query, args Arguments, trigger string) (*Run, error) {
+	now := r.config.Clock.Now()
+
+	run, err := r.config.RunStore.Create(&CreateRun{
+		UserID:       query.UserID,
+		QueryID:      query.ID,
+		DatasourceID: query.DatasourceID,
+		Trigger:      trigger,
+		Status:       RunQueued,
+		StartedAt:    now,
+		EndedAt:      now,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(r.ctx)
+
+	r.lock.Lock()
+	r.cancels[run.ID] = cancel
+	r.lock.Unlock()
+
+	if !r.pool.Add(func() { r.execute(ctx, run, query, args) }) {
+		r.finish(ctx, run.ID, nil, false, ErrRunQueueFull)
+		r.release(run.ID)
+
+		return nil, ErrRunQueueFull
+	}
+
+	return run, nil
+}
+
+// Cancel cancels the Run with the given ID. It returns ErrRunFinished if the
+// Run has already finished.
+// Only Runs executing on this instance are interrupted, those executing
+// elsewhere are marked as cancelled and their result discarded.
+func (r *Runner) Cancel(userID, id string) (*Run, error) {
+	if _, err := r.config.RunStore.Get(userID, id); err != nil {
+		return nil, err
+	}
+
+	status := RunCancelled
+	ended := r.config.Clock.Now()
+
+	run, err := r.config.RunStore.Update(id, &UpdateRun{Status: &status, EndedAt: &ended})
+	if err == sql.ErrNoRows {
+		return nil, ErrRunFinished
+	} else if err != nil {
+		return nil, err
+	}
+
+	r.lock.Lock()
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+	}
+	r.lock.Unlock()
+
+	return run, nil
+}
+
+// Result returns the result of the succeeded Run with the given ID, or false
+// if it is no longer available
+func (r *Runner) Result(id string) (*Result, bool) {
+	value, ok := r.config.Cache.Get(runResultKey(id))
+	if !ok {
+		return nil, false
+	}
+
+	entry, err := unmarshalEntry(value)
+	if err != nil {
+		return nil, false
+	}
+
+	return entry.Result, true
+}
+
+func (r *Runner) release(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if cancel, ok := r.cancels[id]; ok {
+		cancel()
+		delete(r.cancels, id)
+	}
+}
+
+func (r *Runner) execute(ctx context.Context, run *Run, query *Query, args Arguments) {
+	defer r.release(run.ID)
+
+	if ctx.Err() != nil {
+		r.finish(ctx, run.ID, nil, false, ctx.Err())
+		return
+	}
+
+	status := RunRunning
+	started := r.config.Clock.Now()
+
+	_, err := r.config.RunStore.Update(run.ID, &UpdateRun{Status: &status, StartedAt: &started})
+	if err == sql.ErrNoRows {
+		// cancelled while queued
+		return
+	} else if err != nil {
+		log.Printf("querycache: failed to start run %v: %v", run.ID, err)
+	}
+
+	result, hit, err := r.run(ctx, query, args)
+	if err == nil {
+		err = r.store(run.ID, result)
+	}
+
+	r.finish(ctx, run.ID, result, hit, err)
+}
+
+func (r *Runner) run(ctx context.Context, query *Query, args Arguments) (*Result, bool, error) {
+	executor, timeout, err := r.config.datasourceExecutor(query, r.options.Timeout)
+	if err != nil {
+		return nil, false, err
+	}
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	result, executed, err := r.config.cachedExecutor(executor).refresh(ctx, query, args)
+
+	return result, !executed, err
+}
+
+// store keeps the result of the Run in the cache, so it may be fetched once
+// the Run has succeeded
+func (r *Runner) store(id string, result *Result) error {
+	value, err := marshalEntry(&cacheEntry{Result: result, ExecutedAt: r.config.Clock.Now()})
+	if err != nil {
+		return err
+	}
+
+	if r.config.MaxCacheBytes > 0 && len(value) > r.config.MaxCacheBytes {
+		return fmt.Errorf("result is larger than %v bytes", r.config.MaxCacheBytes)
+	}
+
+	return r.config.Cache.Set(runResultKey(id), value, r.options.ResultLifetime)
+}
+
+// finish records the final status of the Run, and the result it was served
+func (r *Runner) finish(ctx context.Context, id string, result *Result, hit bool, err error) {
+	status, message := runOutcome(ctx, err)
+	ended := r.config.Clock.Now()
+	update := &UpdateRun{Status: &status, EndedAt: &ended, Error: message}
+
+	if result != nil {
+		rows, bytes := result.size()
+		update.RowCount = &rows
+		update.Bytes = &bytes
+		update.CacheHit = &hit
+	}
+
+	// the run may have been cancelled in the meantime
+	if _, err := r.config.RunStore.Update(id, update); err != nil && err != sql.ErrNoRows {
+		log.Printf("querycache: failed to finish run %v: %v", id, err)
+	}
+}
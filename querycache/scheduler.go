@@ -0,0 +1,235 @@
+package querycache
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/cga1123/bissy-api/utils/pool"
+)
+
+// SchedulerOptions configures a Scheduler.
+// Interval is how often queries are checked for refresh, Lead how long before
+// the end of its Lifetime a query is refreshed, and Jitter the maximum extra
+// time, picked per query, by which refreshes are brought forward so that
+// queries sharing a Lifetime are spread out.
+// Concurrency caps the number of queries refreshed at once.
+type SchedulerOptions struct {
+	Interval    time.Duration
+	Lead        time.Duration
+	Jitter      time.Duration
+	Concurrency int
+}
+
+// Scheduler re-executes queries with AutoRefresh set shortly before their
+// Lifetime expires, keeping their cached results warm
+type Scheduler struct {
+	config   *Config
+	options  SchedulerOptions
+	pool     pool.Pool
+	inflight map[string]bool
+	unbound  map[string]bool
+	lock     sync.Mutex
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// NewScheduler builds a new Scheduler refreshing queries with the stores,
+// cache and connections of the given Config, which must have a Cache set.
+// The Interval must be positive.
+func NewScheduler(config *Config, options SchedulerOptions) (*Scheduler, error) {
+	if options.Interval <= 0 {
+		return nil, fmt.Errorf("scheduler interval must be positive, got %v", options.Interval)
+	}
+
+	if options.Concurrency < 1 {
+		options.Concurrency = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &Scheduler{
+		config:   config,
+		options:  options,
+		pool:     pool.New(options.Concurrency, options.Concurrency),
+		inflight: map[string]bool{},
+		unbound:  map[string]bool{},
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// Start kicks off the scheduler in the background
+func (s *Scheduler) Start() *Scheduler {
+	s.pool.Start()
+
+	go func() {
+		defer close(s.done)
+
+		ticker := time.NewTicker(s.options.Interval)
+		defer ticker.Stop()
+
+		for {
+			s.schedule()
+
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+
+	return s
+}
+
+// Stop stops scheduling refreshes, cancels those in progress and waits for
+// them to return
+func (s *Scheduler) Stop() {
+	s.cancel()
+	<-s.done
+	s.pool.Stop()
+}
+
+// jitter returns a stable offset in [0, Jitter) for the given query ID
+func (s *Scheduler) jitter(id string) time.Duration {
+	if s.options.Jitter <= 0 {
+		return 0
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(id))
+
+	return time.Duration(h.Sum64() % uint64(s.options.Jitter))
+}
+
+// due determines whether the given query should be refreshed at now, that is
+// within Lead (plus its jitter) of the end of its Lifetime. Refreshes are never
+// brought forward by more than half the Lifetime.
+func (s *Scheduler) due(query *Query, now time.Time) bool {
+	lifetime := time.Duration(query.Lifetime)
+	if lifetime <= 0 {
+		return false
+	}
+
+	early := s.options.Lead + s.jitter(query.ID)
+	if early > lifetime/2 {
+		early = lifetime / 2
+	}
+
+	return !now.Before(query.LastRefresh.Add(lifetime - early))
+}
+
+func (s *Scheduler) schedule() {
+	queries, err := s.config.QueryStore.ListAutoRefresh()
+	if err != nil {
+		log.Printf("querycache: failed to list queries to refresh: %v", err)
+		return
+	}
+
+	now := s.config.Clock.Now()
+
+	for _, query := range queries {
+		if s.ctx.Err() != nil {
+			return
+		}
+
+		if !s.due(query, now) || !s.bindable(query) || !s.claim(query.ID) {
+			continue
+		}
+
+		query := query
+		if !s.pool.Add(func() { s.refresh(query) }) {
+			// at capacity, the query will be picked up on a later tick
+			s.release(query.ID)
+		}
+	}
+}
+
+// bindable determines whether the query can be refreshed with its default
+// arguments, queries with a required Parameter and no default can't be and are
+// skipped, logging the first time they are
+func (s *Scheduler) bindable(query *Query) bool {
+	_, err := query.Params.Bind(map[string]string{})
+	if err == nil {
+		delete(s.unbound, query.ID)
+		return true
+	}
+
+	if !s.unbound[query.ID] {
+		s.unbound[query.ID] = true
+		log.Printf("querycache: not refreshing query %v without values: %v", query.ID, err)
+	}
+
+	return false
+}
+
+func (s *Scheduler) claim(id string) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.inflight[id] {
+		return false
+	}
+
+	s.inflight[id] = true
+
+	return true
+}
+
+func (s *Scheduler) release(id string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.inflight, id)
+}
+
+// refresh re-executes the query with its default arguments and caches the
+// result
+func (s *Scheduler) refresh(query *Query) {
+	defer s.release(query.ID)
+
+	if s.ctx.Err() != nil {
+		return
+	}
+
+	if err := s.refreshQuery(query); err != nil {
+		log.Printf("querycache: failed to refresh query %v: %v", query.ID, err)
+	}
+}
+
+func (s *Scheduler) refreshQuery(query *Query) error {
+	args, err := query.Params.Bind(map[string]string{})
+	if err != nil {
+		return err
+	}
+
+	executor, timeout, err := s.config.datasourceExecutor(query, s.config.QueryTimeout)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(WithTrigger(s.ctx, TriggerScheduler), timeout)
+	defer cancel()
+
+	if _, err := s.config.cachedExecutor(executor).Refresh(ctx, query, args); err != nil {
+		return err
+	}
+
+	// parameterised results don't update LastRefresh when cached, but it is
+	// what schedules the next refresh
+	if len(args) > 0 {
+		_, err := s.config.QueryStore.Update(query.UserID, query.ID,
+			&UpdateQuery{LastRefresh: s.config.Clock.Now()})
+		if err != nil {
+			return fmt.Errorf("failed to update last refresh: %v", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+package querycache_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/google/uuid"
+)
+
+func TestSchedulerRefresh(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	now := time.Now().Truncate(time.Millisecond)
+	later := now.Add(50 * time.Minute)
+	userID := uuid.New().String()
+	cache := querycache.NewInMemoryCache()
+	config := &querycache.Config{
+		QueryStore:      newTestQueryStore(db, now, uuid.New().String()),
+		DatasourceStore: newTestDatasourceStore(db, now, uuid.New().String()),
+		Cache:           cache,
+		Clock:           &utils.TestClock{Time: later},
+	}
+
+	datasource, err := config.DatasourceStore.Create(userID, &querycache.CreateDatasource{Type: "test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(userID, &querycache.CreateQuery{
+		Query:        "SELECT 1",
+		Lifetime:     querycache.Duration(time.Hour),
+		AutoRefresh:  true,
+		DatasourceID: datasource.ID,
+	})
+	expect.Ok(t, err)
+
+	scheduler, err := querycache.NewScheduler(config, querycache.SchedulerOptions{
+		Interval:    10 * time.Millisecond,
+		Lead:        15 * time.Minute,
+		Concurrency: 1,
+	})
+	expect.Ok(t, err)
+	scheduler.Start()
+
+	deadline := time.Now().Add(time.Second)
+	_, ok := cache.Get(query.ID)
+	for !ok && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, ok = cache.Get(query.ID)
+	}
+
+	scheduler.Stop()
+	expect.True(t, ok)
+
+	query, err = config.QueryStore.Get(userID, query.ID)
+	expect.Ok(t, err)
+	expect.True(t, query.LastRefresh.Equal(later))
+}
+
+func TestSchedulerNotDue(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	now := time.Now().Truncate(time.Millisecond)
+	userID := uuid.New().String()
+	cache := querycache.NewInMemoryCache()
+	config := &querycache.Config{
+		QueryStore:      newTestQueryStore(db, now, uuid.New().String()),
+		DatasourceStore: newTestDatasourceStore(db, now, uuid.New().String()),
+		Cache:           cache,
+		Clock:           &utils.TestClock{Time: now.Add(30 * time.Minute)},
+	}
+
+	datasource, err := config.DatasourceStore.Create(userID, &querycache.CreateDatasource{Type: "test"})
+	expect.Ok(t, err)
+
+	query, err := config.QueryStore.Create(userID, &querycache.CreateQuery{
+		Query:        "SELECT 1",
+		Lifetime:     querycache.Duration(time.Hour),
+		AutoRefresh:  true,
+		DatasourceID: datasource.ID,
+	})
+	expect.Ok(t, err)
+
+	scheduler, err := querycache.NewScheduler(config, querycache.SchedulerOptions{
+		Interval:    10 * time.Millisecond,
+		Lead:        15 * time.Minute,
+		Concurrency: 1,
+	})
+	expect.Ok(t, err)
+	scheduler.Start()
+
+	time.Sleep(50 * time.Millisecond)
+	scheduler.Stop()
+
+	_, ok := cache.Get(query.ID)
+	expect.False(t, ok)
+}
+
+func TestSchedulerInterval(t *testing.T) {
+	t.Parallel()
+
+	for _, interval := range []time.Duration{0, -time.Second} {
+		_, err := querycache.NewScheduler(&querycache.Config{}, querycache.SchedulerOptions{Interval: interval})
+		expect.Error(t, err)
+	}
+}
+
+func TestSchedulerUnbound(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	now := time.Now().Truncate(time.Millisecond)
+	userID := uuid.New().String()
+	cache := querycache.NewInMemoryCache()
+	config := &querycache.Config{
+		QueryStore:      querycache.NewSQLQueryStore(db, &utils.TestClock{Time: now}, &utils.UUIDGenerator{}),
+		DatasourceStore: newTestDatasourceStore(db, now, uuid.New().String()),
+		Cache:           cache,
+		Clock:           &utils.TestClock{Time: now.Add(50 * time.Minute)},
+	}
+
+	datasource, err := config.DatasourceStore.Create(userID, &querycache.CreateDatasource{Type: "test"})
+	expect.Ok(t, err)
+
+	create := func(sql string, params querycache.Parameters) *querycache.Query {
+		query, err := config.QueryStore.Create(userID, &querycache.CreateQuery{
+			Query:        sql,
+			Lifetime:     querycache.Duration(time.Hour),
+			AutoRefresh:  true,
+			DatasourceID: datasource.ID,
+			Params:       params,
+		})
+		expect.Ok(t, err)
+
+		return query
+	}
+
+	// a query which can't be executed without values is skipped, while others
+	// are still refreshed
+	unbound := create("SELECT {{id}}", querycache.Parameters{
+		{Name: "id", Type: querycache.ParameterInteger, Required: true}})
+	bound := create("SELECT 1", nil)
+
+	scheduler, err := querycache.NewScheduler(config, querycache.SchedulerOptions{
+		Interval:    10 * time.Millisecond,
+		Lead:        15 * time.Minute,
+		Concurrency: 1,
+	})
+	expect.Ok(t, err)
+	scheduler.Start()
+
+	deadline := time.Now().Add(time.Second)
+	_, ok := cache.Get(bound.ID)
+	for !ok && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+		_, ok = cache.Get(bound.ID)
+	}
+
+	scheduler.Stop()
+	expect.True(t, ok)
+
+	query, err := config.QueryStore.Get(userID, unbound.ID)
+	expect.Ok(t, err)
+	expect.True(t, query.LastRefresh.Equal(now))
+}
@@ -0,0 +1,108 @@
+package querycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/cga1123/bissy-api/auth"
+	"github.com/cga1123/bissy-api/utils/handlerutils"
+)
+
+var errSnapshotsDisabled = &handlerutils.HandlerError{
+	Err: fmt.Errorf("snapshots are not enabled"), Status: http.StatusNotImplemented}
+
+func (c *Config) querySnapshots(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	_, args, err := c.boundQuery(claims, id, r)
+	if err != nil {
+		return err
+	}
+
+	snapshots := []*Snapshot{}
+
+	if c.SnapshotStore != nil {
+		argsHash, err := args.Hash()
+		if err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusUnprocessableEntity}
+		}
+
+		params := handlerutils.Params(r)
+		page := params.MaybeInt("page", 1)
+		per := params.MaybeInt("per", 25)
+
+		snapshots, err = c.SnapshotStore.List(claims.UserID, id, argsHash, page, per)
+		if err != nil {
+			return &handlerutils.HandlerError{
+				Err: err, Status: http.StatusInternalServerError}
+		}
+	}
+
+	return json.NewEncoder(w).Encode(snapshots)
+}
+
+func (c *Config) querySnapshot(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.SnapshotStore == nil {
+		return errSnapshotsDisabled
+	}
+
+	params := handlerutils.Params(r)
+	if err := params.Require("snapshot"); err != nil {
+		return err
+	}
+
+	snapshotID, _ := params.Get("snapshot")
+
+	snapshot, err := c.SnapshotStore.Get(claims.UserID, id, snapshotID)
+	if err != nil {
+		return err
+	}
+
+	return json.NewEncoder(w).Encode(snapshot)
+}
+
+// querySnapshotDiff compares snapshot a to snapshot b, matching rows on the
+// query's SnapshotKey unless a key is passed
+func (c *Config) querySnapshotDiff(claims *auth.Claims, id string, w http.ResponseWriter, r *http.Request) error {
+	if c.SnapshotStore == nil {
+		return errSnapshotsDisabled
+	}
+
+	params := handlerutils.Params(r)
+	if err := params.Require("a", "b"); err != nil {
+		return err
+	}
+
+	query, err := c.QueryStore.Get(claims.UserID, id)
+	if err != nil {
+		return err
+	}
+
+	key := query.SnapshotKey
+	if override, ok := params.Get("key"); ok {
+		key = override
+	}
+
+	if key == "" {
+		return &handlerutils.HandlerError{
+			Err: fmt.Errorf("query %v has no snapshot key", id), Status: http.StatusUnprocessableEntity}
+	}
+
+	snapshots := make([]*Snapshot, 2)
+	for i, param := range []string{"a", "b"} {
+		snapshotID, _ := params.Get(param)
+
+		snapshots[i], err = c.SnapshotStore.Get(claims.UserID, id, snapshotID)
+		if err != nil {
+			return err
+		}
+	}
+
+	diff, err := DiffResults(snapshots[0].Result, snapshots[1].Result, key)
+	if err != nil {
+		return &handlerutils.HandlerError{
+			Err: err, Status: http.StatusUnprocessableEntity}
+	}
+
+	return json.NewEncoder(w).Encode(diff)
+}
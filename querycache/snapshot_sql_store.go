@@ -0,0 +1,110 @@
+package querycache
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/honeycombio/beeline-go/wrappers/hnysqlx"
+)
+
+// SQLSnapshotStore defines an SQL implementation of a SnapshotStore
+type SQLSnapshotStore struct {
+	db          *hnysqlx.DB
+	idGenerator utils.IDGenerator
+}
+
+// NewSQLSnapshotStore builds a new SQLSnapshotStore
+func NewSQLSnapshotStore(db *hnysqlx.DB, generator utils.IDGenerator) *SQLSnapshotStore {
+	return &SQLSnapshotStore{db: db, idGenerator: generator}
+}
+
+// Create records a new Snapshot
+func (s *SQLSnapshotStore) Create(cs *CreateSnapshot) (*Snapshot, error) {
+	queryStr := `
+		INSERT INTO querycache_snapshots (id, user_id, query_id, args_hash, hash, row_count, result, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING *`
+
+	var snapshot Snapshot
+	err := s.db.Get(&snapshot, queryStr, s.idGenerator.Generate(), cs.UserID, cs.QueryID,
+		cs.ArgsHash, cs.Hash, len(cs.Result.Rows), cs.Result, cs.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// Get returns the Snapshot of the Query with associated id from the store,
+// along with its Result
+func (s *SQLSnapshotStore) Get(userID, queryID, id string) (*Snapshot, error) {
+	var snapshot Snapshot
+
+	queryStr := "SELECT * FROM querycache_snapshots WHERE id = $1 AND query_id = $2 AND user_id = $3"
+
+	if err := s.db.Get(&snapshot, queryStr, id, queryID, userID); err != nil {
+		return nil, err
+	}
+
+	return &snapshot, nil
+}
+
+// List returns the requested Snapshots of a Query for the given arguments,
+// most recent first and without their Results
+func (s *SQLSnapshotStore) List(userID, queryID, argsHash string, page, per int) ([]*Snapshot, error) {
+	if page < 1 || per < 1 {
+		return nil,
+			fmt.Errorf("page and per must be greater than 0 (page %v) (per %v)",
+				page, per)
+	}
+
+	snapshots := []*Snapshot{}
+
+	queryStr := `
+		SELECT id, user_id, query_id, args_hash, hash, row_count, created_at
+		FROM querycache_snapshots
+		WHERE user_id = $1
+		AND query_id = $2
+		AND args_hash = $3
+		ORDER BY created_at DESC
+		OFFSET $4
+		LIMIT $5`
+	if err := s.db.Select(&snapshots, queryStr, userID, queryID, argsHash, (page-1)*per, per); err != nil {
+		return nil, err
+	}
+
+	return snapshots, nil
+}
+
+// Prune deletes the Snapshots of a Query for the given arguments beyond the
+// most recent keep and those created before the given time, returning how
+// many were deleted
+func (s *SQLSnapshotStore) Prune(queryID, argsHash string, keep int, before time.Time) (int64, error) {
+	queryStr := `
+		DELETE FROM querycache_snapshots
+		WHERE query_id = $1
+		AND args_hash = $2
+		AND (
+			($3 > 0 AND id NOT IN (
+				SELECT id
+				FROM querycache_snapshots
+				WHERE query_id = $1
+				AND args_hash = $2
+				ORDER BY created_at DESC
+				LIMIT $3))
+			OR created_at < $4)`
+
+	var cutoff sql.NullTime
+	if !before.IsZero() {
+		cutoff = sql.NullTime{Time: before, Valid: true}
+	}
+
+	result, err := s.db.Exec(queryStr, queryID, argsHash, keep, cutoff)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
@@ -0,0 +1,109 @@
+package querycache
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Snapshot is a retained copy of a Result of a Query, for the Arguments
+// hashed as ArgsHash. Hash is a hash of the Result's content.
+// Result is only set when fetching a single Snapshot.
+type Snapshot struct {
+	ID        string    `json:"id"`
+	UserID    string    `json:"userId" db:"user_id"`
+	QueryID   string    `json:"queryId" db:"query_id"`
+	ArgsHash  string    `json:"argsHash" db:"args_hash"`
+	Hash      string    `json:"hash"`
+	RowCount  int       `json:"rowCount" db:"row_count"`
+	Result    *Result   `json:"result,omitempty"`
+	CreatedAt time.Time `json:"createdAt" db:"created_at"`
+}
+
+// CreateSnapshot describes the parameters to record a new Snapshot
+type CreateSnapshot struct {
+	UserID    string
+	QueryID   string
+	ArgsHash  string
+	Hash      string
+	Result    *Result
+	CreatedAt time.Time
+}
+
+// SnapshotStore describes a generic Store for Snapshots.
+// Prune deletes the Snapshots of a Query and ArgsHash beyond the most recent
+// keep, if set, and those created before the given time, if not zero.
+type SnapshotStore interface {
+	Create(*CreateSnapshot) (*Snapshot, error)
+	Get(userID, queryID, id string) (*Snapshot, error)
+	List(userID, queryID, argsHash string, page, per int) ([]*Snapshot, error)
+	Prune(queryID, argsHash string, keep int, before time.Time) (int64, error)
+}
+
+// Value satisfies the driver.Valuer interface, Results are persisted as JSON
+func (result *Result) Value() (driver.Value, error) {
+	b, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+
+	return string(b), nil
+}
+
+// Scan satisfies the sql.Scanner interface
+func (result *Result) Scan(src interface{}) error {
+	var value string
+
+	switch v := src.(type) {
+	case []byte:
+		value = string(v)
+	case string:
+		value = v
+	default:
+		return fmt.Errorf("cannot scan %T into Result", src)
+	}
+
+	// preserve integers and exact numbers
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+
+	return decoder.Decode(result)
+}
+
+// snapshots determines whether the Query retains Snapshots of its results
+func (query *Query) snapshots() bool {
+	return query.SnapshotCount > 0 || query.SnapshotRetention > 0
+}
+
+// snapshot retains the result of the query, executed with the arguments
+// hashed as argsHash, and prunes Snapshots beyond the query's retention policy
+func snapshot(store SnapshotStore, query *Query, argsHash string, entry *cacheEntry) {
+	if store == nil || !query.snapshots() {
+		return
+	}
+
+	_, err := store.Create(&CreateSnapshot{
+		UserID:    query.UserID,
+		QueryID:   query.ID,
+		ArgsHash:  argsHash,
+		Hash:      entry.Hash,
+		Result:    entry.Result,
+		CreatedAt: entry.ExecutedAt,
+	})
+	if err != nil {
+		log.Printf("querycache: failed to snapshot query %v: %v", query.ID, err)
+		return
+	}
+
+	var before time.Time
+	if query.SnapshotRetention > 0 {
+		before = entry.ExecutedAt.Add(-time.Duration(query.SnapshotRetention))
+	}
+
+	if _, err := store.Prune(query.ID, argsHash, query.SnapshotCount, before); err != nil {
+		log.Printf("querycache: failed to prune snapshots of query %v: %v", query.ID, err)
+	}
+}
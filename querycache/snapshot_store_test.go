@@ -0,0 +1,76 @@
+package querycache_test
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/google/uuid"
+)
+
+func TestSQLSnapshotStore(t *testing.T) {
+	t.Parallel()
+
+	db, teardown := utils.TestDB(t)
+	defer teardown()
+
+	now := time.Now().Truncate(time.Millisecond)
+	userID := uuid.New().String()
+	datasources := newTestDatasourceStore(db, now, uuid.New().String())
+	queries := newTestQueryStore(db, now, uuid.New().String())
+	store := querycache.NewSQLSnapshotStore(db, &utils.UUIDGenerator{})
+
+	datasource, err := datasources.Create(userID, &querycache.CreateDatasource{})
+	expect.Ok(t, err)
+
+	query, err := queries.Create(userID, &querycache.CreateQuery{Query: "SELECT 1", DatasourceID: datasource.ID})
+	expect.Ok(t, err)
+
+	ids := []string{}
+	for i := 0; i < 3; i++ {
+		snapshot, err := store.Create(&querycache.CreateSnapshot{
+			UserID:    userID,
+			QueryID:   query.ID,
+			Hash:      "hash",
+			Result:    testResult(),
+			CreatedAt: now.Add(time.Duration(i) * time.Hour),
+		})
+		expect.Ok(t, err)
+		expect.Equal(t, 3, snapshot.RowCount)
+
+		ids = append(ids, snapshot.ID)
+	}
+
+	snapshot, err := store.Get(userID, query.ID, ids[0])
+	expect.Ok(t, err)
+	expect.Equal(t, [][]interface{}{
+		{json.Number("1"), "a,b"}, {json.Number("2"), "<c>"}, {json.Number("3"), nil}}, snapshot.Result.Rows)
+
+	_, err = store.Get(uuid.New().String(), query.ID, ids[0])
+	expect.Equal(t, sql.ErrNoRows, err)
+
+	snapshots, err := store.List(userID, query.ID, "", 1, 2)
+	expect.Ok(t, err)
+	expect.Equal(t, 2, len(snapshots))
+	expect.Equal(t, ids[2], snapshots[0].ID)
+	expect.True(t, snapshots[0].Result == nil)
+
+	// keep the two most recent
+	deleted, err := store.Prune(query.ID, "", 2, time.Time{})
+	expect.Ok(t, err)
+	expect.Equal(t, int64(1), deleted)
+
+	// and those created in the last hour
+	deleted, err = store.Prune(query.ID, "", 0, now.Add(90*time.Minute))
+	expect.Ok(t, err)
+	expect.Equal(t, int64(1), deleted)
+
+	snapshots, err = store.List(userID, query.ID, "", 1, 25)
+	expect.Ok(t, err)
+	expect.Equal(t, 1, len(snapshots))
+	expect.Equal(t, ids[2], snapshots[0].ID)
+}
@@ -0,0 +1,270 @@
+//go:build sqlite
+// +build sqlite
+
+package querycache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// sqliteMemory is the path of in memory sqlite databases
+const sqliteMemory = ":memory:"
+
+// sqliteFixture is the parameter of the options of in memory sqlite datasources
+// naming the SQL script they are seeded from
+const sqliteFixture = "fixture"
+
+// sqlitePathEscaper escapes the characters of paths which are special in
+// sqlite URIs
+var sqlitePathEscaper = strings.NewReplacer("%", "%25", "?", "%3f", "#", "%23")
+
+// sqliteDir is the directory the files of sqlite datasources are confined to,
+// set once by EnableSQLite
+var sqliteDir string
+
+// EnableSQLite registers the sqlite Driver, its databases and fixtures being
+// resolved relative to dir, it may only be called once. sqlite datasources read
+// and write files on the server, so they are meant for local development and
+// tests only.
+func EnableSQLite(dir string) error {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+
+	info, err := os.Stat(dir)
+	if err != nil {
+		return err
+	}
+
+	if !info.IsDir() {
+		return fmt.Errorf("%v is not a directory", dir)
+	}
+
+	sqliteDir = dir
+
+	RegisterDriver(&Driver{
+		Name:  "sqlite",
+		Label: "SQLite",
+		Options: []DriverOption{
+			{Name: "path", Label: "Path", Type: OptionString},
+			{Name: "memory", Label: "In memory", Type: OptionBoolean, Default: false},
+			{Name: "fixture", Label: "Fixture", Type: OptionString},
+		},
+		DSN:     sqliteDSN,
+		Open:    openSQLite,
+		Version: "SELECT sqlite_version()",
+	})
+
+	return nil
+}
+
+// sqliteFile resolves the path of a sqlite database or fixture within
+// sqliteDir, paths must be relative and may not contain ..
+func sqliteFile(path string) (string, error) {
+	if filepath.IsAbs(path) || strings.HasPrefix(path, "/") {
+		return "", fmt.Errorf("sqlite path %q must be relative", path)
+	}
+
+	for _, element := range strings.Split(filepath.ToSlash(path), "/") {
+		if element == ".." {
+			return "", fmt.Errorf("sqlite path %q may not contain ..", path)
+		}
+	}
+
+	return filepath.Join(sqliteDir, path), nil
+}
+
+// sqliteOptions are the options of sqlite datasources, a sqlite URI: the path
+// of the database file, or :memory:, and the parameters of the URI
+type sqliteOptions struct {
+	path   string
+	params url.Values
+}
+
+// parseSQLiteOptions parses the options of sqlite datasources, the file: scheme
+// of the URI is optional
+func parseSQLiteOptions(options string) (*sqliteOptions, error) {
+	path, query := strings.TrimPrefix(options, "file:"), ""
+	if i := strings.Index(path, "?"); i >= 0 {
+		path, query = path[:i], path[i+1:]
+	}
+
+	path, err := url.PathUnescape(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if path == "" {
+		return nil, errors.New("the path of the sqlite database is required")
+	}
+
+	params, err := url.ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	for name := range params {
+		if name != sqliteFixture {
+			return nil, fmt.Errorf("unknown sqlite parameter %q", name)
+		}
+	}
+
+	return &sqliteOptions{path: path, params: params}, nil
+}
+
+func (options *sqliteOptions) memory() bool {
+	return options.path == sqliteMemory
+}
+
+func (options *sqliteOptions) String() string {
+	uri := "file:" + sqlitePathEscaper.Replace(options.path)
+	if len(options.params) > 0 {
+		uri += "?" + options.params.Encode()
+	}
+
+	return uri
+}
+
+func sqliteDSN(config DriverConfig) (string, error) {
+	options := &sqliteOptions{path: config.String("path"), params: url.Values{}}
+	fixture := config.String("fixture")
+
+	if config.Bool("memory") {
+		if options.path != "" {
+			return "", errors.New("in memory sqlite datasources may not set a path")
+		}
+
+		options.path = sqliteMemory
+		if fixture != "" {
+			if _, err := sqliteFile(fixture); err != nil {
+				return "", err
+			}
+
+			options.params.Set(sqliteFixture, fixture)
+		}
+	} else {
+		if options.path == "" {
+			return "", errors.New(`option "path" is required unless "memory" is set`)
+		}
+
+		if _, err := sqliteFile(options.path); err != nil {
+			return "", err
+		}
+
+		if fixture != "" {
+			return "", errors.New("only in memory sqlite datasources may be seeded from a fixture")
+		}
+	}
+
+	return options.String(), nil
+}
+
+// openSQLite opens a pool of connections to the sqlite database of the
+// Datasource, within sqliteDir. Files are opened read-only if the Datasource
+// is, each connection to an in memory database holds its own copy of it, seeded
+// from the fixture.
+func openSQLite(datasource *Datasource) (*sql.DB, error) {
+	options, err := parseSQLiteOptions(datasource.Options)
+	if err != nil {
+		return nil, err
+	}
+
+	connector := &sqliteConnector{readOnly: datasource.ReadOnly}
+
+	fixture := options.params.Get(sqliteFixture)
+	options.params.Del(sqliteFixture)
+
+	if options.memory() {
+		if fixture != "" {
+			path, err := sqliteFile(fixture)
+			if err != nil {
+				return nil, err
+			}
+
+			// the fixture's contents or location on the server are not
+			// reported back
+			script, err := ioutil.ReadFile(path)
+			if err != nil {
+				log.Printf("querycache: failed to read sqlite fixture: %v", err)
+
+				return nil, fmt.Errorf("the sqlite fixture %q could not be read", fixture)
+			}
+
+			connector.fixture, connector.script = fixture, string(script)
+		}
+	} else {
+		if fixture != "" {
+			return nil, errors.New("only in memory sqlite datasources may be seeded from a fixture")
+		}
+
+		options.path, err = sqliteFile(options.path)
+		if err != nil {
+			return nil, err
+		}
+
+		if datasource.ReadOnly {
+			options.params.Set("mode", "ro")
+		}
+	}
+
+	connector.dsn = options.String()
+
+	return sql.OpenDB(connector), nil
+}
+
+// sqliteConnector opens connections to a sqlite database, which may not attach
+// other databases, running the fixture's script against each of them, and
+// making them query only if read-only
+type sqliteConnector struct {
+	dsn      string
+	fixture  string
+	script   string
+	readOnly bool
+}
+
+func (c *sqliteConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Driver().Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	sqliteConn := conn.(*sqlite3.SQLiteConn)
+
+	// ATTACH could open any file the server can
+	sqliteConn.SetLimit(sqlite3.SQLITE_LIMIT_ATTACHED, 0)
+
+	if c.script != "" {
+		if _, err := sqliteConn.ExecContext(ctx, c.script, nil); err != nil {
+			sqliteConn.Close()
+			log.Printf("querycache: failed to run sqlite fixture %v: %v", c.fixture, err)
+
+			return nil, fmt.Errorf("the sqlite fixture %q failed to run", c.fixture)
+		}
+	}
+
+	if c.readOnly {
+		if _, err := sqliteConn.ExecContext(ctx, "PRAGMA query_only = ON", nil); err != nil {
+			sqliteConn.Close()
+			return nil, err
+		}
+	}
+
+	return sqliteConn, nil
+}
+
+func (c *sqliteConnector) Driver() driver.Driver {
+	return &sqlite3.SQLiteDriver{}
+}
@@ -0,0 +1,11 @@
+//go:build !sqlite
+// +build !sqlite
+
+package querycache
+
+import "errors"
+
+// EnableSQLite fails, the sqlite Driver is only built with the sqlite tag
+func EnableSQLite(dir string) error {
+	return errors.New("sqlite datasources require building with -tags sqlite")
+}
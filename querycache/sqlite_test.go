@@ -0,0 +1,249 @@
+//go:build sqlite
+// +build sqlite
+
+package querycache_test
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils"
+	"github.com/cga1123/bissy-api/utils/expect"
+	"github.com/google/uuid"
+)
+
+var (
+	enableSQLite sync.Once
+	sqliteErr    error
+)
+
+// sqliteDriver enables sqlite datasources, confined to testdata
+func sqliteDriver(t *testing.T) *querycache.Driver {
+	enableSQLite.Do(func() { sqliteErr = querycache.EnableSQLite("testdata") })
+	expect.Ok(t, sqliteErr)
+
+	driver, ok := querycache.LookupDriver("sqlite")
+	expect.True(t, ok)
+
+	return driver
+}
+
+// sqliteTestFile returns the name of a new file in testdata, removed once the
+// test is done
+func sqliteTestFile(t *testing.T, extension string) string {
+	name := uuid.New().String() + extension
+	t.Cleanup(func() { os.Remove(filepath.Join("testdata", name)) })
+
+	return name
+}
+
+func sqliteDatasource(t *testing.T, config querycache.DriverConfig, readOnly bool) *querycache.Datasource {
+	options, err := sqliteDriver(t).Configure(config)
+	expect.Ok(t, err)
+
+	return &querycache.Datasource{ID: uuid.New().String(), Type: "sqlite", Options: options, ReadOnly: readOnly}
+}
+
+func TestSQLiteMemory(t *testing.T) {
+	t.Parallel()
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{MaxOpen: 2})
+	datasource := sqliteDatasource(t,
+		querycache.DriverConfig{"memory": true, "fixture": "sqlite_fixture.sql"}, true)
+	defer connections.Close(datasource.ID)
+
+	executor, err := datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	query := &querycache.Query{
+		ID:       "1",
+		Query:    "SELECT id, email, score, created_at FROM users WHERE score > {{min}} OR score IS NULL ORDER BY id",
+		Params:   querycache.Parameters{{Name: "min", Type: querycache.ParameterNumber, Required: true}},
+		Lifetime: querycache.Duration(time.Hour),
+	}
+	args := querycache.Arguments{"min": float64(50)}
+
+	result, err := executor.Execute(context.Background(), query, args)
+	expect.Ok(t, err)
+	expect.Equal(t, []querycache.Column{
+		{Name: "id", Type: "INTEGER"},
+		{Name: "email", Type: "TEXT"},
+		{Name: "score", Type: "REAL"},
+		{Name: "created_at", Type: "TIMESTAMP"},
+	}, result.Columns)
+	expect.Equal(t, [][]interface{}{
+		{int64(1), "ada@example.com", 72.5, "2021-07-01T09:30:00Z"},
+		{int64(2), "grace@example.com", nil, "2021-07-02T14:00:00Z"},
+	}, result.Rows)
+
+	// results are cached as any other datasource's
+	expected, err := json.Marshal(result)
+	expect.Ok(t, err)
+
+	cached := &querycache.CachedExecutor{
+		Cache:    querycache.NewInMemoryCache(),
+		Executor: executor,
+		Clock:    &utils.RealClock{},
+	}
+
+	for _, hit := range []bool{false, true} {
+		recorder := &resultWriter{}
+		writer := &infoWriter{RowWriter: recorder}
+		expect.Ok(t, cached.Stream(context.Background(), query, args, writer))
+
+		actual, err := json.Marshal(recorder.result())
+		expect.Ok(t, err)
+		expect.Equal(t, string(expected), string(actual))
+		expect.Equal(t, hit, writer.info != nil)
+	}
+
+	// read-only databases may not be written to
+	_, err = executor.Execute(context.Background(), &querycache.Query{Query: "DELETE FROM users"}, nil)
+	expect.True(t, err != nil)
+
+	catalog, err := executor.(querycache.Cataloger).Catalog(context.Background())
+	expect.Ok(t, err)
+	expect.Equal(t, 1, len(catalog.Schemas))
+	expect.Equal(t, "high_scores", catalog.Schemas[0].Tables[0].Name)
+	expect.Equal(t, "VIEW", catalog.Schemas[0].Tables[0].Type)
+	expect.Equal(t, "users", catalog.Schemas[0].Tables[1].Name)
+	expect.Equal(t, querycache.CatalogColumn{Name: "score", Type: "REAL", Nullable: true},
+		catalog.Schemas[0].Tables[1].Columns[2])
+
+	report := datasource.TestConnection(context.Background())
+	expect.True(t, report.OK())
+	expect.True(t, strings.HasPrefix(report.ServerVersion, "3."))
+}
+
+func TestSQLiteFile(t *testing.T) {
+	t.Parallel()
+
+	path := sqliteTestFile(t, ".db")
+
+	db, err := sql.Open("sqlite3", filepath.Join("testdata", path))
+	expect.Ok(t, err)
+	_, err = db.Exec("CREATE TABLE events (name TEXT); INSERT INTO events VALUES ('signup')")
+	expect.Ok(t, err)
+	expect.Ok(t, db.Close())
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+	datasource := sqliteDatasource(t, querycache.DriverConfig{"path": path}, true)
+	defer connections.Close(datasource.ID)
+
+	count := &querycache.Query{Query: "SELECT count(*) n FROM events"}
+	insert := &querycache.Query{Query: "INSERT INTO events VALUES ('login')"}
+
+	executor, err := datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	result, err := executor.Execute(context.Background(), count, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, [][]interface{}{{int64(1)}}, result.Rows)
+
+	_, err = executor.Execute(context.Background(), insert, nil)
+	expect.True(t, err != nil)
+
+	// files are only written to by writable datasources
+	datasource.ReadOnly = false
+	executor, err = datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	_, err = executor.Execute(context.Background(), insert, nil)
+	expect.Ok(t, err)
+
+	result, err = executor.Execute(context.Background(), count, nil)
+	expect.Ok(t, err)
+	expect.Equal(t, [][]interface{}{{int64(2)}}, result.Rows)
+
+	// read-only datasources are not created
+	missing := sqliteDatasource(t, querycache.DriverConfig{"path": path + ".missing"}, true)
+	expect.False(t, missing.TestConnection(context.Background()).OK())
+}
+
+func TestSQLiteConfigure(t *testing.T) {
+	t.Parallel()
+
+	driver := sqliteDriver(t)
+
+	dsn, err := driver.Configure(querycache.DriverConfig{"path": "data/my db?.sqlite"})
+	expect.Ok(t, err)
+	expect.Equal(t, "file:data/my db%3f.sqlite", dsn)
+
+	dsn, err = driver.Configure(querycache.DriverConfig{"memory": true, "fixture": "seed.sql"})
+	expect.Ok(t, err)
+	expect.Equal(t, "file::memory:?fixture=seed.sql", dsn)
+
+	for _, config := range []querycache.DriverConfig{
+		{},
+		{"memory": true, "path": "data.sqlite"},
+		{"path": "data.sqlite", "fixture": "seed.sql"},
+		{"path": "/etc/passwd"},
+		{"path": "../go.mod"},
+		{"path": "data/../../go.mod"},
+		{"memory": true, "fixture": "/etc/passwd"},
+		{"memory": true, "fixture": "../go.mod"},
+	} {
+		_, err := driver.Configure(config)
+		expect.True(t, err != nil)
+	}
+}
+
+func TestSQLiteConfined(t *testing.T) {
+	t.Parallel()
+
+	sqliteDriver(t)
+
+	// options set directly are confined as those built from a config
+	for _, options := range []string{
+		"file:/etc/hosts",
+		"file:../go.mod",
+		"file::memory:?fixture=..%2Fgo.mod",
+		"file:data.db?vfs=unix-none",
+	} {
+		datasource := &querycache.Datasource{Type: "sqlite", Options: options}
+
+		report := datasource.TestConnection(context.Background())
+		expect.False(t, report.OK())
+		expect.Equal(t, querycache.ConnectionErrorOptions, report.Error.Category)
+	}
+
+	connections := querycache.NewConnections(querycache.ConnectionOptions{})
+	datasource := sqliteDatasource(t, querycache.DriverConfig{"memory": true}, false)
+	defer connections.Close(datasource.ID)
+
+	executor, err := datasource.NewExecutor(connections)
+	expect.Ok(t, err)
+
+	// other databases may not be attached, even to writable datasources
+	attached := filepath.Join(t.TempDir(), "attached.db")
+	attach := &querycache.Query{Query: "ATTACH DATABASE '" + attached + "' AS attached"}
+	_, err = executor.Execute(context.Background(), attach, nil)
+	expect.True(t, err != nil)
+
+	_, err = os.Stat(attached)
+	expect.True(t, os.IsNotExist(err))
+
+	// failing fixtures don't report their contents
+	fixture := sqliteTestFile(t, ".sql")
+	expect.Ok(t, ioutil.WriteFile(filepath.Join("testdata", fixture), []byte("secret_token 42"), 0600))
+
+	for name, expected := range map[string]string{
+		fixture:       "the sqlite fixture \"" + fixture + "\" failed to run",
+		"missing.sql": "the sqlite fixture \"missing.sql\" could not be read",
+	} {
+		seeded := sqliteDatasource(t, querycache.DriverConfig{"memory": true, "fixture": name}, true)
+
+		report := seeded.TestConnection(context.Background())
+		expect.False(t, report.OK())
+		expect.Equal(t, expected, report.Error.Detail)
+	}
+}
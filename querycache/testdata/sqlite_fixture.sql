@@ -0,0 +1,13 @@
+CREATE TABLE users (
+	id INTEGER PRIMARY KEY,
+	email TEXT NOT NULL,
+	score REAL,
+	created_at TIMESTAMP NOT NULL
+);
+
+CREATE VIEW high_scores AS SELECT email, score FROM users WHERE score >= 50;
+
+INSERT INTO users (id, email, score, created_at) VALUES
+	(1, 'ada@example.com', 72.5, '2021-07-01 09:30:00'),
+	(2, 'grace@example.com', NULL, '2021-07-02 14:00:00'),
+	(3, 'alan@example.com', 41, '2021-07-03 18:45:00');
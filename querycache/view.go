@@ -0,0 +1,328 @@
+package querycache
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The operators Filters may compare values with
+var filterOperators = map[string]func(int) bool{
+	"eq":  func(c int) bool { return c == 0 },
+	"ne":  func(c int) bool { return c != 0 },
+	"lt":  func(c int) bool { return c < 0 },
+	"lte": func(c int) bool { return c <= 0 },
+	"gt":  func(c int) bool { return c > 0 },
+	"gte": func(c int) bool { return c >= 0 },
+}
+
+// Filter keeps the rows of a Result whose value in Column compares to Value
+// according to Operator
+type Filter struct {
+	Column   string
+	Operator string
+	Value    string
+}
+
+// SortKey orders the rows of a Result by the values in Column
+type SortKey struct {
+	Column     string
+	Descending bool
+}
+
+// ResultView describes a page of a Result, with only the given Columns, of
+// the rows matching all of its Filters ordered by its Sort keys.
+// A zero Limit means no limit, and no Columns means all of them.
+type ResultView struct {
+	Offset  int
+	Limit   int
+	Columns []string
+	Filters []Filter
+	Sort    []SortKey
+}
+
+func listParam(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// parseFilterKey parses filter[column] and filter[column][operator] keys
+func parseFilterKey(key string) (string, string, bool) {
+	if !strings.HasPrefix(key, "filter[") || !strings.HasSuffix(key, "]") {
+		return "", "", false
+	}
+
+	parts := strings.SplitN(strings.TrimSuffix(strings.TrimPrefix(key, "filter["), "]"), "][", 2)
+	if len(parts) == 1 {
+		return parts[0], "eq", true
+	}
+
+	return parts[0], parts[1], true
+}
+
+// ParseResultView builds a ResultView from the offset, limit, columns, sort
+// and filter[column] query parameters. It returns nil if none are set.
+func ParseResultView(values map[string][]string) (*ResultView, error) {
+	view := &ResultView{}
+	set := false
+
+	param := func(key string) (string, bool) {
+		v, ok := values[key]
+		if !ok || len(v) == 0 {
+			return "", false
+		}
+
+		set = true
+
+		return v[0], true
+	}
+
+	if offset, ok := param("offset"); ok {
+		value, err := strconv.Atoi(offset)
+		if err != nil || value < 0 {
+			return nil, fmt.Errorf("offset must be a non-negative integer")
+		}
+
+		view.Offset = value
+	}
+
+	if limit, ok := param("limit"); ok {
+		value, err := strconv.Atoi(limit)
+		if err != nil || value < 1 {
+			return nil, fmt.Errorf("limit must be a positive integer")
+		}
+
+		view.Limit = value
+	}
+
+	if columns, ok := param("columns"); ok {
+		view.Columns = listParam(columns)
+	}
+
+	if keys, ok := param("sort"); ok {
+		for _, key := range listParam(keys) {
+			view.Sort = append(view.Sort, SortKey{
+				Column:     strings.TrimPrefix(key, "-"),
+				Descending: strings.HasPrefix(key, "-"),
+			})
+		}
+	}
+
+	// sorted for filters to be applied in a stable order
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		column, operator, ok := parseFilterKey(key)
+		if !ok {
+			continue
+		}
+
+		if _, ok := filterOperators[operator]; !ok {
+			return nil, fmt.Errorf("unknown filter operator %q", operator)
+		}
+
+		set = true
+		for _, value := range values[key] {
+			view.Filters = append(view.Filters, Filter{Column: column, Operator: operator, Value: value})
+		}
+	}
+
+	if !set {
+		return nil, nil
+	}
+
+	return view, nil
+}
+
+// numericValue returns the value as a float64, if it is a number or a string
+// holding one (as exact decimals are)
+func numericValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	case json.Number:
+		f, err := v.Float64()
+		return f, err == nil
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	default:
+		return 0, false
+	}
+}
+
+// compareValues compares two Result values, numerically if both are numbers
+// and by their text representation otherwise. NULLs sort after all values.
+func compareValues(a, b interface{}) int {
+	switch {
+	case a == nil && b == nil:
+		return 0
+	case a == nil:
+		return 1
+	case b == nil:
+		return -1
+	}
+
+	x, xok := numericValue(a)
+	y, yok := numericValue(b)
+	if xok && yok {
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		default:
+			return 0
+		}
+	}
+
+	return strings.Compare(valueString(a, ""), valueString(b, ""))
+}
+
+// matches determines whether value passes the Filter, NULLs only pass ne
+func (filter Filter) matches(value interface{}) bool {
+	if value == nil {
+		return filter.Operator == "ne"
+	}
+
+	return filterOperators[filter.Operator](compareValues(value, filter.Value))
+}
+
+func columnIndex(columns []Column, name string) (int, error) {
+	for i, column := range columns {
+		if column.Name == name {
+			return i, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown column %q", name)
+}
+
+// Validate checks that all the columns the view filters, sorts and projects
+// by are among the given columns
+func (view *ResultView) Validate(columns []Column) error {
+	names := append([]string{}, view.Columns...)
+	for _, filter := range view.Filters {
+		names = append(names, filter.Column)
+	}
+
+	for _, key := range view.Sort {
+		names = append(names, key.Column)
+	}
+
+	for _, name := range names {
+		if _, err := columnIndex(columns, name); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Apply returns the page of the Result described by the view, along with the
+// total number of rows matching its Filters
+func (view *ResultView) Apply(result *Result) (*Result, int, error) {
+	rows := [][]interface{}{}
+
+	filters := make([]int, len(view.Filters))
+	for i, filter := range view.Filters {
+		index, err := columnIndex(result.Columns, filter.Column)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		filters[i] = index
+	}
+
+	for _, row := range result.Rows {
+		matched := true
+		for i, filter := range view.Filters {
+			if !filter.matches(row[filters[i]]) {
+				matched = false
+				break
+			}
+		}
+
+		if matched {
+			rows = append(rows, row)
+		}
+	}
+
+	keys := make([]int, len(view.Sort))
+	for i, key := range view.Sort {
+		index, err := columnIndex(result.Columns, key.Column)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		keys[i] = index
+	}
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		for k, key := range view.Sort {
+			c := compareValues(rows[i][keys[k]], rows[j][keys[k]])
+			if key.Descending {
+				c = -c
+			}
+
+			if c != 0 {
+				return c < 0
+			}
+		}
+
+		return false
+	})
+
+	total := len(rows)
+	start := view.Offset
+	if start > total {
+		start = total
+	}
+
+	end := total
+	if view.Limit > 0 && start+view.Limit < end {
+		end = start + view.Limit
+	}
+
+	rows = rows[start:end]
+
+	if len(view.Columns) == 0 {
+		return &Result{Columns: result.Columns, Rows: rows, Truncated: result.Truncated}, total, nil
+	}
+
+	columns := make([]Column, len(view.Columns))
+	projection := make([]int, len(view.Columns))
+	for i, name := range view.Columns {
+		index, err := columnIndex(result.Columns, name)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		columns[i] = result.Columns[index]
+		projection[i] = index
+	}
+
+	projected := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		projected[i] = make([]interface{}, len(projection))
+		for j, index := range projection {
+			projected[i][j] = row[index]
+		}
+	}
+
+	return &Result{Columns: columns, Rows: projected, Truncated: result.Truncated}, total, nil
+}
@@ -0,0 +1,133 @@
+package querycache_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/cga1123/bissy-api/querycache"
+	"github.com/cga1123/bissy-api/utils/expect"
+)
+
+func viewResult() *querycache.Result {
+	return &querycache.Result{
+		Columns: []querycache.Column{
+			{Name: "country", Type: "TEXT"}, {Name: "revenue", Type: "INT8"}, {Name: "share", Type: "NUMERIC"}},
+		Rows: [][]interface{}{
+			{"GB", int64(300), "0.30"},
+			{"FR", json.Number("100"), "0.10"},
+			{"GB", int64(50), nil},
+			{nil, int64(550), "0.55"},
+		},
+	}
+}
+
+func TestParseResultView(t *testing.T) {
+	t.Parallel()
+
+	view, err := querycache.ParseResultView(map[string][]string{"format": {"csv"}, "param.a": {"1"}})
+	expect.Ok(t, err)
+	expect.True(t, view == nil)
+
+	view, err = querycache.ParseResultView(map[string][]string{
+		"offset":         {"10"},
+		"limit":          {"5"},
+		"columns":        {"a, b"},
+		"sort":           {"-b,a"},
+		"filter[a]":      {"GB"},
+		"filter[a][ne]":  {"FR", "DE"},
+		"filter[b][gte]": {"100"},
+		"filter[c][lt]":  {"2020-01-01"},
+		"param.a":        {"1"},
+	})
+	expect.Ok(t, err)
+	expect.Equal(t, &querycache.ResultView{
+		Offset:  10,
+		Limit:   5,
+		Columns: []string{"a", "b"},
+		Sort:    []querycache.SortKey{{Column: "b", Descending: true}, {Column: "a"}},
+		Filters: []querycache.Filter{
+			{Column: "a", Operator: "eq", Value: "GB"},
+			{Column: "a", Operator: "ne", Value: "FR"},
+			{Column: "a", Operator: "ne", Value: "DE"},
+			{Column: "b", Operator: "gte", Value: "100"},
+			{Column: "c", Operator: "lt", Value: "2020-01-01"},
+		},
+	}, view)
+
+	for _, values := range []map[string][]string{
+		{"offset": {"-1"}},
+		{"limit": {"0"}},
+		{"limit": {"many"}},
+		{"filter[a][like]": {"x"}},
+	} {
+		_, err := querycache.ParseResultView(values)
+		expect.Error(t, err)
+	}
+}
+
+func TestResultViewApply(t *testing.T) {
+	t.Parallel()
+
+	view := &querycache.ResultView{
+		Columns: []string{"revenue", "country"},
+		Filters: []querycache.Filter{{Column: "revenue", Operator: "gte", Value: "100"}},
+		Sort:    []querycache.SortKey{{Column: "revenue", Descending: true}},
+		Offset:  1,
+		Limit:   1,
+	}
+
+	result, total, err := view.Apply(viewResult())
+	expect.Ok(t, err)
+	expect.Equal(t, 3, total)
+	expect.Equal(t, &querycache.Result{
+		Columns: []querycache.Column{{Name: "revenue", Type: "INT8"}, {Name: "country", Type: "TEXT"}},
+		Rows:    [][]interface{}{{int64(300), "GB"}},
+	}, result)
+
+	// NULLs only match ne, and sort last
+	view = &querycache.ResultView{
+		Filters: []querycache.Filter{{Column: "country", Operator: "ne", Value: "FR"}},
+		Sort:    []querycache.SortKey{{Column: "share"}},
+	}
+
+	result, total, err = view.Apply(viewResult())
+	expect.Ok(t, err)
+	expect.Equal(t, 3, total)
+	expect.Equal(t, [][]interface{}{
+		{"GB", int64(300), "0.30"},
+		{nil, int64(550), "0.55"},
+		{"GB", int64(50), nil},
+	}, result.Rows)
+
+	// offsets past the end are empty
+	result, total, err = (&querycache.ResultView{Offset: 10}).Apply(viewResult())
+	expect.Ok(t, err)
+	expect.Equal(t, 4, total)
+	expect.Equal(t, [][]interface{}{}, result.Rows)
+
+	_, _, err = (&querycache.ResultView{Columns: []string{"missing"}}).Apply(viewResult())
+	expect.Error(t, err)
+
+	_, _, err = (&querycache.ResultView{Sort: []querycache.SortKey{{Column: "missing"}}}).Apply(viewResult())
+	expect.Error(t, err)
+}
+
+func TestResultViewValidate(t *testing.T) {
+	t.Parallel()
+
+	columns := viewResult().Columns
+
+	expect.Ok(t, (&querycache.ResultView{
+		Columns: []string{"country"},
+		Filters: []querycache.Filter{{Column: "revenue", Operator: "gt", Value: "100"}},
+		Sort:    []querycache.SortKey{{Column: "share"}},
+	}).Validate(columns))
+
+	for _, view := range []*querycache.ResultView{
+		{Columns: []string{"missing"}},
+		{Filters: []querycache.Filter{{Column: "missing", Operator: "eq", Value: "1"}}},
+		{Sort: []querycache.SortKey{{Column: "missing"}}},
+	} {
+		expect.Error(t, view.Validate(columns))
+	}
+}
@@ -15,6 +15,9 @@ const (
 	ContentTypeJSON      = "application/json; charset=UTF-8"
 	ContentTypePlaintext = "text/plain"
 	ContentTypeCSV       = "text/csv"
+	ContentTypeTSV       = "text/tab-separated-values"
+	ContentTypeNDJSON    = "application/x-ndjson"
+	ContentTypeHTML      = "text/html; charset=UTF-8"
 )
 
 type handlerError interface {